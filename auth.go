@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// User is a local account mapped from the sub claim of an OIDC token
+type User struct {
+	ID      int64  `json:"id"`
+	Subject string `json:"subject"`
+	Email   string `json:"email"`
+	Name    string `json:"name"`
+}
+
+// OIDCAuth verifies bearer tokens issued by an OpenID Connect provider
+type OIDCAuth struct {
+	verifier   *oidc.IDTokenVerifier
+	audiences  []string // accepted values of the aud claim, empty means any
+	autoCreate bool     // create a local user the first time a subject logs in
+}
+
+// Global authenticator object, nil when OIDC is not configured
+var auth *OIDCAuth
+
+// Key type for values stored in a request context
+type contextKey string
+
+// Context key under which the authenticated user is stored
+const userContextKey contextKey = "user"
+
+// Context key under which the verified bearer token is stored
+const tokenContextKey contextKey = "token"
+
+// SetupAuth discovers the OIDC provider and returns an authenticator for its tokens
+func SetupAuth(ctx context.Context, options OIDCOptions) (*OIDCAuth, error) {
+	// If there is no issuer authentication is disabled
+	if options.Issuer == "" {
+		return nil, nil
+	}
+
+	// Fetch the discovery document from the issuer, this also sets up the JWKS endpoint.
+	// The key set is cached and refetched whenever a token is signed with an unknown key ID,
+	// so keys rotated by the provider are picked up without restarting the server.
+	provider, err := oidc.NewProvider(ctx, options.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("[SetupAuth] error discovering OIDC provider: %w", err)
+	}
+
+	// Collect the audiences we accept, ID tokens use the client ID and access tokens usually the API identifier
+	var audiences []string
+	for _, aud := range []string{options.ClientID, options.Audience} {
+		if aud != "" {
+			audiences = append(audiences, aud)
+		}
+	}
+
+	return &OIDCAuth{
+		// The audience is checked by us since both ID and access tokens are accepted
+		verifier:   provider.Verifier(&oidc.Config{SkipClientIDCheck: true}),
+		audiences:  audiences,
+		autoCreate: options.AutoCreate, // create users on their first login
+	}, nil
+}
+
+// Authenticate verifies a raw token and returns the local user it belongs to
+func (a *OIDCAuth) Authenticate(ctx context.Context, rawToken string) (*User, error) {
+	token, err := a.Verify(ctx, rawToken)
+	if err != nil {
+		return nil, err
+	}
+	return a.User(ctx, token)
+}
+
+// Verify checks the signature, issuer, expiry and audience of a raw token and returns it
+func (a *OIDCAuth) Verify(ctx context.Context, rawToken string) (*oidc.IDToken, error) {
+	// Check signature, issuer and expiry of the token
+	token, err := a.verifier.Verify(ctx, rawToken)
+	if err != nil {
+		return nil, fmt.Errorf("[Verify] error verifying token: %w", err)
+	}
+
+	// Make sure the token was meant for us
+	if len(a.audiences) > 0 && !slices.ContainsFunc(token.Audience, func(aud string) bool {
+		return slices.Contains(a.audiences, aud)
+	}) {
+		return nil, errors.New("[Verify] error: token audience is not accepted")
+	}
+
+	return token, nil
+}
+
+// User returns the local user a verified token belongs to from the database of the context, creating it on the
+// first login when allowed
+func (a *OIDCAuth) User(ctx context.Context, token *oidc.IDToken) (*User, error) {
+	// Get optional profile claims, access tokens often don't have them
+	var claims struct {
+		Email string `json:"email"`
+		Name  string `json:"name"`
+	}
+	err := token.Claims(&claims)
+	if err != nil {
+		return nil, fmt.Errorf("[User] error decoding token claims: %w", err)
+	}
+
+	// Look up the local user with the subject of the token
+	user, err := findUser(ctx, token.Subject)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("[User] error looking up user: %w", err)
+	}
+
+	// The subject is unknown so only continue if we're allowed to create it
+	if !a.autoCreate {
+		return nil, errors.New("[User] error: no user with subject " + token.Subject + " exists")
+	}
+
+	// Save user in database, unless a concurrent first request of the same user just did
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	res, err := DBFromContext(ctx).ExecContext(queryCtx, `INSERT INTO user (subject, email, name) VALUES (?, ?, ?)
+		ON CONFLICT (subject) DO NOTHING;`,
+		token.Subject,
+		claims.Email,
+		claims.Name,
+	)
+	ObserveQuery("create_user", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("[User] error creating user: %w", err)
+	}
+	created, err := res.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("[User] error creating user: %w", err)
+	}
+
+	// Get the user back with its generated id, whichever request created it
+	user, err = findUser(ctx, token.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("[User] error looking up created user: %w", err)
+	}
+	if created > 0 {
+		slog.InfoContext(ctx, "created user", "user_id", user.ID, "subject", user.Subject)
+	}
+
+	return user, nil
+}
+
+// findUser returns the local user with a subject, sql.ErrNoRows if there is none
+func findUser(ctx context.Context, subject string) (*User, error) {
+	user := User{Subject: subject}
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	row := DBFromContext(ctx).QueryRowContext(queryCtx, `SELECT id, email, name FROM user WHERE subject = ?;`, subject)
+	err := row.Scan(&user.ID, &user.Email, &user.Name)
+	ObserveQuery("get_user", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// VerifyToken wraps an HTTP handler so that it only runs for requests with a valid bearer token, which is kept in
+// the context for RequireAuth. It runs before the tenant is resolved, so only callers the provider vouches for get
+// a tenant database opened.
+func VerifyToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// If authentication is disabled let every request through
+		if auth == nil {
+			next(w, r)
+			return
+		}
+
+		token, ok := verifyRequest(w, r)
+		if !ok {
+			return
+		}
+
+		// Make the token available to the wrapped handler
+		next(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey, token)))
+	}
+}
+
+// RequireAuth wraps an HTTP handler so that it only runs for authenticated users, looked up in the database of the
+// tenant of the request. The token is verified here unless VerifyToken already did.
+func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// If authentication is disabled let every request through
+		if auth == nil {
+			next(w, r)
+			return
+		}
+
+		token, ok := r.Context().Value(tokenContextKey).(*oidc.IDToken)
+		if !ok {
+			token, ok = verifyRequest(w, r)
+			if !ok {
+				return
+			}
+		}
+
+		// Find the user the token belongs to
+		user, err := auth.User(r.Context(), token)
+		if err != nil {
+			// Log the reason for debugging since the client only gets a generic message
+			slog.WarnContext(r.Context(), "error authenticating", "error", err)
+			// Tell the client how to authenticate
+			w.Header().Add("WWW-Authenticate", `Bearer error="invalid_token"`)
+			// Return the JSON-encoded error message
+			WriteHTTPError(w, r, "Invalid bearer token", http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		// Make the user available to the wrapped handler
+		next(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+	}
+}
+
+// verifyRequest returns the verified bearer token of a request, or responds with a 401 and returns false
+func verifyRequest(w http.ResponseWriter, r *http.Request) (*oidc.IDToken, bool) {
+	// Get the bearer token from the Authorization header
+	rawToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	// Browsers can't set headers when opening a WebSocket so it can come as a query parameter, see RFC 6750
+	if !found && isWebSocket(r) {
+		rawToken = r.URL.Query().Get("access_token")
+		found = true
+	}
+	if !found || rawToken == "" {
+		// Tell the client how to authenticate
+		w.Header().Add("WWW-Authenticate", "Bearer")
+		// Return the JSON-encoded error message
+		WriteHTTPError(w, r, "Missing bearer token", http.StatusUnauthorized, "Unauthorized")
+		return nil, false
+	}
+
+	token, err := auth.Verify(r.Context(), rawToken)
+	if err != nil {
+		// Log the reason for debugging since the client only gets a generic message
+		slog.WarnContext(r.Context(), "error authenticating", "error", err)
+		// Tell the client how to authenticate
+		w.Header().Add("WWW-Authenticate", `Bearer error="invalid_token"`)
+		// Return the JSON-encoded error message
+		WriteHTTPError(w, r, "Invalid bearer token", http.StatusUnauthorized, "Unauthorized")
+		return nil, false
+	}
+	return token, true
+}
+
+// UserFromContext returns the authenticated user stored in the context, if any
+func UserFromContext(ctx context.Context) (*User, bool) {
+	user, ok := ctx.Value(userContextKey).(*User)
+	return user, ok
+}
+
+// HTTP handler for getting the authenticated user
+func ReadMe(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		// Return the JSON-encoded error message
+		WriteHTTPError(w, r, "Authentication is not enabled", http.StatusNotFound, "Not Found")
+		return
+	}
+
+	// Tell the client that we are going to return JSON
+	w.Header().Add("Content-Type", "application/json")
+	// Tell the client that the status of the request is 200
+	w.WriteHeader(http.StatusOK)
+	// Return the JSON-encoded user
+	err := json.NewEncoder(w).Encode(user)
+	if err != nil {
+		// Log encoding error for debugging
+		slog.ErrorContext(r.Context(), "error encoding user", "error", err)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// testIssuer is a local OIDC provider that serves discovery and keys and signs tokens for tests
+type testIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+}
+
+// newTestIssuer starts a local OIDC provider that is stopped when the test ends
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	issuer := &testIssuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                issuer.server.URL,
+			"jwks_uri":                              issuer.server.URL + "/keys",
+			"authorization_endpoint":                issuer.server.URL + "/authorize",
+			"token_endpoint":                        issuer.server.URL + "/token",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "test", Algorithm: string(jose.RS256), Use: "sig"},
+		}})
+	})
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+// token returns a token for the subject signed with key, with the given claims on top of the standard ones
+func (i *testIssuer) token(t *testing.T, key *rsa.PrivateKey, subject string, claims map[string]any) string {
+	t.Helper()
+	payload := map[string]any{
+		"iss": i.server.URL,
+		"sub": subject,
+		"aud": "todo",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for name, value := range claims {
+		payload[name] = value
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("error encoding claims: %v", err)
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: key, KeyID: "test"}},
+		(&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatalf("error creating signer: %v", err)
+	}
+	signed, err := signer.Sign(data)
+	if err != nil {
+		t.Fatalf("error signing token: %v", err)
+	}
+	raw, err := signed.CompactSerialize()
+	if err != nil {
+		t.Fatalf("error serializing token: %v", err)
+	}
+	return raw
+}
+
+// setupTestAuth enables authentication with tokens of a local OIDC provider for the duration of the test
+func setupTestAuth(t *testing.T, autoCreate bool) *testIssuer {
+	t.Helper()
+	issuer := newTestIssuer(t)
+	a, err := SetupAuth(context.Background(), OIDCOptions{Issuer: issuer.server.URL, Audience: "todo", AutoCreate: autoCreate})
+	if err != nil {
+		t.Fatalf("error setting up authentication: %v", err)
+	}
+	previous := auth
+	auth = a
+	t.Cleanup(func() { auth = previous })
+	return issuer
+}
+
+func TestAuthenticateCreatesUser(t *testing.T) {
+	setupTestDB(t)
+	issuer := setupTestAuth(t, true)
+	token := issuer.token(t, issuer.key, "alice", map[string]any{"email": "alice@example.com", "name": "Alice"})
+
+	user, err := auth.Authenticate(context.Background(), token)
+	if err != nil {
+		t.Fatalf("first login: %v", err)
+	}
+	if user.ID == 0 || user.Subject != "alice" || user.Email != "alice@example.com" || user.Name != "Alice" {
+		t.Fatalf("first login returned %+v", user)
+	}
+
+	again, err := auth.Authenticate(context.Background(), token)
+	if err != nil {
+		t.Fatalf("second login: %v", err)
+	}
+	if again.ID != user.ID {
+		t.Fatalf("second login returned user %d, want %d", again.ID, user.ID)
+	}
+}
+
+func TestAuthenticateConcurrentFirstLogin(t *testing.T) {
+	setupTestDB(t)
+	issuer := setupTestAuth(t, true)
+	token := issuer.token(t, issuer.key, "bob", nil)
+
+	// Every first request of the same new user has to get the same user, none of them a failure
+	ids := make([]int64, 10)
+	errs := make([]error, len(ids))
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, err := auth.Authenticate(context.Background(), token)
+			if err == nil {
+				ids[i] = user.ID
+			}
+			errs[i] = err
+		}()
+	}
+	wg.Wait()
+
+	for i := range ids {
+		if errs[i] != nil {
+			t.Fatalf("login %d: %v", i, errs[i])
+		}
+		if ids[i] != ids[0] {
+			t.Fatalf("login %d returned user %d, want %d", i, ids[i], ids[0])
+		}
+	}
+}
+
+func TestAuthenticateRejectsInvalidTokens(t *testing.T) {
+	setupTestDB(t)
+	issuer := setupTestAuth(t, false)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+
+	tests := map[string]string{
+		"unknown user":   issuer.token(t, issuer.key, "carol", nil),
+		"wrong audience": issuer.token(t, issuer.key, "carol", map[string]any{"aud": "other"}),
+		"expired":        issuer.token(t, issuer.key, "carol", map[string]any{"exp": time.Now().Add(-time.Minute).Unix()}),
+		"wrong issuer":   issuer.token(t, issuer.key, "carol", map[string]any{"iss": "https://evil.example.com"}),
+		"wrong key":      issuer.token(t, otherKey, "carol", nil),
+		"not a token":    "not-a-token",
+	}
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			user, err := auth.Authenticate(context.Background(), token)
+			if err == nil {
+				t.Fatalf("got user %+v, want an error", user)
+			}
+		})
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	setupTestDB(t)
+	issuer := setupTestAuth(t, true)
+	handler := RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := UserFromContext(r.Context())
+		if !ok || user.Subject != "dave" {
+			t.Errorf("handler got user %+v", user)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"missing token", "", http.StatusUnauthorized},
+		{"invalid token", "Bearer not-a-token", http.StatusUnauthorized},
+		{"valid token", "Bearer " + issuer.token(t, issuer.key, "dave", nil), http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/me", nil)
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != test.status {
+				t.Fatalf("got status %d, want %d", w.Code, test.status)
+			}
+			if test.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Fatal("401 without WWW-Authenticate header")
+			}
+		})
+	}
+}
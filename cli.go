@@ -0,0 +1,580 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/insanitywholesale/go-todo/client"
+)
+
+// Exit codes of the command-line client
+const (
+	exitOK       = 0
+	exitError    = 1 // the server or database failed or couldn't be reached
+	exitUsage    = 2 // the command, its arguments or the configuration are wrong, like the flag package uses
+	exitNotFound = 3 // the todo item doesn't exist or the user can't see it
+	exitDenied   = 4 // the user isn't authenticated or not allowed to make the change
+)
+
+// Subcommands of the command-line client, they talk to the server at client.url instead of running one, or work on
+// the database file at db_path when no server is configured
+var cliCommands = map[string]func(args []string) error{
+	"add":  cliAdd,
+	"ls":   cliList,
+	"done": cliDone,
+	"rm":   cliRemove,
+	"edit": cliEdit,
+}
+
+// errCLIUsage is returned by subcommands that were used wrongly, after the usage was printed
+var errCLIUsage = errors.New("wrong usage")
+
+// IsCLICommand reports whether a subcommand of the command-line client has this name
+func IsCLICommand(name string) bool {
+	_, ok := cliCommands[name]
+	return ok
+}
+
+// CLICommand runs a subcommand of the command-line client and returns its exit code
+func CLICommand(name string, args []string) int {
+	err := cliCommands[name](args)
+	switch {
+	case err == nil || errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.Is(err, errCLIUsage):
+		return exitUsage
+	}
+
+	fmt.Fprintln(os.Stderr, "go-todo "+name+": "+err.Error())
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) {
+		return exitError
+	}
+	switch apiErr.Status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return exitUsage
+	case http.StatusNotFound:
+		return exitNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return exitDenied
+	default:
+		return exitError
+	}
+}
+
+// cliFlags are the flags of a subcommand, with the ones every subcommand has
+type cliFlags struct {
+	*flag.FlagSet
+	config string // path of the config file
+	json   bool   // print JSON instead of a table
+}
+
+// newCLIFlags returns the flags of a subcommand taking the arguments described by args
+func newCLIFlags(name, args, description string) *cliFlags {
+	flags := &cliFlags{FlagSet: flag.NewFlagSet("go-todo "+name, flag.ContinueOnError)}
+	flags.StringVar(&flags.config, "config", os.Getenv("TODO_CONFIG"), "path of a YAML config file (env TODO_CONFIG)")
+	flags.BoolVar(&flags.json, "json", false, "print JSON instead of a table")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s\n\n%s\n\nflags:\n", strings.TrimSpace("go-todo "+name+" [flags] "+args), description)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parse parses the arguments of the subcommand, which has to get between minArgs and maxArgs of them after the flags
+func (f *cliFlags) parse(args []string, minArgs, maxArgs int) error {
+	err := f.Parse(args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errCLIUsage
+	}
+	if f.NArg() < minArgs || f.NArg() > maxArgs {
+		return f.fail("wrong number of arguments")
+	}
+	return nil
+}
+
+// id returns the todo item ID that is the argument at index i
+func (f *cliFlags) id(i int) (int64, error) {
+	id, err := strconv.ParseInt(f.Arg(i), 10, 64)
+	if err != nil || id < 1 {
+		return 0, f.fail(strconv.Quote(f.Arg(i)) + " is not a todo item ID")
+	}
+	return id, nil
+}
+
+// description returns the todo item description that is the argument at index i
+func (f *cliFlags) description(i int) (string, error) {
+	description := strings.TrimSpace(f.Arg(i))
+	if description == "" {
+		return "", f.fail("the description can't be empty")
+	}
+	return description, nil
+}
+
+// fail prints what was wrong with the arguments and the usage
+func (f *cliFlags) fail(message string) error {
+	fmt.Fprintln(f.Output(), message)
+	f.Usage()
+	return errCLIUsage
+}
+
+// todoBackend is where the subcommands read and change todo items, the configured server or the database file
+type todoBackend interface {
+	Todos(ctx context.Context, options client.ListOptions) iter.Seq2[client.TodoItem, error]
+	GetTodo(ctx context.Context, id int64) (client.TodoItem, error)
+	CreateTodo(ctx context.Context, todo client.TodoItem) (client.TodoItem, error)
+	UpdateTodo(ctx context.Context, todo client.TodoItem) (client.TodoItem, error)
+	DeleteTodo(ctx context.Context, id int64) error
+	Close() error
+}
+
+// backend returns a client of the server configured in the config file or environment, or the database file at
+// db_path when there is none
+func (f *cliFlags) backend() (todoBackend, error) {
+	var args []string
+	if f.config != "" {
+		args = []string{"-config", f.config}
+	}
+	cfg, err := LoadConfig(f.Name(), args)
+	if err != nil {
+		fmt.Fprintln(f.Output(), err)
+		return nil, errCLIUsage
+	}
+
+	if cfg.Client.URL == "" {
+		// Work on the database file of the server directly, the same way the server would
+		path := cfg.DBPath
+		if cfg.Client.Tenant != "" {
+			path = filepath.Join(cfg.Tenant.Dir, cfg.Client.Tenant+".db")
+		}
+		mydb, err := OpenExistingDB(path)
+		if err != nil {
+			return nil, err
+		}
+		db = mydb
+		queryTimeout = cfg.Server.QueryTimeout
+		return localTodos{}, nil
+	}
+
+	header := http.Header{}
+	if cfg.Client.Tenant != "" {
+		header.Set(cfg.Tenant.Header, cfg.Client.Tenant)
+	}
+	c, err := client.New(cfg.Client.URL, client.Options{
+		HTTPClient: &http.Client{Timeout: cfg.Client.Timeout},
+		Token:      cfg.Client.Token,
+		Header:     header,
+		Retries:    cfg.Client.Retries,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return remoteTodos{c}, nil
+}
+
+// remoteTodos are the todo items of the configured server
+type remoteTodos struct {
+	*client.Client
+}
+
+// Close does nothing, the client has nothing to clean up
+func (remoteTodos) Close() error {
+	return nil
+}
+
+// localTodos are the todo items of the database file, used through the store like the server does. There is no
+// user so every item can be seen and changed, like with authentication disabled.
+type localTodos struct{}
+
+func (localTodos) Todos(ctx context.Context, options client.ListOptions) iter.Seq2[client.TodoItem, error] {
+	filter := TodoFilter{Done: options.Done, Tag: options.Tag, Search: options.Search}
+	if options.ListID != nil {
+		filter.ListIDs = []int64{*options.ListID}
+	}
+	limit := options.Limit
+	if limit == 0 {
+		// A negative limit means no limit to sqlite
+		limit = -1
+	}
+	return func(yield func(client.TodoItem, error) bool) {
+		todos, err := store.Find(ctx, filter, options.After, limit)
+		if err != nil {
+			yield(client.TodoItem{}, localError(err))
+			return
+		}
+		for _, todo := range todos {
+			if !yield(client.TodoItem(todo), nil) {
+				return
+			}
+		}
+	}
+}
+
+func (localTodos) GetTodo(ctx context.Context, id int64) (client.TodoItem, error) {
+	todo, err := store.Get(ctx, id)
+	return client.TodoItem(todo), localError(err)
+}
+
+func (localTodos) CreateTodo(ctx context.Context, todo client.TodoItem) (client.TodoItem, error) {
+	created, err := store.Create(ctx, TodoItem(todo))
+	return client.TodoItem(created), localError(err)
+}
+
+func (localTodos) UpdateTodo(ctx context.Context, todo client.TodoItem) (client.TodoItem, error) {
+	updated, err := store.Update(ctx, TodoItem(todo))
+	return client.TodoItem(updated), localError(err)
+}
+
+func (localTodos) DeleteTodo(ctx context.Context, id int64) error {
+	return localError(store.Delete(ctx, id))
+}
+
+// Close closes the database file, checkpointing the write-ahead log if no one else has it open
+func (localTodos) Close() error {
+	return db.Close()
+}
+
+// localError returns errors of the store meant for the client as the errors the server would have responded with,
+// so both backends fail the same way
+func localError(err error) error {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return &client.Error{Message: httpErr.Message, Detail: httpErr.Detail, Status: httpErr.Status}
+	}
+	return err
+}
+
+// printTodo writes a todo item to stdout as a table, or as JSON if asked to
+func (f *cliFlags) printTodo(todo client.TodoItem) error {
+	if f.json {
+		return printJSON(todo)
+	}
+	return printTable([]client.TodoItem{todo})
+}
+
+// printTodos writes todo items to stdout as a table, or as JSON if asked to
+func (f *cliFlags) printTodos(todos []client.TodoItem) error {
+	if f.json {
+		if todos == nil {
+			todos = []client.TodoItem{}
+		}
+		return printJSON(todos)
+	}
+	return printTable(todos)
+}
+
+// printJSON writes a value to stdout as indented JSON
+func printJSON(v any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// printTable writes todo items to stdout as a table with a row per item
+func printTable(todos []client.TodoItem) error {
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tDONE\tLIST\tDESCRIPTION")
+	for _, todo := range todos {
+		done := "no"
+		if todo.Done {
+			done = "yes"
+		}
+		list := "-"
+		if todo.ListID != nil {
+			list = strconv.FormatInt(*todo.ListID, 10)
+		}
+		fmt.Fprintf(table, "%d\t%s\t%s\t%s\n", todo.ID, done, list, todo.Description)
+	}
+	return table.Flush()
+}
+
+// optionalBool is a boolean flag that tells whether it was given at all
+type optionalBool struct {
+	value *bool
+}
+
+func (b *optionalBool) String() string {
+	if b.value == nil {
+		return ""
+	}
+	return strconv.FormatBool(*b.value)
+}
+
+func (b *optionalBool) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	b.value = &v
+	return nil
+}
+
+func (b *optionalBool) IsBoolFlag() bool {
+	return true
+}
+
+// optionalID is an ID flag that tells whether it was given at all
+type optionalID struct {
+	value *int64
+}
+
+func (i *optionalID) String() string {
+	if i.value == nil {
+		return ""
+	}
+	return strconv.FormatInt(*i.value, 10)
+}
+
+func (i *optionalID) Set(s string) error {
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	i.value = &v
+	return nil
+}
+
+// cliContext returns a context that is cancelled by Ctrl+C
+func cliContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+// cliAdd runs go-todo add, which creates a todo item
+func cliAdd(args []string) error {
+	flags := newCLIFlags("add", "DESCRIPTION", "Add a todo item and print it.")
+	done := flags.Bool("done", false, "add the item as done")
+	var list optionalID
+	flags.Var(&list, "list", "`ID` of the list to add the item to")
+	err := flags.parse(args, 1, 1)
+	if err != nil {
+		return err
+	}
+	description, err := flags.description(0)
+	if err != nil {
+		return err
+	}
+
+	c, err := flags.backend()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	ctx, cancel := cliContext()
+	defer cancel()
+
+	todo, err := c.CreateTodo(ctx, client.TodoItem{Description: description, Done: *done, ListID: list.value})
+	if err != nil {
+		return err
+	}
+	return flags.printTodo(todo)
+}
+
+// cliList runs go-todo ls, which prints the todo items
+func cliList(args []string) error {
+	flags := newCLIFlags("ls", "", "Print the todo items the user can see.")
+	var done optionalBool
+	flags.Var(&done, "done", "only items that are done, or not done with -done=false")
+	var list optionalID
+	flags.Var(&list, "list", "only items in the list with this `ID`")
+	tag := flags.String("tag", "", "only items with this tag")
+	search := flags.String("search", "", "only items whose description contains this, ignoring case")
+	err := flags.parse(args, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	c, err := flags.backend()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	ctx, cancel := cliContext()
+	defer cancel()
+
+	var todos []client.TodoItem
+	for todo, err := range c.Todos(ctx, client.ListOptions{Done: done.value, ListID: list.value, Tag: *tag, Search: *search}) {
+		if err != nil {
+			return err
+		}
+		todos = append(todos, todo)
+	}
+	return flags.printTodos(todos)
+}
+
+// cliDone runs go-todo done, which marks a todo item as done
+func cliDone(args []string) error {
+	flags := newCLIFlags("done", "ID", "Mark a todo item as done and print it.")
+	err := flags.parse(args, 1, 1)
+	if err != nil {
+		return err
+	}
+	id, err := flags.id(0)
+	if err != nil {
+		return err
+	}
+
+	c, err := flags.backend()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	ctx, cancel := cliContext()
+	defer cancel()
+
+	todo, err := c.GetTodo(ctx, id)
+	if err != nil {
+		return err
+	}
+	todo.Done = true
+	todo, err = c.UpdateTodo(ctx, todo)
+	if err != nil {
+		return err
+	}
+	return flags.printTodo(todo)
+}
+
+// cliRemove runs go-todo rm, which deletes todo items
+func cliRemove(args []string) error {
+	flags := newCLIFlags("rm", "ID...", "Remove todo items.")
+	err := flags.parse(args, 1, len(args))
+	if err != nil {
+		return err
+	}
+	ids := make([]int64, flags.NArg())
+	for i := range ids {
+		ids[i], err = flags.id(i)
+		if err != nil {
+			return err
+		}
+	}
+
+	c, err := flags.backend()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	ctx, cancel := cliContext()
+	defer cancel()
+
+	for _, id := range ids {
+		err = c.DeleteTodo(ctx, id)
+		if err != nil {
+			return fmt.Errorf("error removing todo item %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// cliEdit runs go-todo edit, which changes a todo item
+func cliEdit(args []string) error {
+	flags := newCLIFlags("edit", "ID [DESCRIPTION]",
+		"Change a todo item and print it. Without a new description or flags the description is opened in $VISUAL or $EDITOR.")
+	var done optionalBool
+	flags.Var(&done, "done", "mark the item as done, or not done with -done=false")
+	var list optionalID
+	flags.Var(&list, "list", "`ID` of the list to move the item to")
+	err := flags.parse(args, 1, 2)
+	if err != nil {
+		return err
+	}
+	id, err := flags.id(0)
+	if err != nil {
+		return err
+	}
+
+	c, err := flags.backend()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	ctx, cancel := cliContext()
+	defer cancel()
+
+	todo, err := c.GetTodo(ctx, id)
+	if err != nil {
+		return err
+	}
+	switch {
+	case flags.NArg() == 2:
+		todo.Description, err = flags.description(1)
+		if err != nil {
+			return err
+		}
+	case done.value == nil && list.value == nil:
+		todo.Description, err = editText(todo.Description)
+		if err != nil {
+			return err
+		}
+	}
+	if done.value != nil {
+		todo.Done = *done.value
+	}
+	if list.value != nil {
+		todo.ListID = list.value
+	}
+
+	todo, err = c.UpdateTodo(ctx, todo)
+	if err != nil {
+		return err
+	}
+	return flags.printTodo(todo)
+}
+
+// editText lets the user change text in their editor and returns the result, refusing empty text
+func editText(text string) (string, error) {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	file, err := os.CreateTemp("", "go-todo-*.txt")
+	if err != nil {
+		return "", fmt.Errorf("error creating file to edit: %w", err)
+	}
+	defer os.Remove(file.Name())
+	_, err = io.WriteString(file, text+"\n")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("error writing file to edit: %w", err)
+	}
+
+	// The editor setting can have arguments, like "code --wait"
+	command := strings.Fields(editor)
+	cmd := exec.Command(command[0], append(command[1:], file.Name())...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("error running editor %s: %w", editor, err)
+	}
+
+	edited, err := os.ReadFile(file.Name())
+	if err != nil {
+		return "", fmt.Errorf("error reading edited file: %w", err)
+	}
+	text = strings.TrimSpace(string(edited))
+	if text == "" {
+		return "", errors.New("description is empty, the todo item wasn't changed")
+	}
+	return text, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupTestStdout sends what the command-line client prints to a file for the duration of the test
+func setupTestStdout(t *testing.T) {
+	t.Helper()
+	file, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatalf("error creating output file: %v", err)
+	}
+	previous := os.Stdout
+	os.Stdout = file
+	t.Cleanup(func() {
+		os.Stdout = previous
+		_ = file.Close()
+	})
+}
+
+// countTestTodos returns how many todo items the database file at path has
+func countTestTodos(t *testing.T, path string) int {
+	t.Helper()
+	mydb, err := OpenDB(path)
+	if err != nil {
+		t.Fatalf("error opening %s: %v", path, err)
+	}
+	defer mydb.Close()
+	var count int
+	err = mydb.QueryRow(`SELECT count(*) FROM todo;`).Scan(&count)
+	if err != nil {
+		t.Fatalf("error counting todo items: %v", err)
+	}
+	return count
+}
+
+func TestCLITenant(t *testing.T) {
+	server, issuer := setupTestServer(t)
+	dir := t.TempDir()
+	setupTestTenants(t, TenantOptions{Dir: dir, IDs: []string{"acme"}})
+	setupTestStdout(t)
+	t.Setenv("TODO_CLIENT_URL", server.URL)
+	t.Setenv("TODO_CLIENT_TOKEN", issuer.token(t, issuer.key, "alice", nil))
+	t.Setenv("TODO_TENANT_DIR", dir)
+
+	// The server can't tell which tenant the client means without one
+	if code := CLICommand("add", []string{"nowhere"}); code != exitUsage {
+		t.Fatalf("adding without a tenant exited with %d, want %d", code, exitUsage)
+	}
+
+	// The client sends the tenant in the tenant header
+	t.Setenv("TODO_CLIENT_TENANT", "acme")
+	if code := CLICommand("add", []string{"buy milk"}); code != exitOK {
+		t.Fatalf("adding with a tenant exited with %d", code)
+	}
+	if code := CLICommand("ls", nil); code != exitOK {
+		t.Fatalf("listing with a tenant exited with %d", code)
+	}
+
+	// Without a server the client works on the database file of the tenant
+	t.Setenv("TODO_CLIENT_URL", "")
+	if code := CLICommand("add", []string{"buy bread"}); code != exitOK {
+		t.Fatalf("adding locally with a tenant exited with %d", code)
+	}
+	if count := countTestTodos(t, filepath.Join(dir, "acme.db")); count != 2 {
+		t.Errorf("tenant database has %d todo items, want 2", count)
+	}
+
+	// Tenants the server hasn't set up don't get a database file
+	t.Setenv("TODO_CLIENT_TENANT", "beta")
+	if code := CLICommand("add", []string{"buy eggs"}); code != exitError {
+		t.Errorf("adding locally to a missing tenant exited with %d, want %d", code, exitError)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "beta.db")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("adding locally to a missing tenant created its database: %v", err)
+	}
+
+	t.Setenv("TODO_CLIENT_TENANT", "../acme")
+	if code := CLICommand("ls", nil); code != exitUsage {
+		t.Errorf("listing with an invalid tenant exited with %d, want %d", code, exitUsage)
+	}
+}
@@ -0,0 +1,268 @@
+// Package client is a Go client of the go-todo REST API, so other services don't have to build requests by hand
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"iter"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TodoItem is a todo item as the API returns it
+type TodoItem struct {
+	ID          int64  `json:"id"`
+	Description string `json:"description"`
+	Done        bool   `json:"done"`
+	ListID      *int64 `json:"list_id,omitempty"` // list the item belongs to, if any
+}
+
+// Options of a Client, the zero value talks to an API without authentication and doesn't retry
+type Options struct {
+	HTTPClient *http.Client  // client making the requests, http.DefaultClient if nil
+	Token      string        // bearer token sent in the Authorization header
+	Header     http.Header   // headers sent with every request, for example the tenant header
+	Retries    int           // how many times a failed request is tried again
+	RetryWait  time.Duration // wait before the first retry, doubled for every other one, 1 second if zero
+}
+
+// Client of the go-todo REST API, safe for concurrent use
+type Client struct {
+	baseURL *url.URL
+	options Options
+}
+
+// New returns a client of the API served at baseURL, like "http://localhost:8080"
+func New(baseURL string, options Options) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, errors.New("[client.New] error parsing base URL: " + err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("[client.New] base URL " + strconv.Quote(baseURL) + " has to start with http:// or https://")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	if options.HTTPClient == nil {
+		options.HTTPClient = http.DefaultClient
+	}
+	if options.RetryWait <= 0 {
+		options.RetryWait = time.Second
+	}
+	return &Client{baseURL: u, options: options}, nil
+}
+
+// ListOptions narrows down the todo items ListTodos returns, the zero value returns every item
+type ListOptions struct {
+	Done   *bool  // only items that are (not) done
+	ListID *int64 // only items in this list
+	Tag    string // only items with this tag
+	Search string // only items whose description contains this, ignoring case
+	After  int64  // only items with a larger ID, the ID of the last item of the previous page
+	Limit  int    // largest number of items to return, up to 100, all of them if zero
+}
+
+// query returns the query parameters of the options
+func (o ListOptions) query() url.Values {
+	query := url.Values{}
+	if o.Done != nil {
+		query.Set("done", strconv.FormatBool(*o.Done))
+	}
+	if o.ListID != nil {
+		query.Set("list_id", strconv.FormatInt(*o.ListID, 10))
+	}
+	if o.Tag != "" {
+		query.Set("tag", o.Tag)
+	}
+	if o.Search != "" {
+		query.Set("search", o.Search)
+	}
+	if o.After != 0 {
+		query.Set("after", strconv.FormatInt(o.After, 10))
+	}
+	if o.Limit != 0 {
+		query.Set("limit", strconv.Itoa(o.Limit))
+	}
+	return query
+}
+
+// ListTodos returns the todo items matching the options that the user can see, ordered by ID
+func (c *Client) ListTodos(ctx context.Context, options ListOptions) ([]TodoItem, error) {
+	var todos []TodoItem
+	err := c.do(ctx, http.MethodGet, "/todos", options.query(), nil, &todos)
+	return todos, err
+}
+
+// Largest page of todo items the API returns at once
+const maxPage = 100
+
+// Todos iterates over every todo item matching the options, fetching them a page of options.Limit items at a time,
+// 100 if it's zero. Iterating stops after the first error.
+func (c *Client) Todos(ctx context.Context, options ListOptions) iter.Seq2[TodoItem, error] {
+	if options.Limit == 0 {
+		options.Limit = maxPage
+	}
+	return func(yield func(TodoItem, error) bool) {
+		for {
+			todos, err := c.ListTodos(ctx, options)
+			if err != nil {
+				yield(TodoItem{}, err)
+				return
+			}
+			for _, todo := range todos {
+				if !yield(todo, nil) {
+					return
+				}
+			}
+			// A page that isn't full is the last one
+			if len(todos) < options.Limit {
+				return
+			}
+			options.After = todos[len(todos)-1].ID
+		}
+	}
+}
+
+// GetTodo returns a todo item by ID
+func (c *Client) GetTodo(ctx context.Context, id int64) (TodoItem, error) {
+	var todo TodoItem
+	err := c.do(ctx, http.MethodGet, "/todo/"+strconv.FormatInt(id, 10), nil, nil, &todo)
+	return todo, err
+}
+
+// CreateTodo adds a todo item and returns it with its ID
+func (c *Client) CreateTodo(ctx context.Context, todo TodoItem) (TodoItem, error) {
+	var created TodoItem
+	err := c.do(ctx, http.MethodPost, "/todo", nil, todo, &created)
+	return created, err
+}
+
+// UpdateTodo changes the todo item with the ID of todo and returns it
+func (c *Client) UpdateTodo(ctx context.Context, todo TodoItem) (TodoItem, error) {
+	var updated TodoItem
+	err := c.do(ctx, http.MethodPut, "/todo/"+strconv.FormatInt(todo.ID, 10), nil, todo, &updated)
+	return updated, err
+}
+
+// DeleteTodo removes a todo item by ID
+func (c *Client) DeleteTodo(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, "/todo/"+strconv.FormatInt(id, 10), nil, nil, nil)
+}
+
+// do sends a request with body encoded as JSON, retrying it when allowed, and decodes the response into result
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, result any) error {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return errors.New("[client] error encoding request body: " + err.Error())
+		}
+	}
+
+	u := *c.baseURL
+	u.Path += path
+	u.RawQuery = query.Encode()
+
+	wait := c.options.RetryWait
+	resent := false
+	for attempt := 0; ; attempt++ {
+		res, err := c.send(ctx, method, u.String(), data)
+		// Requests that may not have reached the server can only be sent again if that doesn't change anything
+		retry := err != nil && method != http.MethodPost && ctx.Err() == nil
+		if err == nil {
+			err = decodeResponse(res, result)
+			retry = temporary(method, err)
+			// A delete that was sent again may have removed the resource the first time
+			if resent && method == http.MethodDelete && errors.Is(err, ErrNotFound) {
+				return nil
+			}
+		}
+		if !retry || attempt >= c.options.Retries {
+			return err
+		}
+		if res == nil {
+			resent = true
+		}
+
+		// Wait as long as the server asks to, or back off exponentially
+		delay := wait
+		if res != nil {
+			if seconds, parseErr := strconv.Atoi(res.Header.Get("Retry-After")); parseErr == nil && seconds >= 0 {
+				delay = time.Duration(seconds) * time.Second
+			}
+		}
+		wait *= 2
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// send makes a single request
+func (c *Client) send(ctx context.Context, method, u string, data []byte) (*http.Response, error) {
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range c.options.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.options.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.options.Token)
+	}
+	return c.options.HTTPClient.Do(req)
+}
+
+// decodeResponse decodes a successful response into result and an unsuccessful one into an *Error
+func decodeResponse(res *http.Response, result any) error {
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		return decodeError(res)
+	}
+	if result == nil || res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	err := json.NewDecoder(res.Body).Decode(result)
+	if err != nil {
+		return errors.New("[client] error decoding response: " + err.Error())
+	}
+	return nil
+}
+
+// temporary reports whether the server refused a request for now. Rate limited requests weren't handled so they can
+// always be sent again, but a request that was unavailable may have run out of time after making its changes so it's
+// only sent again if that doesn't change anything.
+func temporary(method string, err error) bool {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.Status {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusServiceUnavailable:
+		return method != http.MethodPost
+	default:
+		return false
+	}
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Error is an error response of the API, tell them apart with errors.Is, like errors.Is(err, client.ErrNotFound)
+type Error struct {
+	Message   string `json:"error"`
+	Detail    string `json:"detail"` // the status as text, like "Not Found"
+	Status    int    `json:"status"`
+	RequestID string `json:"request_id,omitempty"` // ID of the request in the logs of the server
+}
+
+// Error returns the error as a string, in the same format as the server
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Detail
+	}
+	return e.Detail + " : " + e.Message
+}
+
+// Is reports whether target is the error of the same status, so the Err variables match every error of their status
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Message == "" && t.Status == e.Status
+}
+
+// Errors of every status the API responds with
+var (
+	ErrBadRequest            = &Error{Status: http.StatusBadRequest, Detail: "Bad Request"}
+	ErrUnauthorized          = &Error{Status: http.StatusUnauthorized, Detail: "Unauthorized"}
+	ErrForbidden             = &Error{Status: http.StatusForbidden, Detail: "Forbidden"}
+	ErrNotFound              = &Error{Status: http.StatusNotFound, Detail: "Not Found"}
+	ErrRequestTimeout        = &Error{Status: http.StatusRequestTimeout, Detail: "Request Timeout"}
+	ErrRequestEntityTooLarge = &Error{Status: http.StatusRequestEntityTooLarge, Detail: "Request Entity Too Large"}
+	ErrTooManyRequests       = &Error{Status: http.StatusTooManyRequests, Detail: "Too Many Requests"}
+	ErrInternalServerError   = &Error{Status: http.StatusInternalServerError, Detail: "General Error"}
+	ErrServiceUnavailable    = &Error{Status: http.StatusServiceUnavailable, Detail: "Service Unavailable"}
+)
+
+// Largest error response that is read, anything longer isn't an error of the API
+const maxErrorBytes = 64 << 10
+
+// decodeError returns the *Error of an unsuccessful response. Responses that aren't from the API, like those of a
+// proxy in front of it, get an *Error with their status and body.
+func decodeError(res *http.Response) error {
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxErrorBytes))
+	apiErr := &Error{}
+	if err == nil && json.Unmarshal(body, apiErr) == nil && apiErr.Status != 0 {
+		return apiErr
+	}
+	return &Error{
+		Message: strings.TrimSpace(string(body)),
+		Detail:  http.StatusText(res.StatusCode),
+		Status:  res.StatusCode,
+	}
+}
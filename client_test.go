@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/insanitywholesale/go-todo/client"
+)
+
+// newTestClient returns an API client of the server with the token of the subject
+func newTestClient(t *testing.T, server *httptest.Server, token string, options client.Options) *client.Client {
+	t.Helper()
+	options.Token = token
+	if options.HTTPClient == nil {
+		options.HTTPClient = server.Client()
+	}
+	c, err := client.New(server.URL, options)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	return c
+}
+
+func TestClient(t *testing.T) {
+	server, issuer := setupTestServer(t)
+	setupTestValidation(t)
+	c := newTestClient(t, server, issuer.token(t, issuer.key, "alice", nil), client.Options{})
+	ctx := context.Background()
+
+	created, err := c.CreateTodo(ctx, client.TodoItem{Description: "buy milk"})
+	if err != nil || created.ID == 0 || created.Description != "buy milk" {
+		t.Fatalf("created %+v: %v", created, err)
+	}
+	created.Done = true
+	updated, err := c.UpdateTodo(ctx, created)
+	if err != nil || !updated.Done {
+		t.Fatalf("updated %+v: %v", updated, err)
+	}
+	got, err := c.GetTodo(ctx, created.ID)
+	if err != nil || got != updated {
+		t.Fatalf("got %+v, want %+v: %v", got, updated, err)
+	}
+
+	// Todos pages through every item
+	for range 4 {
+		_, err = c.CreateTodo(ctx, client.TodoItem{Description: "item"})
+		if err != nil {
+			t.Fatalf("error creating todo item: %v", err)
+		}
+	}
+	var ids []int64
+	for todo, err := range c.Todos(ctx, client.ListOptions{Limit: 2}) {
+		if err != nil {
+			t.Fatalf("error listing todo items: %v", err)
+		}
+		ids = append(ids, todo.ID)
+	}
+	if len(ids) != 5 {
+		t.Fatalf("listed items %v, want 5 of them", ids)
+	}
+	done := true
+	todos, err := c.ListTodos(ctx, client.ListOptions{Done: &done})
+	if err != nil || len(todos) != 1 || todos[0].ID != created.ID {
+		t.Fatalf("listed done items %+v: %v", todos, err)
+	}
+
+	err = c.DeleteTodo(ctx, created.ID)
+	if err != nil {
+		t.Fatalf("error deleting todo item: %v", err)
+	}
+
+	// Error responses match their Err variables
+	_, err = c.GetTodo(ctx, created.ID)
+	if !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("getting deleted item: got %v, want ErrNotFound", err)
+	}
+	err = c.DeleteTodo(ctx, created.ID)
+	if !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("deleting deleted item: got %v, want ErrNotFound", err)
+	}
+	_, err = c.ListTodos(ctx, client.ListOptions{Limit: 1000})
+	if !errors.Is(err, client.ErrBadRequest) {
+		t.Errorf("listing with a large limit: got %v, want ErrBadRequest", err)
+	}
+	_, err = newTestClient(t, server, "", client.Options{}).ListTodos(ctx, client.ListOptions{})
+	if !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("listing without a token: got %v, want ErrUnauthorized", err)
+	}
+}
+
+// lostResponses is a transport that sends requests to the server but loses the response to the first one of a method
+type lostResponses struct {
+	transport http.RoundTripper
+	method    string
+	lost      atomic.Bool
+	sent      atomic.Int32
+}
+
+func (l *lostResponses) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := l.transport.RoundTrip(req)
+	if req.Method != l.method {
+		return res, err
+	}
+	l.sent.Add(1)
+	if err == nil && l.lost.CompareAndSwap(false, true) {
+		res.Body.Close()
+		return nil, errors.New("connection reset")
+	}
+	return res, err
+}
+
+func TestClientRetries(t *testing.T) {
+	server, issuer := setupTestServer(t)
+	token := issuer.token(t, issuer.key, "alice", nil)
+	ctx := context.Background()
+
+	// lossyClient returns a client that loses the response to its first request of method
+	lossyClient := func(method string) (*client.Client, *lostResponses) {
+		transport := &lostResponses{transport: server.Client().Transport, method: method}
+		return newTestClient(t, server, token, client.Options{
+			HTTPClient: &http.Client{Transport: transport},
+			Retries:    2,
+			RetryWait:  time.Millisecond,
+		}), transport
+	}
+
+	todo, err := newTestClient(t, server, token, client.Options{}).CreateTodo(ctx, client.TodoItem{Description: "item"})
+	if err != nil {
+		t.Fatalf("error creating todo item: %v", err)
+	}
+
+	// A delete whose response was lost removed the item, so the retry not finding it is a success
+	c, transport := lossyClient(http.MethodDelete)
+	err = c.DeleteTodo(ctx, todo.ID)
+	if err != nil || transport.sent.Load() != 2 {
+		t.Fatalf("deleting with a lost response sent %d requests: %v", transport.sent.Load(), err)
+	}
+	_, err = c.GetTodo(ctx, todo.ID)
+	if !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("getting deleted item: got %v, want ErrNotFound", err)
+	}
+
+	// Without a lost response a missing item is still an error
+	c, _ = lossyClient(http.MethodGet)
+	err = c.DeleteTodo(ctx, todo.ID)
+	if !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("deleting missing item: got %v, want ErrNotFound", err)
+	}
+
+	// A create whose response was lost isn't sent again, it may have created the item
+	c, transport = lossyClient(http.MethodPost)
+	_, err = c.CreateTodo(ctx, client.TodoItem{Description: "once"})
+	if err == nil || transport.sent.Load() != 1 {
+		t.Errorf("creating with a lost response sent %d requests: %v", transport.sent.Load(), err)
+	}
+
+	// A create that was unavailable may have created the item so it isn't sent again, one that was rate limited is
+	statuses := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}
+	var sent atomic.Int32
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[sent.Add(1)-1]
+		if status != http.StatusOK {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(`{"error":"try again","status":` + strconv.Itoa(status) + `}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":1,"description":"once"}`))
+	}))
+	defer refusing.Close()
+	c = newTestClient(t, refusing, token, client.Options{Retries: 2, RetryWait: time.Millisecond})
+	_, err = c.CreateTodo(ctx, client.TodoItem{Description: "once"})
+	if err == nil || sent.Load() != 1 {
+		t.Errorf("creating while unavailable sent %d requests: %v", sent.Load(), err)
+	}
+	created, err := c.CreateTodo(ctx, client.TodoItem{Description: "once"})
+	if err != nil || created.ID != 1 || sent.Load() != 3 {
+		t.Errorf("creating while rate limited sent %d requests and created %+v: %v", sent.Load(), created, err)
+	}
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting of the server. Each setting can be given, from lowest to highest precedence,
+// in a YAML config file, as a TODO_* environment variable or as a command-line flag.
+// The flag of a setting is its YAML path joined with dashes, for example tenant.max_todos is -tenant-max-todos.
+type Config struct {
+	DBPath          string        `yaml:"db_path" env:"TODO_DB_PATH" usage:"path of the sqlite database file"`
+	Listen          string        `yaml:"listen" env:"TODO_LISTEN" usage:"address the server listens on: host:port, [ipv6]:port or unix:/path.sock"`
+	SocketMode      string        `yaml:"socket_mode" env:"TODO_SOCKET_MODE" usage:"octal permissions of the Unix socket, like 0660"`
+	Port            string        `yaml:"port" env:"TODO_PORT" usage:"port the server listens on on all interfaces when listen is empty"`
+	ShutdownDelay   time.Duration `yaml:"shutdown_delay" env:"TODO_SHUTDOWN_DELAY" usage:"how long readiness fails before shutting down, so load balancers stop sending requests"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"TODO_SHUTDOWN_TIMEOUT" usage:"how long in-flight requests get to finish on shutdown"`
+	TrustProxy      bool          `yaml:"trust_proxy" env:"TODO_TRUST_PROXY" usage:"use X-Forwarded-For to find the client IP"`
+
+	Server    ServerOptions    `yaml:"server"`
+	Events    EventsOptions    `yaml:"events"`
+	Log       LogOptions       `yaml:"log"`
+	Tracing   TracingOptions   `yaml:"tracing"`
+	OIDC      OIDCOptions      `yaml:"oidc"`
+	Tenant    TenantOptions    `yaml:"tenant"`
+	RateLimit RateLimitOptions `yaml:"rate_limit"`
+	CORS      CORSOptions      `yaml:"cors"`
+	TLS       TLSOptions       `yaml:"tls"`
+	Webhook   WebhookOptions   `yaml:"webhook"`
+	GRPC      GRPCOptions      `yaml:"grpc"`
+	Client    ClientOptions    `yaml:"client"`
+}
+
+// ServerOptions configures timeouts and size limits of requests, 0 means unlimited
+type ServerOptions struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"TODO_SERVER_READ_HEADER_TIMEOUT" usage:"time to read the headers of a request"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" env:"TODO_SERVER_READ_TIMEOUT" usage:"time to read a whole request including its body"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"TODO_SERVER_WRITE_TIMEOUT" usage:"time to handle a request and write its response"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"TODO_SERVER_IDLE_TIMEOUT" usage:"time a keep-alive connection stays open between requests"`
+	RequestTimeout    time.Duration `yaml:"request_timeout" env:"TODO_SERVER_REQUEST_TIMEOUT" usage:"time the database queries of a request can take"`
+	QueryTimeout      time.Duration `yaml:"query_timeout" env:"TODO_SERVER_QUERY_TIMEOUT" usage:"time a single database query can take"`
+	MaxHeaderBytes    int           `yaml:"max_header_bytes" env:"TODO_SERVER_MAX_HEADER_BYTES" usage:"maximum size of the request headers in bytes"`
+	MaxBodyBytes      int64         `yaml:"max_body_bytes" env:"TODO_SERVER_MAX_BODY_BYTES" usage:"maximum size of a request body in bytes"`
+	ValidateResponses bool          `yaml:"validate_responses" env:"TODO_SERVER_VALIDATE_RESPONSES" usage:"debug mode: respond with a 500 when a response doesn't match openapi.yaml"`
+}
+
+// EventsOptions configures the change feed
+type EventsOptions struct {
+	Replay    int           `yaml:"replay" env:"TODO_EVENTS_REPLAY" usage:"amount of recent changes kept for clients that reconnect"`
+	Heartbeat time.Duration `yaml:"heartbeat" env:"TODO_EVENTS_HEARTBEAT" usage:"time between the comments that keep idle streams open"`
+}
+
+// LogOptions configures the format and level of the logs
+type LogOptions struct {
+	Level  string `yaml:"level" env:"TODO_LOG_LEVEL" usage:"lowest level that is logged: debug, info, warn or error"`
+	Format string `yaml:"format" env:"TODO_LOG_FORMAT" usage:"log format: text or json"`
+}
+
+// TracingOptions configures where spans are exported to
+type TracingOptions struct {
+	Exporter string `yaml:"exporter" env:"TODO_TRACING_EXPORTER" usage:"span exporter: none, otlp or stdout"`
+}
+
+// OIDCOptions configures authentication with bearer tokens of an OpenID Connect provider
+type OIDCOptions struct {
+	Issuer     string `yaml:"issuer" env:"TODO_OIDC_ISSUER" usage:"issuer URL of the OIDC provider, enables authentication"`
+	ClientID   string `yaml:"client_id" env:"TODO_OIDC_CLIENT_ID" usage:"client ID accepted as token audience"`
+	Audience   string `yaml:"audience" env:"TODO_OIDC_AUDIENCE" usage:"API identifier accepted as token audience"`
+	AutoCreate bool   `yaml:"auto_create" env:"TODO_OIDC_AUTO_CREATE" usage:"create users on their first login"`
+}
+
+// TenantOptions configures multi-tenant mode
+type TenantOptions struct {
+	Mode     string         `yaml:"mode" env:"TODO_TENANT_MODE" usage:"how tenants are resolved: header, subdomain or claim, enables multi-tenant mode"`
+	Header   string         `yaml:"header" env:"TODO_TENANT_HEADER" usage:"request header holding the tenant in header mode"`
+	Domain   string         `yaml:"domain" env:"TODO_TENANT_DOMAIN" usage:"base domain in subdomain mode"`
+	Claim    string         `yaml:"claim" env:"TODO_TENANT_CLAIM" usage:"token claim holding the tenant in claim mode"`
+	Dir      string         `yaml:"dir" env:"TODO_TENANT_DIR" usage:"directory of the tenant database files"`
+	IDs      []string       `yaml:"ids" env:"TODO_TENANT_IDS" usage:"tenants whose database file is created on first use, others need one in tenant.dir already"`
+	MaxOpen  int            `yaml:"max_open" env:"TODO_TENANT_MAX_OPEN" usage:"most tenant databases kept open at once, idle ones are closed to make room, 0 is unlimited"`
+	MaxTodos int            `yaml:"max_todos" env:"TODO_TENANT_MAX_TODOS" usage:"default todo item quota of a tenant, 0 is unlimited"`
+	Quotas   map[string]int `yaml:"quotas" env:"TODO_TENANT_QUOTAS" usage:"todo item quotas of specific tenants as tenant=quota,tenant=quota"`
+}
+
+// RateLimitOptions configures the requests per second each client can make
+type RateLimitOptions struct {
+	Reads       float64 `yaml:"reads" env:"TODO_RATE_LIMIT_READS" usage:"GET requests per second of a client, 0 is unlimited"`
+	ReadsBurst  int     `yaml:"reads_burst" env:"TODO_RATE_LIMIT_READS_BURST" usage:"GET requests a client can make at once"`
+	Writes      float64 `yaml:"writes" env:"TODO_RATE_LIMIT_WRITES" usage:"other requests per second of a client, 0 is unlimited"`
+	WritesBurst int     `yaml:"writes_burst" env:"TODO_RATE_LIMIT_WRITES_BURST" usage:"other requests a client can make at once"`
+	IP          float64 `yaml:"ip" env:"TODO_RATE_LIMIT_IP" usage:"requests per second of an IP address before authentication, 0 is unlimited"`
+	IPBurst     int     `yaml:"ip_burst" env:"TODO_RATE_LIMIT_IP_BURST" usage:"requests an IP address can make at once"`
+}
+
+// CORSOptions configures which browser clients on other origins can call the API
+type CORSOptions struct {
+	Origins       []string `yaml:"origins" env:"TODO_CORS_ORIGINS" usage:"comma-separated allowed origins or *, enables CORS"`
+	Methods       []string `yaml:"methods" env:"TODO_CORS_METHODS" usage:"comma-separated methods allowed in preflight responses"`
+	Headers       []string `yaml:"headers" env:"TODO_CORS_HEADERS" usage:"comma-separated request headers clients can send"`
+	ExposeHeaders []string `yaml:"expose_headers" env:"TODO_CORS_EXPOSE_HEADERS" usage:"comma-separated response headers clients can read"`
+	Credentials   bool     `yaml:"credentials" env:"TODO_CORS_CREDENTIALS" usage:"allow cookies and Authorization headers"`
+	MaxAge        int      `yaml:"max_age" env:"TODO_CORS_MAX_AGE" usage:"seconds a preflight response can be cached"`
+}
+
+// TLSOptions configures HTTPS
+type TLSOptions struct {
+	Cert         string `yaml:"cert" env:"TODO_TLS_CERT" usage:"path of the PEM certificate chain, enables HTTPS"`
+	Key          string `yaml:"key" env:"TODO_TLS_KEY" usage:"path of the PEM private key"`
+	ClientCA     string `yaml:"client_ca" env:"TODO_TLS_CLIENT_CA" usage:"path of the CA bundle client certificates are checked against, enables mutual TLS"`
+	RedirectPort string `yaml:"redirect_port" env:"TODO_TLS_REDIRECT_PORT" usage:"port of a plain HTTP server that redirects to HTTPS"`
+}
+
+// WebhookOptions configures how webhook deliveries are sent and retried
+type WebhookOptions struct {
+	Timeout      time.Duration `yaml:"timeout" env:"TODO_WEBHOOK_TIMEOUT" usage:"time a receiver has to respond to a delivery"`
+	Interval     time.Duration `yaml:"interval" env:"TODO_WEBHOOK_INTERVAL" usage:"time between checks for deliveries that are due"`
+	MaxAttempts  int           `yaml:"max_attempts" env:"TODO_WEBHOOK_MAX_ATTEMPTS" usage:"attempts after which a delivery is dead-lettered"`
+	Backoff      time.Duration `yaml:"backoff" env:"TODO_WEBHOOK_BACKOFF" usage:"time before the first retry, doubled after every attempt"`
+	MaxBackoff   time.Duration `yaml:"max_backoff" env:"TODO_WEBHOOK_MAX_BACKOFF" usage:"longest time between retries"`
+	Workers      int           `yaml:"workers" env:"TODO_WEBHOOK_WORKERS" usage:"deliveries that are sent at the same time"`
+	AllowPrivate bool          `yaml:"allow_private" env:"TODO_WEBHOOK_ALLOW_PRIVATE" usage:"allow webhook URLs on loopback, private and link-local addresses"`
+}
+
+// GRPCOptions configures the gRPC API
+type GRPCOptions struct {
+	Listen string `yaml:"listen" env:"TODO_GRPC_LISTEN" usage:"address the gRPC server listens on: host:port or unix:/path.sock, enables the gRPC API"`
+}
+
+// ClientOptions configures the command-line client, see cli.go
+type ClientOptions struct {
+	URL     string        `yaml:"url" env:"TODO_CLIENT_URL" usage:"URL of the server the command-line client talks to, like http://localhost:8080"`
+	Token   string        `yaml:"token" env:"TODO_CLIENT_TOKEN" usage:"bearer token the command-line client sends" secret:"true"`
+	Tenant  string        `yaml:"tenant" env:"TODO_CLIENT_TENANT" usage:"tenant the command-line client works on, sent in the tenant.header header or picking the database file in tenant.dir"`
+	Timeout time.Duration `yaml:"timeout" env:"TODO_CLIENT_TIMEOUT" usage:"time a request of the command-line client can take"`
+	Retries int           `yaml:"retries" env:"TODO_CLIENT_RETRIES" usage:"times the command-line client retries a rate limited request"`
+}
+
+// DefaultConfig returns the settings used when nothing else is configured
+func DefaultConfig() *Config {
+	return &Config{
+		DBPath: "todo.db",
+		Port:   "8080",
+		// Stay under the default Kubernetes grace period of 30 seconds
+		ShutdownDelay:   5 * time.Second,
+		ShutdownTimeout: 20 * time.Second,
+		Server: ServerOptions{
+			ReadHeaderTimeout: 2 * time.Second, // Prevent slowloris attack
+			ReadTimeout:       15 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			RequestTimeout:    10 * time.Second,
+			QueryTimeout:      5 * time.Second,
+			MaxHeaderBytes:    64 << 10,
+			MaxBodyBytes:      1 << 20,
+		},
+		Events: EventsOptions{
+			Replay:    1000,
+			Heartbeat: 15 * time.Second,
+		},
+		Log: LogOptions{
+			Level:  "info",
+			Format: "text",
+		},
+		Tracing: TracingOptions{
+			Exporter: "none",
+		},
+		Tenant: TenantOptions{
+			Header:  "X-Tenant-ID",
+			Claim:   "tenant",
+			Dir:     "tenants",
+			MaxOpen: 100,
+		},
+		CORS: CORSOptions{
+			Methods:       []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+			Headers:       []string{"Authorization", "Content-Type"},
+			ExposeHeaders: []string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After", "X-Request-ID"},
+		},
+		Webhook: WebhookOptions{
+			Timeout:     10 * time.Second,
+			Interval:    5 * time.Second,
+			MaxAttempts: 10,
+			Backoff:     30 * time.Second,
+			MaxBackoff:  time.Hour,
+			Workers:     8,
+		},
+		Client: ClientOptions{
+			Timeout: 30 * time.Second,
+			Retries: 2,
+		},
+	}
+}
+
+// configField is a single setting found by walking the Config struct
+type configField struct {
+	path   string // YAML path of the setting, like tenant.max_todos
+	env    string
+	usage  string
+	secret bool // hidden when the config is printed
+	value  reflect.Value
+}
+
+// configFields returns every setting of a config struct, descending into its sections
+func configFields(v reflect.Value, prefix string) []configField {
+	var fields []configField
+	for i := range v.NumField() {
+		field := v.Type().Field(i)
+		path := prefix + field.Tag.Get("yaml")
+		if field.Type.Kind() == reflect.Struct {
+			fields = append(fields, configFields(v.Field(i), path+".")...)
+			continue
+		}
+		fields = append(fields, configField{
+			path:   path,
+			env:    field.Tag.Get("env"),
+			usage:  field.Tag.Get("usage"),
+			secret: field.Tag.Get("secret") == "true",
+			value:  v.Field(i),
+		})
+	}
+	return fields
+}
+
+// flagName returns the command-line flag of the setting
+func (f configField) flagName() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(f.path)
+}
+
+// splitList splits a comma-separated list, ignoring empty items
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// set parses the setting from the text form used by environment variables and flags
+func (f configField) set(s string) error {
+	var err error
+	switch p := f.value.Addr().Interface().(type) {
+	case *string:
+		*p = s
+	case *bool:
+		*p, err = strconv.ParseBool(s)
+	case *int:
+		*p, err = strconv.Atoi(s)
+	case *int64:
+		*p, err = strconv.ParseInt(s, 10, 64)
+	case *float64:
+		*p, err = strconv.ParseFloat(s, 64)
+	case *time.Duration:
+		*p, err = time.ParseDuration(s)
+	case *[]string:
+		*p = splitList(s)
+	case *map[string]int: // Entries in the form of key=value,key=value
+		m := map[string]int{}
+		for _, pair := range splitList(s) {
+			key, value, found := strings.Cut(pair, "=")
+			if !found {
+				return fmt.Errorf("entry %q is not key=value", pair)
+			}
+			m[strings.TrimSpace(key)], err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return fmt.Errorf("entry %q: %w", pair, err)
+			}
+		}
+		*p = m
+	default:
+		return fmt.Errorf("unsupported setting type %s", f.value.Type())
+	}
+	return err
+}
+
+// String returns the setting in the text form used by environment variables and flags
+func (f configField) String() string {
+	switch v := f.value.Interface().(type) {
+	case []string:
+		return strings.Join(v, ",")
+	case map[string]int:
+		pairs := make([]string, 0, len(v))
+		for key, value := range v {
+			pairs = append(pairs, key+"="+strconv.Itoa(value))
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// flagValue remembers the raw value of a flag so it can be applied after the config file and environment
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+// String returns the value of the flag
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+// Set stores the value of the flag
+func (f *flagValue) Set(s string) error {
+	f.value = s
+	return nil
+}
+
+// IsBoolFlag lets boolean flags be given without a value
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// LoadConfig builds the configuration from the defaults, config file, environment and command-line arguments
+func LoadConfig(name string, args []string) (*Config, error) {
+	cfg := DefaultConfig()
+	fields := configFields(reflect.ValueOf(cfg).Elem(), "")
+
+	// Register a flag for every setting, showing the defaults in the help text
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("TODO_CONFIG"), "path of a YAML config file (env TODO_CONFIG)")
+	values := map[string]*flagValue{}
+	for _, field := range fields {
+		value := &flagValue{isBool: field.value.Kind() == reflect.Bool}
+		if !field.value.IsZero() {
+			value.value = field.String()
+		}
+		values[field.flagName()] = value
+		flags.Var(value, field.flagName(), field.usage+" (env "+field.env+")")
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("[LoadConfig] error: unexpected argument %q", flags.Arg(0))
+	}
+
+	// Read the config file, unknown keys are most likely typos so they're refused
+	if *configPath != "" {
+		file, err := os.Open(*configPath)
+		if err != nil {
+			return nil, fmt.Errorf("[LoadConfig] error opening config file: %w", err)
+		}
+		decoder := yaml.NewDecoder(file)
+		decoder.KnownFields(true)
+		err = decoder.Decode(cfg)
+		_ = file.Close()
+		// An empty file leaves the defaults as they are
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("[LoadConfig] error parsing config file %s: %w", *configPath, err)
+		}
+	}
+
+	// Environment variables override the config file, empty ones count as unset
+	for _, field := range fields {
+		if v := os.Getenv(field.env); v != "" {
+			err := field.set(v)
+			if err != nil {
+				return nil, fmt.Errorf("[LoadConfig] error parsing %s: %w", field.env, err)
+			}
+		}
+	}
+
+	// Flags given on the command line override everything else
+	fieldsByFlag := map[string]configField{}
+	for _, field := range fields {
+		fieldsByFlag[field.flagName()] = field
+	}
+	flags.Visit(func(f *flag.Flag) {
+		field, ok := fieldsByFlag[f.Name]
+		if !ok || err != nil {
+			return
+		}
+		if setErr := field.set(values[f.Name].value); setErr != nil {
+			err = fmt.Errorf("[LoadConfig] error parsing flag -%s: %w", f.Name, setErr)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("[LoadConfig] error validating config: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// Validate checks that the settings make sense on their own and together, reporting every problem at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	if path, isUnix := strings.CutPrefix(c.Listen, "unix:"); isUnix {
+		check(path != "", "listen needs a socket path after unix:")
+	} else if c.Listen != "" {
+		_, port, err := net.SplitHostPort(c.Listen)
+		check(err == nil && port != "", "listen %q is not host:port, [ipv6]:port or unix:/path.sock", c.Listen)
+	} else {
+		port, err := strconv.Atoi(c.Port)
+		check(err == nil && port > 0 && port < 65536, "port %q is not a port number", c.Port)
+	}
+	if c.SocketMode != "" {
+		_, err := strconv.ParseUint(c.SocketMode, 8, 32)
+		check(err == nil, "socket_mode %q is not an octal file mode", c.SocketMode)
+	}
+	if path, isUnix := strings.CutPrefix(c.GRPC.Listen, "unix:"); isUnix {
+		check(path != "", "grpc.listen needs a socket path after unix:")
+	} else if c.GRPC.Listen != "" {
+		_, port, err := net.SplitHostPort(c.GRPC.Listen)
+		check(err == nil && port != "", "grpc.listen %q is not host:port, [ipv6]:port or unix:/path.sock", c.GRPC.Listen)
+	}
+	check(c.DBPath != "", "db_path can't be empty")
+	check(c.ShutdownDelay >= 0, "shutdown_delay can't be negative")
+	check(c.ShutdownTimeout > 0, "shutdown_timeout has to be positive")
+
+	for _, timeout := range []time.Duration{c.Server.ReadHeaderTimeout, c.Server.ReadTimeout, c.Server.WriteTimeout, c.Server.IdleTimeout, c.Server.RequestTimeout, c.Server.QueryTimeout} {
+		check(timeout >= 0, "server timeouts can't be negative")
+	}
+	check(c.Server.MaxHeaderBytes >= 0 && c.Server.MaxBodyBytes >= 0, "server size limits can't be negative")
+
+	check(c.Events.Replay >= 0, "events.replay can't be negative")
+	check(c.Events.Heartbeat > 0, "events.heartbeat has to be positive")
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Log.Level)) == nil, "unknown log.level %q", c.Log.Level)
+	check(slices.Contains([]string{"text", "json"}, c.Log.Format), "unknown log.format %q", c.Log.Format)
+	check(slices.Contains([]string{"none", "otlp", "stdout"}, c.Tracing.Exporter), "unknown tracing.exporter %q", c.Tracing.Exporter)
+
+	switch c.Tenant.Mode {
+	case "", TenantModeHeader:
+	case TenantModeSubdomain:
+		check(c.Tenant.Domain != "", "tenant.domain is required in %s mode", c.Tenant.Mode)
+	case TenantModeClaim:
+		check(c.OIDC.Issuer != "", "oidc.issuer is required in %s mode", c.Tenant.Mode)
+	default:
+		check(false, "unknown tenant.mode %q", c.Tenant.Mode)
+	}
+	for _, tenantID := range c.Tenant.IDs {
+		check(tenantIDPattern.MatchString(tenantID), "tenant.ids has invalid tenant ID %q", tenantID)
+	}
+	check(c.Tenant.MaxOpen >= 0, "tenant.max_open can't be negative")
+	check(c.Tenant.MaxTodos >= 0, "tenant.max_todos can't be negative")
+	for tenantID, quota := range c.Tenant.Quotas {
+		check(quota >= 0, "tenant.quotas of %s can't be negative", tenantID)
+	}
+
+	check(c.RateLimit.Reads >= 0 && c.RateLimit.Writes >= 0 && c.RateLimit.IP >= 0, "rate_limit.reads, rate_limit.writes and rate_limit.ip can't be negative")
+	check(c.RateLimit.ReadsBurst >= 0 && c.RateLimit.WritesBurst >= 0 && c.RateLimit.IPBurst >= 0, "rate_limit.reads_burst, rate_limit.writes_burst and rate_limit.ip_burst can't be negative")
+
+	// Browsers refuse credentials with a wildcard origin and reflecting every origin instead would let any site use them
+	check(!c.CORS.Credentials || !slices.Contains(c.CORS.Origins, "*"), "cors.credentials can't be used when cors.origins is *")
+	check(c.CORS.MaxAge >= 0, "cors.max_age can't be negative")
+
+	check((c.TLS.Cert == "") == (c.TLS.Key == ""), "tls.cert and tls.key have to be set together")
+	check(c.TLS.ClientCA == "" || c.TLS.Cert != "", "tls.client_ca requires tls.cert and tls.key")
+	check(c.TLS.RedirectPort == "" || c.TLS.Cert != "", "tls.redirect_port requires tls.cert and tls.key")
+
+	check(c.Webhook.Timeout > 0 && c.Webhook.Interval > 0, "webhook.timeout and webhook.interval have to be positive")
+	check(c.Webhook.MaxAttempts > 0 && c.Webhook.Workers > 0, "webhook.max_attempts and webhook.workers have to be positive")
+	check(c.Webhook.Backoff > 0 && c.Webhook.MaxBackoff >= c.Webhook.Backoff, "webhook.backoff has to be positive and at most webhook.max_backoff")
+
+	if c.Client.URL != "" {
+		u, err := url.Parse(c.Client.URL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "client.url %q is not an http:// or https:// URL", c.Client.URL)
+	}
+	check(c.Client.Tenant == "" || tenantIDPattern.MatchString(c.Client.Tenant), "client.tenant %q is not a valid tenant ID", c.Client.Tenant)
+	check(c.Client.Timeout >= 0 && c.Client.Retries >= 0, "client.timeout and client.retries can't be negative")
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config that is safe to show, with secret settings hidden
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	for _, field := range configFields(reflect.ValueOf(&redacted).Elem(), "") {
+		if field.secret && !field.value.IsZero() {
+			_ = field.set("REDACTED")
+		}
+	}
+	return &redacted
+}
+
+// ConfigCommand runs the config subcommand, print shows the effective configuration as YAML
+func ConfigCommand(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return errors.New("[ConfigCommand] error: usage is go-todo config print [flags]")
+	}
+
+	cfg, err := LoadConfig("go-todo config print", args[1:])
+	if err != nil {
+		return err
+	}
+
+	out, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		return fmt.Errorf("[ConfigCommand] error encoding config: %w", err)
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRedacted(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Client.Token = "hunter2"
+
+	redacted := cfg.Redacted()
+	if redacted.Client.Token != "REDACTED" {
+		t.Errorf("client.token is %q once redacted", redacted.Client.Token)
+	}
+	if cfg.Client.Token != "hunter2" {
+		t.Errorf("redacting changed client.token of the original config to %q", cfg.Client.Token)
+	}
+
+	// Unset secrets stay unset so that it's clear they aren't configured
+	redacted = DefaultConfig().Redacted()
+	if redacted.Client.Token != "" {
+		t.Errorf("unset client.token is %q once redacted", redacted.Client.Token)
+	}
+}
+
+func TestSecretsTagged(t *testing.T) {
+	// Settings named like credentials have to be hidden when the config is printed
+	for _, field := range configFields(reflect.ValueOf(DefaultConfig()).Elem(), "") {
+		name := field.path[strings.LastIndex(field.path, ".")+1:]
+		for _, word := range []string{"token", "secret", "password"} {
+			if strings.Contains(name, word) && !field.secret {
+				t.Errorf("%s isn't tagged as secret", field.path)
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// CORSConfig controls which browser clients on other origins can call the API
+type CORSConfig struct {
+	origins        []string // allowed origins, "*" allows any
+	methods        []string // methods that can be allowed in preflight responses
+	headers        []string // request headers clients can send
+	exposeHeaders  []string // response headers clients can read
+	credentials    bool     // allow cookies and Authorization headers
+	maxAge         int      // seconds a preflight response can be cached, 0 leaves it to the browser
+	allowAnyOrigin bool
+}
+
+// Global CORS configuration, nil when CORS is disabled
+var cors *CORSConfig
+
+// SetupCORS creates the CORS configuration of the server, nil when CORS is disabled
+func SetupCORS(options CORSOptions) *CORSConfig {
+	// If no origins are allowed CORS is disabled
+	if len(options.Origins) == 0 {
+		return nil
+	}
+
+	c := &CORSConfig{
+		origins:        options.Origins,
+		methods:        options.Methods,
+		headers:        make([]string, len(options.Headers)),
+		exposeHeaders:  options.ExposeHeaders,
+		credentials:    options.Credentials,
+		maxAge:         options.MaxAge,
+		allowAnyOrigin: slices.Contains(options.Origins, "*"),
+	}
+
+	// Header names are case-insensitive so compare them in canonical form
+	for i, header := range options.Headers {
+		c.headers[i] = http.CanonicalHeaderKey(header)
+	}
+
+	return c
+}
+
+// allowOrigin reports whether requests from the origin are allowed
+func (c *CORSConfig) allowOrigin(origin string) bool {
+	return c.allowAnyOrigin || slices.Contains(c.origins, origin)
+}
+
+// routeMethods returns the configured methods that have a route registered for the path
+func (c *CORSConfig) routeMethods(mux *http.ServeMux, r *http.Request) []string {
+	var methods []string
+	for _, method := range c.methods {
+		// Ask the router which pattern would handle the request without running it
+		probe := &http.Request{Method: method, URL: &url.URL{Path: r.URL.Path}, Host: r.Host}
+		_, pattern := mux.Handler(probe)
+		if pattern != "" {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// CORS wraps the router so that it answers preflight requests and adds CORS headers to responses
+func CORS(mux *http.ServeMux) http.Handler {
+	// If CORS is disabled the router is used as is
+	if cors == nil {
+		return mux
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Responses depend on the origin so caches have to keep them apart
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		// Requests without an origin don't come from a browser on another origin
+		if origin == "" || !cors.allowOrigin(origin) {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		// Tell the browser which origin can read the response
+		if cors.allowAnyOrigin {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if cors.credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		// Anything other than a preflight request is handled by the router
+		requestMethod := r.Header.Get("Access-Control-Request-Method")
+		if r.Method != http.MethodOptions || requestMethod == "" {
+			if len(cors.exposeHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(cors.exposeHeaders, ", "))
+			}
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		// Preflight responses also depend on what is being asked for
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+		// Only allow the methods that have a route for this path
+		methods := cors.routeMethods(mux, r)
+		if !slices.Contains(methods, requestMethod) {
+			// Tell the client that the status of the request is 403
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		// Only allow the configured request headers
+		var headers []string
+		for _, header := range splitList(r.Header.Get("Access-Control-Request-Headers")) {
+			header = http.CanonicalHeaderKey(header)
+			if !slices.Contains(cors.headers, header) {
+				// Tell the client that the status of the request is 403
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			headers = append(headers, header)
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		if len(headers) > 0 {
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+		}
+		if cors.maxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(cors.maxAge))
+		}
+
+		// Tell the client that the status of the request is 204
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+// setupTestCORS allows the origins for the duration of the test, it has to run before the router is set up
+func setupTestCORS(t *testing.T, options CORSOptions) {
+	t.Helper()
+	defaults := DefaultConfig().CORS
+	options.Methods, options.Headers, options.ExposeHeaders = defaults.Methods, defaults.Headers, defaults.ExposeHeaders
+	previous := cors
+	cors = SetupCORS(options)
+	t.Cleanup(func() { cors = previous })
+}
+
+func TestCORS(t *testing.T) {
+	setupTestCORS(t, CORSOptions{Origins: []string{"https://app.example.com"}, MaxAge: 600})
+	server, issuer := setupTestServer(t)
+	token := issuer.token(t, issuer.key, "alice", nil)
+	// Preflight responses also depend on what is asked for, whether it's allowed or not
+	preflightVary := []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"}
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		origin         string
+		requestMethod  string
+		requestHeaders string
+		status         int
+		allowOrigin    string
+		allowMethods   string
+		vary           []string
+	}{
+		{"preflight", http.MethodOptions, "/todo/1", "https://app.example.com", http.MethodPut, "authorization, content-type",
+			http.StatusNoContent, "https://app.example.com", "GET, PUT, DELETE", preflightVary},
+		{"preflight of a method without a route", http.MethodOptions, "/todos", "https://app.example.com", http.MethodDelete, "",
+			http.StatusForbidden, "https://app.example.com", "", preflightVary},
+		{"preflight of a header that isn't allowed", http.MethodOptions, "/todos", "https://app.example.com", http.MethodGet, "X-Secret",
+			http.StatusForbidden, "https://app.example.com", "", preflightVary},
+		{"preflight from another origin", http.MethodOptions, "/todos", "https://evil.example.com", http.MethodGet, "",
+			http.StatusMethodNotAllowed, "", "", []string{"Origin"}},
+		{"request from an allowed origin", http.MethodGet, "/todos", "https://app.example.com", "", "",
+			http.StatusOK, "https://app.example.com", "", []string{"Origin"}},
+		{"request from another origin", http.MethodGet, "/todos", "https://evil.example.com", "", "",
+			http.StatusOK, "", "", []string{"Origin"}},
+		{"request without an origin", http.MethodGet, "/todos", "", "", "",
+			http.StatusOK, "", "", []string{"Origin"}},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, server.URL+test.path, nil)
+		if err != nil {
+			t.Fatalf("error creating request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+		if test.requestMethod != "" {
+			req.Header.Set("Access-Control-Request-Method", test.requestMethod)
+		}
+		if test.requestHeaders != "" {
+			req.Header.Set("Access-Control-Request-Headers", test.requestHeaders)
+		}
+		res, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		_ = res.Body.Close()
+
+		if res.StatusCode != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, res.StatusCode, test.status)
+		}
+		if got := res.Header.Get("Access-Control-Allow-Origin"); got != test.allowOrigin {
+			t.Errorf("%s: got Access-Control-Allow-Origin %q, want %q", test.name, got, test.allowOrigin)
+		}
+		if got := res.Header.Get("Access-Control-Allow-Methods"); got != test.allowMethods {
+			t.Errorf("%s: got Access-Control-Allow-Methods %q, want %q", test.name, got, test.allowMethods)
+		}
+		if got := res.Header.Values("Vary"); !slices.Equal(got, test.vary) {
+			t.Errorf("%s: got Vary %q, want %q", test.name, got, test.vary)
+		}
+
+		// Only allowed origins can read the headers of responses and cache preflights
+		if test.allowOrigin != "" && test.requestMethod == "" && res.Header.Get("Access-Control-Expose-Headers") == "" {
+			t.Errorf("%s: no Access-Control-Expose-Headers", test.name)
+		}
+		if test.status == http.StatusNoContent && res.Header.Get("Access-Control-Max-Age") != "600" {
+			t.Errorf("%s: got Access-Control-Max-Age %q, want 600", test.name, res.Header.Get("Access-Control-Max-Age"))
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Kinds of changes to todo items
+const (
+	EventCreated = "created"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+	// An update that marked the item as done, only sent to webhooks since it's also an update
+	EventCompleted = "completed"
+)
+
+// Event is a change to a todo item, deleted items only have their ID and list
+type Event struct {
+	ID     uint64
+	Type   string
+	Todo   TodoItem
+	tenant string // tenant the item belongs to, subscribers only get events of their own tenant
+}
+
+// subscriber receives the events of one tenant until it's closed
+type subscriber struct {
+	tenant string
+	events chan Event
+	closed bool
+}
+
+// Hub passes changes to todo items on to everyone following them and keeps the most recent ones for clients that
+// reconnect. Event IDs start over when the server restarts so they're sent together with the epoch of the process.
+type Hub struct {
+	epoch  string // when the hub was created, tells apart event IDs of different processes
+	size   int    // amount of recent events kept for replay
+	buffer int    // amount of events a subscriber can lag behind before it's dropped
+
+	mu          sync.Mutex
+	lastID      uint64
+	recent      []Event // ring buffer of the most recent events
+	subscribers map[*subscriber]struct{}
+	closed      bool
+}
+
+// Change feed subscribers currently connected
+var eventSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "todo_event_subscribers",
+	Help: "Clients currently following the change feed.",
+})
+
+// NewHub creates a hub that keeps the given amount of events for replay
+func NewHub(size int) *Hub {
+	return &Hub{
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		size:        size,
+		buffer:      64,
+		subscribers: map[*subscriber]struct{}{},
+	}
+}
+
+// Global hub of todo item changes
+var hub = NewHub(1000)
+
+// Time between the comments that keep idle change feed connections open
+var eventHeartbeat = 15 * time.Second
+
+// Publish sends a change to the subscribers of the tenant the request belongs to
+func (h *Hub) Publish(ctx context.Context, eventType string, todo TodoItem) {
+	tenantID, _ := ctx.Value(tenantIDContextKey).(string)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastID++
+	event := Event{ID: h.lastID, Type: eventType, Todo: todo, tenant: tenantID}
+	if h.size > 0 {
+		if len(h.recent) < h.size {
+			h.recent = append(h.recent, event)
+		} else {
+			h.recent[(event.ID-1)%uint64(h.size)] = event
+		}
+	}
+
+	for sub := range h.subscribers {
+		if sub.tenant != tenantID {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			// Don't let a slow client hold up everyone else, it can catch up from the replay buffer when it reconnects
+			slog.WarnContext(ctx, "dropping change feed subscriber that fell behind", "tenant", tenantID)
+			h.remove(sub)
+		}
+	}
+}
+
+// Subscribe follows the changes of a tenant. It returns the events after lastEventID that are still kept and whether
+// those are all of them, if not the client has missed changes and has to fetch everything again.
+func (h *Hub) Subscribe(tenantID, lastEventID string) (*subscriber, []Event, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub := &subscriber{tenant: tenantID, events: make(chan Event, h.buffer)}
+	if h.closed {
+		sub.closed = true
+		close(sub.events)
+		return sub, nil, true
+	}
+	h.subscribers[sub] = struct{}{}
+	eventSubscribers.Inc()
+
+	// New clients start from now on
+	if lastEventID == "" {
+		return sub, nil, true
+	}
+
+	// IDs of another process or that can't be parsed can't be resumed from
+	epoch, id, found := strings.Cut(lastEventID, "-")
+	lastID, err := strconv.ParseUint(id, 10, 64)
+	if !found || err != nil || epoch != h.epoch || lastID > h.lastID {
+		return sub, nil, false
+	}
+
+	// Only the most recent events are kept, when they don't reach back to the last one the client saw it missed some
+	if lastID+uint64(len(h.recent)) < h.lastID {
+		return sub, nil, false
+	}
+
+	// Collect the kept events after the last one the client saw, oldest first
+	var replay []Event
+	for i := range h.recent {
+		event := h.recent[(int(h.lastID)+i)%len(h.recent)]
+		if event.ID > lastID && event.tenant == tenantID {
+			replay = append(replay, event)
+		}
+	}
+	return sub, replay, true
+}
+
+// Unsubscribe stops sending events to a subscriber
+func (h *Hub) Unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(sub)
+}
+
+// remove closes the channel of a subscriber, the hub has to be locked
+func (h *Hub) remove(sub *subscriber) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	close(sub.events)
+	delete(h.subscribers, sub)
+	eventSubscribers.Dec()
+}
+
+// Close ends every subscription so that streaming requests return and the server can shut down
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for sub := range h.subscribers {
+		h.remove(sub)
+	}
+}
+
+// eventID returns the ID of an event as sent to clients
+func (h *Hub) eventID(event Event) string {
+	return h.epoch + "-" + strconv.FormatUint(event.ID, 10)
+}
+
+// canSeeEvent reports whether the user of the context has access to the todo item of an event
+func canSeeEvent(ctx context.Context, event Event) bool {
+	user, ok := UserFromContext(ctx)
+	if event.Todo.ListID == nil || !ok {
+		return true
+	}
+	role, err := ListRole(ctx, user.ID, *event.Todo.ListID)
+	if err != nil {
+		slog.ErrorContext(ctx, "error checking access to event", "error", err)
+		return false
+	}
+	return role != ""
+}
+
+// HTTP handler streaming changes to todo items as Server-Sent Events
+func TodoEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// The stream stays open for as long as the client wants, past the write timeout of the server
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		slog.WarnContext(r.Context(), "error clearing write deadline of change feed", "error", err)
+	}
+
+	// Start following changes before sending anything so none are missed
+	tenantID, _ := r.Context().Value(tenantIDContextKey).(string)
+	sub, replay, complete := hub.Subscribe(tenantID, r.Header.Get("Last-Event-ID"))
+	defer hub.Unsubscribe(sub)
+
+	// Tell the client that we are going to stream events
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Ask reverse proxies like nginx not to buffer the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	// Tell the client that the status of the request is 200
+	w.WriteHeader(http.StatusOK)
+
+	// Changes were missed so the client has to fetch all todo items again
+	if !complete {
+		_, err = fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, event := range replay {
+		if err == nil && canSeeEvent(r.Context(), event) {
+			err = writeEvent(w, event)
+		}
+	}
+	if err == nil {
+		err = rc.Flush()
+	}
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for err == nil {
+		select {
+		case <-r.Context().Done(): // The client disconnected
+			return
+		case <-heartbeat.C:
+			// Comments are ignored by clients but keep proxies from closing idle connections
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		case event, ok := <-sub.events:
+			if !ok {
+				// The client fell behind or the server is shutting down, it reconnects and resumes where it left off
+				return
+			}
+			if !canSeeEvent(r.Context(), event) {
+				continue
+			}
+			err = writeEvent(w, event)
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+	}
+	slog.DebugContext(r.Context(), "change feed client went away", "error", err)
+}
+
+// writeEvent writes an event in the Server-Sent Events format, the data is the todo item
+func writeEvent(w http.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event.Todo)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", hub.eventID(event), event.Type, data)
+	return err
+}
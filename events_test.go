@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHubSubscribe(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		last     string
+		replay   int
+		complete bool
+	}{
+		{"new client", 5, "", 0, true},
+		{"resume with everything kept", 5, "0", 3, true},
+		{"resume after the last event", 5, "3", 0, true},
+		{"resume with the next event kept", 2, "1", 2, true},
+		{"resume before the kept events", 2, "0", 0, false},
+		{"resume without replay", 0, "2", 0, false},
+		{"resume without replay after the last event", 0, "3", 0, true},
+		{"resume from another process", 5, "other-1", 0, false},
+		{"resume from the future", 5, "4", 0, false},
+	}
+	for _, test := range tests {
+		h := NewHub(test.size)
+		for range 3 {
+			h.Publish(context.Background(), EventCreated, TodoItem{})
+		}
+		last := test.last
+		if last != "" && !strings.Contains(last, "-") {
+			last = h.epoch + "-" + last
+		}
+		_, replay, complete := h.Subscribe("", last)
+		if len(replay) != test.replay || complete != test.complete {
+			t.Errorf("%s: got %d events and complete %t, want %d and %t", test.name, len(replay), complete,
+				test.replay, test.complete)
+		}
+	}
+}
+
+// openTestEvents starts following the change feed and returns the lines it sends, the stream ends with the test or
+// once cancel is called
+func openTestEvents(t *testing.T, server *httptest.Server, token, lastEventID string) (<-chan string, context.CancelFunc) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/todos/events", nil)
+	if err != nil {
+		t.Fatalf("error creating request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	res, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("error following changes: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("following changes: got status %d", res.StatusCode)
+	}
+
+	lines := make(chan string)
+	go func() {
+		defer res.Body.Close()
+		defer close(lines)
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return lines, cancel
+}
+
+// readTestEvent returns the next line of the stream that starts with prefix
+func readTestEvent(t *testing.T, lines <-chan string, prefix string) string {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("stream ended waiting for %q", prefix)
+			}
+			if strings.HasPrefix(line, prefix) {
+				return line
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %q", prefix)
+		}
+	}
+}
+
+func TestTodoEvents(t *testing.T) {
+	// Idle streams get heartbeats often enough to see one
+	previousHeartbeat := eventHeartbeat
+	eventHeartbeat = 10 * time.Millisecond
+	t.Cleanup(func() { eventHeartbeat = previousHeartbeat })
+	server, issuer := setupTestServer(t)
+	token := issuer.token(t, issuer.key, "alice", nil)
+
+	for _, description := range []string{"first", "second", "third"} {
+		res, body := testRequest(t, server, token, http.MethodPost, "/todo", map[string]any{"description": description})
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("creating todo item: %d %s", res.StatusCode, body)
+		}
+	}
+
+	// Resuming replays the events after the last one the client saw
+	lines, cancel := openTestEvents(t, server, token, hub.epoch+"-1")
+	for _, want := range []string{"2", "3"} {
+		if id := readTestEvent(t, lines, "id: "); id != "id: "+hub.epoch+"-"+want {
+			t.Fatalf("got %q, want event %s", id, want)
+		}
+	}
+
+	// Resuming from an event that isn't kept tells the client to fetch everything again
+	reset, cancelReset := openTestEvents(t, server, token, "other-1")
+	if event := readTestEvent(t, reset, "event: "); event != "event: reset" {
+		t.Fatalf("resuming from an unknown event sent %q, want a reset", event)
+	}
+	cancelReset()
+
+	// Idle streams get heartbeats
+	heartbeat, cancelHeartbeat := openTestEvents(t, server, token, "")
+	readTestEvent(t, heartbeat, ": heartbeat")
+	cancelHeartbeat()
+
+	// Clients that disconnect stop being subscribers
+	cancel()
+	for range lines {
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		hub.mu.Lock()
+		subscribers := len(hub.subscribers)
+		hub.mu.Unlock()
+		if subscribers == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d subscribers are left after the clients disconnected", subscribers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
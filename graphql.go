@@ -0,0 +1,749 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/graph-gophers/graphql-go"
+)
+
+// Schema of the GraphQL API, the comments are the descriptions clients see through introspection
+const graphqlSchemaSource = `
+schema {
+	query: Query
+	mutation: Mutation
+	subscription: Subscription
+}
+
+type Query {
+	# Todo items the user can see, ordered by ID, a page at a time
+	todos(filter: TodoFilter, first: Int = 50, after: String): TodoConnection!
+	# Todo item by ID, null if it doesn't exist or the user can't see it
+	todo(id: ID!): Todo
+	# Lists the user owns or has been shared
+	lists: [List!]!
+	# List by ID, null if it doesn't exist or the user has no role on it
+	list(id: ID!): List
+	# Tags of the todo items the user can see
+	tags: [Tag!]!
+}
+
+type Mutation {
+	# Add a todo item, like POST /todo
+	createTodo(input: TodoInput!): Todo!
+	# Change a todo item, like PUT /todo/{todo_id}
+	updateTodo(id: ID!, input: TodoInput!): Todo!
+	# Remove a todo item, like DELETE /todo/{todo_id}, and return its ID
+	deleteTodo(id: ID!): ID!
+}
+
+type Subscription {
+	# Changes to the todo items of a list, or of every item the user can see without a list ID
+	todoChanged(listId: ID): TodoEvent!
+}
+
+input TodoFilter {
+	done: Boolean
+	# Ignored when getting the todo items of a list
+	listId: ID
+	# Only items without a list, ignored when getting the todo items of a list
+	noList: Boolean
+	tag: String
+	# Part of the description, ignoring case
+	search: String
+}
+
+input TodoInput {
+	description: String!
+	done: Boolean = false
+	# List of the item, updates keep the item in its current list without one
+	listId: ID
+	# Replace the tags of the item, updates keep the current tags without them
+	tags: [String!]
+}
+
+type Todo {
+	id: ID!
+	description: String!
+	done: Boolean!
+	list: List
+	tags: [Tag!]!
+}
+
+type List {
+	id: ID!
+	name: String!
+	ownerId: ID!
+	# Role of the user on the list
+	role: String!
+	todos(filter: TodoFilter, first: Int = 50, after: String): TodoConnection!
+}
+
+type Tag {
+	id: ID!
+	name: String!
+}
+
+type TodoConnection {
+	nodes: [Todo!]!
+	pageInfo: PageInfo!
+}
+
+type PageInfo {
+	# Pass as after to get the next page
+	endCursor: String
+	hasNextPage: Boolean!
+}
+
+type TodoEvent {
+	# Same as the event IDs of GET /todos/events
+	id: String!
+	# created, updated or deleted
+	type: String!
+	# Only the ID and list are left of deleted items
+	todo: Todo!
+}
+`
+
+// Limits of GraphQL queries so a single one can't keep the database busy
+const (
+	graphqlMaxPage        = 100 // most todo items on a page
+	graphqlMaxDepth       = 10  // most levels of nested fields
+	graphqlMaxParallelism = 10  // most fields resolved at the same time
+)
+
+// Parsed GraphQL schema bound to its resolvers
+var graphqlSchema = graphql.MustParseSchema(graphqlSchemaSource, &graphqlResolver{},
+	graphql.MaxDepth(graphqlMaxDepth),
+	graphql.MaxParallelism(graphqlMaxParallelism),
+)
+
+// Context key of the HTTP request a GraphQL operation was sent with, mutations apply the write rate limit to it
+const graphqlRequestContextKey contextKey = "graphqlRequest"
+
+// GraphQLRequest is the body of a GraphQL request and the payload of a subscription over a WebSocket
+type GraphQLRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// isGraphQL reports whether a request runs GraphQL operations, which only use the write rate limit for mutations
+func isGraphQL(r *http.Request) bool {
+	return r.Pattern == "POST /graphql"
+}
+
+// HTTP handler for GraphQL queries and mutations
+func GraphQL(w http.ResponseWriter, r *http.Request) {
+	var req GraphQLRequest
+
+	// Map the operation from request body to variable
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteBodyError(w, r, err)
+		return
+	}
+	if req.Query == "" {
+		// Return the JSON-encoded error message
+		WriteHTTPError(w, r, "Missing query", http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	// Errors of resolvers are part of the response like in every GraphQL API
+	ctx := context.WithValue(r.Context(), graphqlRequestContextKey, r)
+	response := graphqlSchema.Exec(ctx, req.Query, req.OperationName, req.Variables)
+
+	// Tell the client that we are going to return JSON
+	w.Header().Add("Content-Type", "application/json")
+	// Tell the client that the status of the request is 200
+	w.WriteHeader(http.StatusOK)
+	// Return the JSON-encoded response
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		// Log encoding error for debugging
+		slog.ErrorContext(r.Context(), "error encoding GraphQL response", "error", err)
+	}
+}
+
+// graphqlError is an error of a resolver, with the status and code the REST API would respond with as extensions
+type graphqlError struct {
+	*HTTPError
+}
+
+func (e graphqlError) Error() string {
+	return e.Message
+}
+
+func (e graphqlError) Extensions() map[string]any {
+	return map[string]any{
+		"status": e.Status,
+		"code":   strings.ToUpper(strings.ReplaceAll(e.Detail, " ", "_")),
+	}
+}
+
+// graphqlErr maps an error of a resolver to the one returned to the client
+func graphqlErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	e := ErrorResponse(ctx, err)
+	// Server errors are our problem so keep a record of them
+	if e.Status >= http.StatusInternalServerError {
+		slog.ErrorContext(ctx, "error resolving GraphQL field", "error", e.Error(), "status", e.Status)
+	}
+	return graphqlError{e}
+}
+
+// isNotFound reports whether an error means that something doesn't exist or the user can't see it
+func isNotFound(err error) bool {
+	var httpErr *HTTPError
+	return errors.As(err, &httpErr) && httpErr.Status == http.StatusNotFound
+}
+
+// parseID gets the numeric ID behind a GraphQL ID
+func parseID(id graphql.ID) (int64, error) {
+	n, err := strconv.ParseInt(string(id), 10, 64)
+	if err != nil {
+		return 0, NewHTTPError("ID "+strconv.Quote(string(id))+" is not a number", http.StatusBadRequest, "Bad Request")
+	}
+	return n, nil
+}
+
+// formatID returns the GraphQL ID of a numeric ID
+func formatID(id int64) graphql.ID {
+	return graphql.ID(strconv.FormatInt(id, 10))
+}
+
+// graphqlResolver resolves the root fields of queries, mutations and subscriptions
+type graphqlResolver struct{}
+
+// todoFilterInput is the TodoFilter input type
+type todoFilterInput struct {
+	Done   *bool
+	ListID *graphql.ID
+	NoList *bool
+	Tag    *string
+	Search *string
+}
+
+// todosArgs are the arguments of fields returning a page of todo items
+type todosArgs struct {
+	Filter *todoFilterInput
+	First  int32
+	After  *string
+}
+
+// find returns the filter, the cursor and the size of the page asked for
+func (args todosArgs) find() (TodoFilter, int64, int, error) {
+	var filter TodoFilter
+	if args.First < 1 || args.First > graphqlMaxPage {
+		return filter, 0, 0, NewHTTPError("first has to be between 1 and "+strconv.Itoa(graphqlMaxPage), http.StatusBadRequest, "Bad Request")
+	}
+
+	var after int64
+	if args.After != nil {
+		cursor, err := base64.RawURLEncoding.DecodeString(*args.After)
+		if err == nil {
+			after, err = strconv.ParseInt(string(cursor), 10, 64)
+		}
+		if err != nil {
+			return filter, 0, 0, NewHTTPError("Invalid cursor", http.StatusBadRequest, "Bad Request")
+		}
+	}
+
+	if f := args.Filter; f != nil {
+		filter.Done = f.Done
+		if f.ListID != nil {
+			listID, err := parseID(*f.ListID)
+			if err != nil {
+				return filter, 0, 0, err
+			}
+			filter.ListIDs = []int64{listID}
+		}
+		filter.NoList = f.NoList != nil && *f.NoList
+		if f.Tag != nil {
+			filter.Tag = *f.Tag
+		}
+		if f.Search != nil {
+			filter.Search = *f.Search
+		}
+	}
+	return filter, after, int(args.First), nil
+}
+
+func (graphqlResolver) Todos(ctx context.Context, args todosArgs) (*todoConnection, error) {
+	filter, after, first, err := args.find()
+	if err != nil {
+		return nil, graphqlErr(ctx, err)
+	}
+	// Get one more item than asked for to know if there is another page
+	todos, err := store.Find(ctx, filter, after, first+1)
+	if err != nil {
+		return nil, graphqlErr(ctx, err)
+	}
+	return newTodoConnection(todos, first, newTodoBatch(todos)), nil
+}
+
+func (graphqlResolver) Todo(ctx context.Context, args struct{ ID graphql.ID }) (*todoResolver, error) {
+	id, err := parseID(args.ID)
+	if err != nil {
+		return nil, graphqlErr(ctx, err)
+	}
+	todo, err := store.Get(ctx, id)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, graphqlErr(ctx, err)
+	}
+	return newTodoResolver(todo), nil
+}
+
+func (graphqlResolver) Lists(ctx context.Context) ([]*listResolver, error) {
+	// Lists need authentication to be enabled
+	user, ok := UserFromContext(ctx)
+	if !ok {
+		return []*listResolver{}, nil
+	}
+	lists, err := UserLists(ctx, user.ID)
+	if err != nil {
+		return nil, graphqlErr(ctx, err)
+	}
+	return newListResolvers(lists), nil
+}
+
+func (graphqlResolver) List(ctx context.Context, args struct{ ID graphql.ID }) (*listResolver, error) {
+	id, err := parseID(args.ID)
+	if err != nil {
+		return nil, graphqlErr(ctx, err)
+	}
+	lists, err := ListsByID(ctx, []int64{id})
+	if err != nil {
+		return nil, graphqlErr(ctx, err)
+	}
+	list, ok := lists[id]
+	if !ok {
+		return nil, nil
+	}
+	return newListResolvers([]*List{list})[0], nil
+}
+
+func (graphqlResolver) Tags(ctx context.Context) ([]*tagResolver, error) {
+	tags, err := store.Tags(ctx)
+	if err != nil {
+		return nil, graphqlErr(ctx, err)
+	}
+	return newTagResolvers(tags), nil
+}
+
+// todoInput is the TodoInput input type
+type todoInput struct {
+	Description string
+	Done        bool
+	ListID      *graphql.ID
+	Tags        *[]string
+}
+
+// todo returns the todo item and the tags it should get, nil tags mean keeping the current ones
+func (input todoInput) todo() (TodoItem, []string, error) {
+	todo := TodoItem{Description: input.Description, Done: input.Done}
+	if input.ListID != nil {
+		listID, err := parseID(*input.ListID)
+		if err != nil {
+			return todo, nil, err
+		}
+		todo.ListID = &listID
+	}
+	if input.Tags == nil {
+		return todo, nil, nil
+	}
+	tags, err := TagNames(*input.Tags)
+	return todo, tags, err
+}
+
+// allowMutation applies the write rate limit to a mutation, the request was only limited as a read
+func allowMutation(ctx context.Context) error {
+	r, ok := ctx.Value(graphqlRequestContextKey).(*http.Request)
+	if !ok {
+		return nil
+	}
+	return AllowWrite(r)
+}
+
+func (graphqlResolver) CreateTodo(ctx context.Context, args struct{ Input todoInput }) (*todoResolver, error) {
+	err := allowMutation(ctx)
+	if err != nil {
+		return nil, graphqlErr(ctx, err)
+	}
+	todo, tags, err := args.Input.todo()
+	if err != nil {
+		return nil, graphqlErr(ctx, err)
+	}
+	todo, err = store.CreateWithTags(ctx, todo, tags)
+	if err != nil {
+		return nil, graphqlErr(ctx, err)
+	}
+	return newTodoResolver(todo), nil
+}
+
+func (graphqlResolver) UpdateTodo(ctx context.Context, args struct {
+	ID    graphql.ID
+	Input todoInput
+}) (*todoResolver, error) {
+	err := allowMutation(ctx)
+	if err != nil {
+		return nil, graphqlErr(ctx, err)
+	}
+	todo, tags, err := args.Input.todo()
+	if err == nil {
+		todo.ID, err = parseID(args.ID)
+	}
+	if err != nil {
+		return nil, graphqlErr(ctx, err)
+	}
+	todo, err = store.UpdateWithTags(ctx, todo, tags)
+	if err != nil {
+		return nil, graphqlErr(ctx, err)
+	}
+	return newTodoResolver(todo), nil
+}
+
+func (graphqlResolver) DeleteTodo(ctx context.Context, args struct{ ID graphql.ID }) (graphql.ID, error) {
+	err := allowMutation(ctx)
+	if err != nil {
+		return "", graphqlErr(ctx, err)
+	}
+	id, err := parseID(args.ID)
+	if err == nil {
+		err = store.Delete(ctx, id)
+	}
+	if err != nil {
+		return "", graphqlErr(ctx, err)
+	}
+	return args.ID, nil
+}
+
+func (graphqlResolver) TodoChanged(ctx context.Context, args struct{ ListID *graphql.ID }) (<-chan *todoEventResolver, error) {
+	var listID *int64
+	if args.ListID != nil {
+		id, err := parseID(*args.ListID)
+		if err == nil {
+			// Make sure the user is allowed to see the list
+			err = ListAccess(ctx, &id, RoleViewer)
+		}
+		if err != nil {
+			return nil, graphqlErr(ctx, err)
+		}
+		listID = &id
+	}
+
+	tenantID, _ := ctx.Value(tenantIDContextKey).(string)
+	sub, _, _ := hub.Subscribe(tenantID, "")
+	events := make(chan *todoEventResolver)
+	go func() {
+		// Closing the channel completes the subscription, which also happens when the hub is closed on shutdown
+		defer close(events)
+		defer hub.Unsubscribe(sub)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-sub.events:
+				if !ok {
+					return
+				}
+				if listID != nil && listKey(event.Todo.ListID) != *listID || !canSeeEvent(ctx, event) {
+					continue
+				}
+				select {
+				case events <- &todoEventResolver{event: event}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// todoBatch loads what the todo items of one result refer to with one query for all of them, instead of one per item
+type todoBatch struct {
+	todos []TodoItem
+
+	tagsOnce sync.Once
+	tags     map[int64][]Tag
+	tagsErr  error
+
+	listsOnce sync.Once
+	lists     map[int64]*listResolver
+	listsErr  error
+}
+
+func newTodoBatch(todos []TodoItem) *todoBatch {
+	return &todoBatch{todos: todos}
+}
+
+// loadTags returns the tags of every item of the batch
+func (b *todoBatch) loadTags(ctx context.Context) (map[int64][]Tag, error) {
+	b.tagsOnce.Do(func() {
+		ids := make([]int64, len(b.todos))
+		for i, todo := range b.todos {
+			ids[i] = todo.ID
+		}
+		b.tags, b.tagsErr = store.TagsOf(ctx, ids)
+	})
+	return b.tags, b.tagsErr
+}
+
+// loadLists returns the lists the items of the batch are in
+func (b *todoBatch) loadLists(ctx context.Context) (map[int64]*listResolver, error) {
+	b.listsOnce.Do(func() {
+		var ids []int64
+		seen := map[int64]bool{}
+		for _, todo := range b.todos {
+			if todo.ListID != nil && !seen[*todo.ListID] {
+				seen[*todo.ListID] = true
+				ids = append(ids, *todo.ListID)
+			}
+		}
+		lists, err := ListsByID(ctx, ids)
+		if err != nil {
+			b.listsErr = err
+			return
+		}
+		b.lists = map[int64]*listResolver{}
+		all := make([]*List, 0, len(lists))
+		for _, list := range lists {
+			all = append(all, list)
+		}
+		for _, resolver := range newListResolvers(all) {
+			b.lists[resolver.list.ID] = resolver
+		}
+	})
+	return b.lists, b.listsErr
+}
+
+// todoResolver resolves the fields of a Todo
+type todoResolver struct {
+	todo  TodoItem
+	batch *todoBatch
+}
+
+// newTodoResolver returns the resolver of a single todo item
+func newTodoResolver(todo TodoItem) *todoResolver {
+	return &todoResolver{todo: todo, batch: newTodoBatch([]TodoItem{todo})}
+}
+
+func (t *todoResolver) ID() graphql.ID {
+	return formatID(t.todo.ID)
+}
+
+func (t *todoResolver) Description() string {
+	return t.todo.Description
+}
+
+func (t *todoResolver) Done() bool {
+	return t.todo.Done
+}
+
+func (t *todoResolver) List(ctx context.Context) (*listResolver, error) {
+	if t.todo.ListID == nil {
+		return nil, nil
+	}
+	lists, err := t.batch.loadLists(ctx)
+	if err != nil {
+		return nil, graphqlErr(ctx, err)
+	}
+	return lists[*t.todo.ListID], nil
+}
+
+func (t *todoResolver) Tags(ctx context.Context) ([]*tagResolver, error) {
+	tags, err := t.batch.loadTags(ctx)
+	if err != nil {
+		return nil, graphqlErr(ctx, err)
+	}
+	return newTagResolvers(tags[t.todo.ID]), nil
+}
+
+// listBatch loads the todo items of several lists with one query for every page asked for, instead of one per list
+type listBatch struct {
+	ids   []int64
+	mu    sync.Mutex
+	pages map[string]*listPage
+}
+
+// listPage is a page of the todo items of every list of a batch
+type listPage struct {
+	once  sync.Once
+	todos map[int64][]TodoItem
+	batch *todoBatch // the items of all lists share a batch too
+	err   error
+}
+
+// load returns the page of todo items of every list of the batch, lists can only be asked for the same page once
+func (b *listBatch) load(ctx context.Context, args todosArgs) (*listPage, error) {
+	filter, after, first, err := args.find()
+	if err != nil {
+		return nil, err
+	}
+	filter.ListIDs = b.ids
+	filter.NoList = false
+
+	key, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	page, ok := b.pages[string(key)]
+	if !ok {
+		page = &listPage{}
+		b.pages[string(key)] = page
+	}
+	b.mu.Unlock()
+
+	page.once.Do(func() {
+		// Get one more item per list than asked for to know if there is another page
+		var todos []TodoItem
+		todos, page.err = store.Find(ctx, filter, after, first+1)
+		page.todos = map[int64][]TodoItem{}
+		for _, todo := range todos {
+			page.todos[*todo.ListID] = append(page.todos[*todo.ListID], todo)
+		}
+		page.batch = newTodoBatch(todos)
+	})
+	return page, page.err
+}
+
+// listResolver resolves the fields of a List
+type listResolver struct {
+	list  *List
+	batch *listBatch
+}
+
+// newListResolvers returns the resolvers of lists that load their todo items together
+func newListResolvers(lists []*List) []*listResolver {
+	batch := &listBatch{pages: map[string]*listPage{}}
+	resolvers := make([]*listResolver, len(lists))
+	for i, list := range lists {
+		batch.ids = append(batch.ids, list.ID)
+		resolvers[i] = &listResolver{list: list, batch: batch}
+	}
+	return resolvers
+}
+
+func (l *listResolver) ID() graphql.ID {
+	return formatID(l.list.ID)
+}
+
+func (l *listResolver) Name() string {
+	return l.list.Name
+}
+
+func (l *listResolver) OwnerID() graphql.ID {
+	return formatID(l.list.OwnerID)
+}
+
+func (l *listResolver) Role() string {
+	return string(l.list.Role)
+}
+
+func (l *listResolver) Todos(ctx context.Context, args todosArgs) (*todoConnection, error) {
+	page, err := l.batch.load(ctx, args)
+	if err != nil {
+		return nil, graphqlErr(ctx, err)
+	}
+	return newTodoConnection(page.todos[l.list.ID], int(args.First), page.batch), nil
+}
+
+// tagResolver resolves the fields of a Tag
+type tagResolver struct {
+	tag Tag
+}
+
+// newTagResolvers returns the resolvers of tags, an empty array instead of null when there are none
+func newTagResolvers(tags []Tag) []*tagResolver {
+	resolvers := make([]*tagResolver, len(tags))
+	for i, tag := range tags {
+		resolvers[i] = &tagResolver{tag: tag}
+	}
+	return resolvers
+}
+
+func (t *tagResolver) ID() graphql.ID {
+	return formatID(t.tag.ID)
+}
+
+func (t *tagResolver) Name() string {
+	return t.tag.Name
+}
+
+// todoConnection resolves the fields of a TodoConnection, a page of todo items
+type todoConnection struct {
+	nodes       []*todoResolver
+	hasNextPage bool
+}
+
+// newTodoConnection returns a page of todo items, there is another page if there are more items than asked for
+func newTodoConnection(todos []TodoItem, first int, batch *todoBatch) *todoConnection {
+	conn := &todoConnection{nodes: []*todoResolver{}}
+	if len(todos) > first {
+		todos = todos[:first]
+		conn.hasNextPage = true
+	}
+	for _, todo := range todos {
+		conn.nodes = append(conn.nodes, &todoResolver{todo: todo, batch: batch})
+	}
+	return conn
+}
+
+func (c *todoConnection) Nodes() []*todoResolver {
+	return c.nodes
+}
+
+func (c *todoConnection) PageInfo() *pageInfoResolver {
+	info := &pageInfoResolver{hasNextPage: c.hasNextPage}
+	if len(c.nodes) > 0 {
+		cursor := base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.nodes[len(c.nodes)-1].todo.ID, 10)))
+		info.endCursor = &cursor
+	}
+	return info
+}
+
+// pageInfoResolver resolves the fields of a PageInfo
+type pageInfoResolver struct {
+	endCursor   *string
+	hasNextPage bool
+}
+
+func (p *pageInfoResolver) EndCursor() *string {
+	return p.endCursor
+}
+
+func (p *pageInfoResolver) HasNextPage() bool {
+	return p.hasNextPage
+}
+
+// todoEventResolver resolves the fields of a TodoEvent
+type todoEventResolver struct {
+	event Event
+}
+
+func (e *todoEventResolver) ID() string {
+	return hub.eventID(e.event)
+}
+
+func (e *todoEventResolver) Type() string {
+	return e.event.Type
+}
+
+func (e *todoEventResolver) Todo() *todoResolver {
+	return newTodoResolver(e.event.Todo)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// graphqlTodo is a todo item as the tests query it
+type graphqlTodo struct {
+	ID   string `json:"id"`
+	Tags []struct {
+		Name string `json:"name"`
+	} `json:"tags"`
+}
+
+// testTodoMutation runs a mutation returning a todo item, with the errors it failed with if any
+func testTodoMutation(t *testing.T, server *httptest.Server, token, mutation string, variables map[string]any) (graphqlTodo, []string) {
+	t.Helper()
+	res, body := testRequest(t, server, token, http.MethodPost, "/graphql", map[string]any{"query": mutation, "variables": variables})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GraphQL request: %d %s", res.StatusCode, body)
+	}
+	var result struct {
+		Data   map[string]*graphqlTodo `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	decodeTestJSON(t, body, &result)
+
+	var todo graphqlTodo
+	for _, data := range result.Data {
+		if data != nil {
+			todo = *data
+		}
+	}
+	var errs []string
+	for _, err := range result.Errors {
+		errs = append(errs, err.Message)
+	}
+	return todo, errs
+}
+
+// tagNames returns the names of the tags of the item in order
+func (todo graphqlTodo) tagNames() []string {
+	names := []string{}
+	for _, tag := range todo.Tags {
+		names = append(names, tag.Name)
+	}
+	return names
+}
+
+const (
+	testCreateTodo = `mutation($tags: [String!]) { createTodo(input: {description: "tagged", tags: $tags}) { id tags { name } } }`
+	testUpdateTodo = `mutation($id: ID!, $tags: [String!]) { updateTodo(id: $id, input: {description: "tagged", tags: $tags}) { id tags { name } } }`
+)
+
+func TestGraphQLTodoTags(t *testing.T) {
+	server, issuer := setupTestServer(t)
+	token := issuer.token(t, issuer.key, "alice", nil)
+
+	todo, errs := testTodoMutation(t, server, token, testCreateTodo, map[string]any{"tags": []string{"work", "home"}})
+	if errs != nil || !slices.Equal(todo.tagNames(), []string{"home", "work"}) {
+		t.Fatalf("created %+v with errors %v", todo, errs)
+	}
+
+	todo, errs = testTodoMutation(t, server, token, testUpdateTodo, map[string]any{"id": todo.ID, "tags": []string{"errand"}})
+	if errs != nil || !slices.Equal(todo.tagNames(), []string{"errand"}) {
+		t.Fatalf("updated %+v with errors %v", todo, errs)
+	}
+
+	// Leaving out the tags keeps the current ones
+	todo, errs = testTodoMutation(t, server, token, testUpdateTodo, map[string]any{"id": todo.ID})
+	if errs != nil || !slices.Equal(todo.tagNames(), []string{"errand"}) {
+		t.Fatalf("updated %+v without tags with errors %v", todo, errs)
+	}
+}
+
+func TestGraphQLTodoTagsAtomic(t *testing.T) {
+	server, issuer := setupTestServer(t)
+	token := issuer.token(t, issuer.key, "alice", nil)
+
+	// Make tagging with "boom" fail halfway through the change
+	_, err := db.Exec(`CREATE TRIGGER boom BEFORE INSERT ON todo_tag
+		WHEN NEW.tag_id = (SELECT id FROM tag WHERE name = 'boom') BEGIN SELECT RAISE(ABORT, 'boom'); END;`)
+	if err != nil {
+		t.Fatalf("error creating trigger: %v", err)
+	}
+
+	// The item isn't created without its tags
+	_, errs := testTodoMutation(t, server, token, testCreateTodo, map[string]any{"tags": []string{"boom"}})
+	if errs == nil {
+		t.Fatal("creating with a failing tag succeeded")
+	}
+	var count int
+	err = db.QueryRow(`SELECT count(*) FROM todo;`).Scan(&count)
+	if err != nil || count != 0 {
+		t.Fatalf("%d todo items exist after the failed create: %v", count, err)
+	}
+
+	// The item isn't changed without its tags
+	todo, errs := testTodoMutation(t, server, token, testCreateTodo, map[string]any{"tags": []string{"kept"}})
+	if errs != nil {
+		t.Fatalf("creating: %v", errs)
+	}
+	_, errs = testTodoMutation(t, server, token,
+		`mutation($id: ID!) { updateTodo(id: $id, input: {description: "changed", done: true, tags: ["boom"]}) { id } }`,
+		map[string]any{"id": todo.ID})
+	if errs == nil {
+		t.Fatal("updating with a failing tag succeeded")
+	}
+	var description string
+	var done bool
+	err = db.QueryRow(`SELECT description, done FROM todo WHERE id = ?;`, todo.ID).Scan(&description, &done)
+	if err != nil || description != "tagged" || done {
+		t.Fatalf("item is %q done %t after the failed update: %v", description, done, err)
+	}
+}
+
+func TestGraphQLTodoDescription(t *testing.T) {
+	server, issuer := setupTestServer(t)
+	token := issuer.token(t, issuer.key, "alice", nil)
+
+	// Items are checked like those sent to the REST API
+	_, errs := testTodoMutation(t, server, token, `mutation { createTodo(input: {description: " "}) { id } }`, map[string]any{})
+	if errs == nil {
+		t.Fatal("creating without a description succeeded")
+	}
+	todo, errs := testTodoMutation(t, server, token, testCreateTodo, map[string]any{})
+	if errs != nil {
+		t.Fatalf("creating: %v", errs)
+	}
+	_, errs = testTodoMutation(t, server, token, `mutation($id: ID!) { updateTodo(id: $id, input: {description: ""}) { id } }`,
+		map[string]any{"id": todo.ID})
+	if errs == nil {
+		t.Fatal("updating without a description succeeded")
+	}
+}
+
+func TestGraphQLSocketSubscriptions(t *testing.T) {
+	server, issuer := setupTestServer(t)
+	token := issuer.token(t, issuer.key, "alice", nil)
+
+	dialer := websocket.Dialer{Subprotocols: []string{graphqlSocketProtocol}}
+	u := "ws" + strings.TrimPrefix(server.URL, "http") + "/graphql?access_token=" + token
+	conn, _, err := dialer.Dial(u, nil)
+	if err != nil {
+		t.Fatalf("error opening WebSocket: %v", err)
+	}
+	defer conn.Close()
+	read := func() graphqlSocketMessage {
+		t.Helper()
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg graphqlSocketMessage
+		err := conn.ReadJSON(&msg)
+		if err != nil {
+			t.Fatalf("error reading WebSocket message: %v", err)
+		}
+		return msg
+	}
+	subscribe := func(id string) {
+		t.Helper()
+		payload, _ := json.Marshal(GraphQLRequest{Query: "subscription { todoChanged { type } }"})
+		err := conn.WriteJSON(graphqlSocketMessage{ID: id, Type: graphqlSubscribe, Payload: payload})
+		if err != nil {
+			t.Fatalf("error subscribing: %v", err)
+		}
+	}
+
+	err = conn.WriteJSON(graphqlSocketMessage{Type: graphqlConnectionInit})
+	if err != nil {
+		t.Fatalf("error initialising connection: %v", err)
+	}
+	if msg := read(); msg.Type != graphqlConnectionAck {
+		t.Fatalf("initialising replied %+v", msg)
+	}
+
+	// Subscriptions over the limit are refused and the connection stays open
+	for i := range graphqlMaxSubscriptions {
+		subscribe(strconv.Itoa(i))
+	}
+	subscribe("over")
+	if msg := read(); msg.ID != "over" || msg.Type != graphqlErrorMessage {
+		t.Fatalf("subscribing over the limit replied %+v", msg)
+	}
+
+	// Completing one makes room for another
+	err = conn.WriteJSON(graphqlSocketMessage{ID: "0", Type: graphqlComplete})
+	if err != nil {
+		t.Fatalf("error completing subscription: %v", err)
+	}
+	subscribe("again")
+	res, body := testRequest(t, server, token, http.MethodPost, "/todo", map[string]any{"description": "milk"})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("creating todo item: %d %s", res.StatusCode, body)
+	}
+	seen := map[string]bool{}
+	for range graphqlMaxSubscriptions {
+		msg := read()
+		if msg.Type != graphqlNext {
+			t.Fatalf("creating sent %+v", msg)
+		}
+		seen[msg.ID] = true
+	}
+	if !seen["again"] || seen["0"] {
+		t.Fatalf("subscriptions that got the change are %v", seen)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Subprotocol of GraphQL over WebSocket, see https://github.com/enisdenjo/graphql-ws/blob/master/PROTOCOL.md
+const graphqlSocketProtocol = "graphql-transport-ws"
+
+// Time a client has after connecting to send connection_init
+const graphqlInitWait = 10 * time.Second
+
+// Most operations a connection can run at once, each of them follows the change feed
+const graphqlMaxSubscriptions = 20
+
+// Kinds of messages of the graphql-transport-ws protocol
+const (
+	graphqlConnectionInit = "connection_init"
+	graphqlConnectionAck  = "connection_ack"
+	graphqlPing           = "ping"
+	graphqlPong           = "pong"
+	graphqlSubscribe      = "subscribe"
+	graphqlNext           = "next"
+	graphqlErrorMessage   = "error"
+	graphqlComplete       = "complete"
+)
+
+// Close codes of the graphql-transport-ws protocol
+const (
+	graphqlCloseBadRequest   = 4400
+	graphqlCloseUnauthorized = 4401
+	graphqlCloseInitTimeout  = 4408
+	graphqlCloseDuplicateID  = 4409
+	graphqlCloseTooManyInits = 4429
+)
+
+// graphqlSocketMessage is a message of the graphql-transport-ws protocol sent either way
+type graphqlSocketMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Upgrades requests to GraphQL WebSocket connections, from the same origins as the WebSocket API
+var graphqlUpgrader = websocket.Upgrader{
+	CheckOrigin:  upgrader.CheckOrigin,
+	Subprotocols: []string{graphqlSocketProtocol},
+}
+
+// graphqlSocket is the state of one GraphQL WebSocket connection
+type graphqlSocket struct {
+	ctx           context.Context // context of the upgraded request, cancelled when the connection closes
+	conn          *websocket.Conn
+	writeMu       sync.Mutex // subscriptions send from their own goroutines
+	mu            sync.Mutex
+	acknowledged  bool
+	subscriptions map[string]context.CancelFunc // running operations by their ID
+}
+
+// HTTP handler for GraphQL operations over a WebSocket, mostly subscriptions, speaking the graphql-transport-ws protocol
+func GraphQLSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := graphqlUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already responded with an error
+		slog.DebugContext(r.Context(), "error upgrading to WebSocket", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	// Operations stop when the connection closes
+	ctx, cancel := context.WithCancel(context.WithValue(r.Context(), graphqlRequestContextKey, r))
+	defer cancel()
+	s := &graphqlSocket{ctx: ctx, conn: conn, subscriptions: map[string]context.CancelFunc{}}
+
+	if conn.Subprotocol() != graphqlSocketProtocol {
+		s.close(websocket.CloseProtocolError, "Subprotocol "+graphqlSocketProtocol+" is needed")
+		return
+	}
+
+	// Messages can be as large as request bodies and the client has to initialise the connection in time
+	if maxBodyBytes > 0 {
+		conn.SetReadLimit(maxBodyBytes)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(graphqlInitWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	})
+
+	// Ping the client so connections that went away get noticed
+	go func() {
+		ping := time.NewTicker(socketPingPeriod)
+		defer ping.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ping.C:
+				s.writeMu.Lock()
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(socketWriteWait))
+				s.writeMu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && !s.isAcknowledged() {
+			s.close(graphqlCloseInitTimeout, "Connection initialisation timeout")
+			return
+		}
+		if err != nil {
+			// The client disconnected or stopped answering pings
+			slog.DebugContext(r.Context(), "GraphQL WebSocket client went away", "error", err)
+			return
+		}
+		if !s.handle(data) {
+			return
+		}
+	}
+}
+
+// handle acts on a message of the client and reports whether the connection stays open
+func (s *graphqlSocket) handle(data []byte) bool {
+	var msg graphqlSocketMessage
+	err := json.Unmarshal(data, &msg)
+	if err != nil {
+		return s.close(graphqlCloseBadRequest, "Invalid message")
+	}
+
+	switch msg.Type {
+	case graphqlConnectionInit:
+		s.mu.Lock()
+		again := s.acknowledged
+		s.acknowledged = true
+		s.mu.Unlock()
+		if again {
+			return s.close(graphqlCloseTooManyInits, "Too many initialisation requests")
+		}
+		// From now on the client only has to answer pings to stay connected
+		_ = s.conn.SetReadDeadline(time.Now().Add(socketPongWait))
+		return s.send(graphqlSocketMessage{Type: graphqlConnectionAck}) == nil
+	case graphqlPing:
+		return s.send(graphqlSocketMessage{Type: graphqlPong}) == nil
+	case graphqlPong:
+		return true
+	case graphqlSubscribe:
+		if !s.isAcknowledged() {
+			return s.close(graphqlCloseUnauthorized, "Unauthorized")
+		}
+		var req GraphQLRequest
+		err = json.Unmarshal(msg.Payload, &req)
+		if err != nil || msg.ID == "" || req.Query == "" {
+			return s.close(graphqlCloseBadRequest, "Invalid subscribe message")
+		}
+
+		s.mu.Lock()
+		_, exists := s.subscriptions[msg.ID]
+		running := len(s.subscriptions)
+		s.mu.Unlock()
+		if exists {
+			return s.close(graphqlCloseDuplicateID, "Subscriber for "+msg.ID+" already exists")
+		}
+		if running >= graphqlMaxSubscriptions {
+			payload, _ := json.Marshal([]map[string]string{{"message": "Too many subscriptions, at most " +
+				strconv.Itoa(graphqlMaxSubscriptions) + " can run at once"}})
+			return s.send(graphqlSocketMessage{ID: msg.ID, Type: graphqlErrorMessage, Payload: payload}) == nil
+		}
+		// Only this goroutine adds operations so the ID is still free
+		ctx, cancel := context.WithCancel(s.ctx)
+		s.mu.Lock()
+		s.subscriptions[msg.ID] = cancel
+		s.mu.Unlock()
+
+		responses, err := graphqlSchema.Subscribe(ctx, req.Query, req.OperationName, req.Variables)
+		if err != nil {
+			s.finish(msg.ID)
+			payload, _ := json.Marshal([]map[string]string{{"message": err.Error()}})
+			return s.send(graphqlSocketMessage{ID: msg.ID, Type: graphqlErrorMessage, Payload: payload}) == nil
+		}
+		go s.forward(msg.ID, responses)
+		return true
+	case graphqlComplete:
+		// The client isn't interested anymore so it isn't told about the end either
+		s.finish(msg.ID)
+		return true
+	default:
+		return s.close(graphqlCloseBadRequest, "Unknown message type "+strconv.Quote(msg.Type))
+	}
+}
+
+// forward sends the results of an operation to the client until it's complete
+func (s *graphqlSocket) forward(id string, responses <-chan any) {
+	for response := range responses {
+		payload, err := json.Marshal(response)
+		if err != nil {
+			// Log encoding error for debugging
+			slog.ErrorContext(s.ctx, "error encoding GraphQL response", "error", err)
+			continue
+		}
+		err = s.send(graphqlSocketMessage{ID: id, Type: graphqlNext, Payload: payload})
+		if err != nil {
+			return
+		}
+	}
+	// Tell the client the operation is over, unless it completed it itself
+	if s.finish(id) {
+		_ = s.send(graphqlSocketMessage{ID: id, Type: graphqlComplete})
+	}
+}
+
+// finish stops an operation and reports whether it was still running
+func (s *graphqlSocket) finish(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cancel, ok := s.subscriptions[id]
+	if ok {
+		cancel()
+		delete(s.subscriptions, id)
+	}
+	return ok
+}
+
+// isAcknowledged reports whether the client initialised the connection
+func (s *graphqlSocket) isAcknowledged() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acknowledged
+}
+
+// send writes a message to the client
+func (s *graphqlSocket) send(msg graphqlSocketMessage) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	err := s.conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+	if err != nil {
+		return err
+	}
+	return s.conn.WriteJSON(msg)
+}
+
+// close ends the connection with a close code and reason, it always reports that the connection is closed
+func (s *graphqlSocket) close(code int, reason string) bool {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_ = s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(socketWriteWait))
+	return false
+}
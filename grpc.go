@@ -0,0 +1,395 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative todopb/todo.proto
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/insanitywholesale/go-todo/todopb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// Calls that change todo items, the others are limited like GET requests
+var grpcWrites = map[string]bool{
+	todopb.TodoService_Create_FullMethodName: true,
+	todopb.TodoService_Update_FullMethodName: true,
+	todopb.TodoService_Delete_FullMethodName: true,
+}
+
+// todoServer implements the gRPC TodoService on top of the todo item store
+type todoServer struct {
+	todopb.UnimplementedTodoServiceServer
+}
+
+// SetupGRPC creates the gRPC server, which uses the same certificate as the HTTP server when TLS is configured
+func SetupGRPC(tlsConfig *tls.Config) *grpc.Server {
+	options := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(grpcUnary),
+		grpc.ChainStreamInterceptor(grpcStream),
+	}
+	// Messages can be as large as request bodies
+	if maxBodyBytes > 0 {
+		options = append(options, grpc.MaxRecvMsgSize(int(maxBodyBytes)))
+	}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	server := grpc.NewServer(options...)
+	todopb.RegisterTodoServiceServer(server, todoServer{})
+	// Let tools like grpcurl find out about the service
+	reflection.Register(server)
+	return server
+}
+
+// StopGRPC waits for calls in flight to finish, cancelling the ones still running once ctx is done
+func StopGRPC(ctx context.Context, server *grpc.Server) {
+	done := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		server.Stop()
+	}
+}
+
+// grpcUnary prepares the context of a call like the middleware of the REST API does and logs it once it's handled
+func grpcUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	var resp any
+	ctx, err := grpcCall(ctx, info.FullMethod, func(ctx context.Context) error {
+		// Queries of a call get as long as those of a request, unless the client wants an answer sooner
+		if requestTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, requestTimeout)
+			defer cancel()
+		}
+		var err error
+		resp, err = handler(ctx, req)
+		return err
+	})
+	logGRPC(ctx, info.FullMethod, start, err)
+	return resp, err
+}
+
+// grpcStream prepares the context of a streaming call, which stays open for as long as the client wants
+func grpcStream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx, err := grpcCall(stream.Context(), info.FullMethod, func(ctx context.Context) error {
+		return handler(srv, &contextStream{ServerStream: stream, ctx: ctx})
+	})
+	logGRPC(ctx, info.FullMethod, start, err)
+	return err
+}
+
+// contextStream is a server stream with the context prepared for its call
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the prepared context
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// grpcCall runs the middleware of the REST API on a request made from the metadata of a call, so addresses,
+// tenants, tokens and rate limits are checked the same way, and handles the call within it so the tenant database stays
+// open until it's done. It returns the context the call got with its error, or the error the middleware
+// responded with.
+func grpcCall(ctx context.Context, fullMethod string, call func(ctx context.Context) error) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	// Keep the ID of the caller so the call can be followed across services, and tell it the ID
+	requestID := ""
+	if ids := md.Get("x-request-id"); len(ids) > 0 && validRequestID(ids[0]) {
+		requestID = ids[0]
+	} else {
+		requestID = newRequestID()
+	}
+	ctx = context.WithValue(ctx, requestIDContextKey, requestID)
+	_ = grpc.SetHeader(ctx, metadata.Pairs("x-request-id", requestID))
+
+	// Metadata keys are lowercase header names, the host is in the :authority pseudo-header
+	method := http.MethodGet
+	if grpcWrites[fullMethod] {
+		method = http.MethodPost
+	}
+	r, err := http.NewRequestWithContext(ctx, method, fullMethod, nil)
+	if err != nil {
+		return ctx, status.Error(codes.Internal, err.Error())
+	}
+	for key, values := range md {
+		for _, value := range values {
+			r.Header.Add(key, value)
+		}
+	}
+	if authority := md.Get(":authority"); len(authority) > 0 {
+		r.Host = authority[0]
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+
+	var handled context.Context
+	var callErr error
+	recorder := &grpcResponse{header: http.Header{}}
+	LimitIP(VerifyToken(ResolveTenant(RequireAuth(RateLimit(func(w http.ResponseWriter, r *http.Request) {
+		handled = r.Context()
+		callErr = call(handled)
+	})))))(recorder, r)
+	if handled != nil {
+		return handled, callErr
+	}
+
+	// Turn the error response of the middleware back into an error
+	httpErr := &HTTPError{Status: recorder.status}
+	_ = json.Unmarshal(recorder.body, httpErr)
+	return ctx, grpcError(ctx, httpErr)
+}
+
+// grpcResponse keeps the response of the middleware run for a gRPC call
+type grpcResponse struct {
+	header http.Header
+	status int
+	body   []byte
+}
+
+// Header returns the headers of the response
+func (g *grpcResponse) Header() http.Header {
+	return g.header
+}
+
+// Write keeps the body of the response
+func (g *grpcResponse) Write(b []byte) (int, error) {
+	g.body = append(g.body, b...)
+	return len(b), nil
+}
+
+// WriteHeader keeps the status of the response
+func (g *grpcResponse) WriteHeader(status int) {
+	g.status = status
+}
+
+// grpcError returns the gRPC status matching an error of handling a call, using the status the REST API would
+// respond with
+func grpcError(ctx context.Context, err error) error {
+	// The deadline of the call has a code of its own
+	if errors.Is(err, context.DeadlineExceeded) {
+		return status.Error(codes.DeadlineExceeded, "Call took too long to handle")
+	}
+
+	httpErr := ErrorResponse(ctx, err)
+	var code codes.Code
+	switch httpErr.Status {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+		// Running out of quota is not about who is asking
+		if httpErr.Detail == "Quota Exceeded" {
+			code = codes.ResourceExhausted
+		}
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusRequestTimeout:
+		code = codes.DeadlineExceeded
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case StatusClientClosedRequest:
+		code = codes.Canceled
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	default:
+		code = codes.Internal
+	}
+
+	// Server errors are our problem so keep a record of them
+	if httpErr.Status >= http.StatusInternalServerError && code != codes.Unavailable {
+		slog.ErrorContext(ctx, "error handling call", "error", httpErr.Error(), "code", code.String())
+	}
+	return status.Error(code, httpErr.Message)
+}
+
+// logGRPC logs a line for every call once it's handled
+func logGRPC(ctx context.Context, fullMethod string, start time.Time, err error) {
+	clientIP := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		clientIP = p.Addr.String()
+		if host, _, err := net.SplitHostPort(clientIP); err == nil {
+			clientIP = host
+		}
+	}
+	slog.InfoContext(ctx, "call",
+		"method", fullMethod,
+		"code", status.Code(err).String(),
+		"latency", time.Since(start),
+		"client_ip", clientIP,
+	)
+}
+
+// todoToProto converts a todo item to its gRPC message
+func todoToProto(todo TodoItem) *todopb.TodoItem {
+	return &todopb.TodoItem{
+		Id:          todo.ID,
+		Description: todo.Description,
+		Done:        todo.Done,
+		ListId:      todo.ListID,
+	}
+}
+
+// todoFromProto converts a gRPC message to a todo item, a missing one is an empty item
+func todoFromProto(todo *todopb.TodoItem) TodoItem {
+	return TodoItem{
+		ID:          todo.GetId(),
+		Description: todo.GetDescription(),
+		Done:        todo.GetDone(),
+		ListID:      todo.ListId,
+	}
+}
+
+// List returns a page of the todo items without a list and those in lists the user has access to
+func (todoServer) List(ctx context.Context, req *todopb.ListRequest) (*todopb.ListResponse, error) {
+	// Pages are as large as those of the REST API at most
+	pageSize := int(req.GetPageSize())
+	if pageSize == 0 {
+		pageSize = maxTodoPage
+	}
+	if pageSize < 1 || pageSize > maxTodoPage {
+		return nil, status.Error(codes.InvalidArgument, "page_size has to be between 1 and "+strconv.Itoa(maxTodoPage))
+	}
+
+	// The token is the ID of the last item of the previous page
+	var after int64
+	if token := req.GetPageToken(); token != "" {
+		cursor, err := base64.RawURLEncoding.DecodeString(token)
+		if err == nil {
+			after, err = strconv.ParseInt(string(cursor), 10, 64)
+		}
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "Invalid page_token")
+		}
+	}
+
+	// Get one more item than asked for to know if there is another page
+	todos, err := store.Find(ctx, TodoFilter{}, after, pageSize+1)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	resp := &todopb.ListResponse{}
+	if len(todos) > pageSize {
+		todos = todos[:pageSize]
+		resp.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(todos[pageSize-1].ID, 10)))
+	}
+	resp.Todos = make([]*todopb.TodoItem, 0, len(todos))
+	for _, todo := range todos {
+		resp.Todos = append(resp.Todos, todoToProto(todo))
+	}
+	return resp, nil
+}
+
+// Get returns a todo item by ID
+func (todoServer) Get(ctx context.Context, req *todopb.GetRequest) (*todopb.TodoItem, error) {
+	todo, err := store.Get(ctx, req.GetId())
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return todoToProto(todo), nil
+}
+
+// Create adds a todo item and returns it with its ID
+func (todoServer) Create(ctx context.Context, req *todopb.CreateRequest) (*todopb.TodoItem, error) {
+	if req.GetTodo() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Missing todo item")
+	}
+	todo, err := store.Create(ctx, todoFromProto(req.GetTodo()))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return todoToProto(todo), nil
+}
+
+// Update replaces a todo item, keeping it in its current list unless a list is given
+func (todoServer) Update(ctx context.Context, req *todopb.UpdateRequest) (*todopb.TodoItem, error) {
+	if req.GetTodo() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Missing todo item")
+	}
+	todo, err := store.Update(ctx, todoFromProto(req.GetTodo()))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return todoToProto(todo), nil
+}
+
+// Delete removes a todo item by ID
+func (todoServer) Delete(ctx context.Context, req *todopb.DeleteRequest) (*todopb.DeleteResponse, error) {
+	err := store.Delete(ctx, req.GetId())
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &todopb.DeleteResponse{}, nil
+}
+
+// Kinds of changes as gRPC event types
+var grpcEventTypes = map[string]todopb.Event_Type{
+	EventCreated: todopb.Event_TYPE_CREATED,
+	EventUpdated: todopb.Event_TYPE_UPDATED,
+	EventDeleted: todopb.Event_TYPE_DELETED,
+}
+
+// Watch streams changes to todo items the user can see, replaying the ones missed since the last event ID
+func (todoServer) Watch(req *todopb.WatchRequest, stream grpc.ServerStreamingServer[todopb.Event]) error {
+	ctx := stream.Context()
+
+	// Start following changes before sending anything so none are missed
+	tenantID, _ := ctx.Value(tenantIDContextKey).(string)
+	sub, replay, complete := hub.Subscribe(tenantID, req.GetLastEventId())
+	defer hub.Unsubscribe(sub)
+
+	// Changes were missed so the client has to fetch all todo items again
+	var err error
+	if !complete {
+		err = stream.Send(&todopb.Event{Type: todopb.Event_TYPE_RESET})
+	}
+	for _, event := range replay {
+		if err == nil && canSeeEvent(ctx, event) {
+			err = stream.Send(&todopb.Event{Id: hub.eventID(event), Type: grpcEventTypes[event.Type], Todo: todoToProto(event.Todo)})
+		}
+	}
+
+	for err == nil {
+		select {
+		case <-ctx.Done(): // The client went away
+			return grpcError(ctx, ctx.Err())
+		case event, ok := <-sub.events:
+			if !ok {
+				// The client fell behind or the server is shutting down, it calls again with the last event ID
+				return status.Error(codes.Unavailable, "Change feed closed, watch again from the last event")
+			}
+			if canSeeEvent(ctx, event) {
+				err = stream.Send(&todopb.Event{Id: hub.eventID(event), Type: grpcEventTypes[event.Type], Todo: todoToProto(event.Todo)})
+			}
+		}
+	}
+	return err
+}
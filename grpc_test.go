@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/insanitywholesale/go-todo/todopb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// setupTestGRPC serves the gRPC API in memory until the test ends and returns a client of it
+func setupTestGRPC(t *testing.T) todopb.TodoServiceClient {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := SetupGRPC(nil)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("error connecting to gRPC server: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return todopb.NewTodoServiceClient(conn)
+}
+
+// grpcContext returns a context whose calls send the token
+func grpcContext(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func TestGRPC(t *testing.T) {
+	server, issuer := setupTestServer(t)
+	grpcClient := setupTestGRPC(t)
+	owner := issuer.token(t, issuer.key, "owner", nil)
+	other := issuer.token(t, issuer.key, "other", nil)
+	ctx := grpcContext(owner)
+
+	// Calls without a token are refused
+	_, err := grpcClient.List(context.Background(), &todopb.ListRequest{})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("listing without a token: got %v, want Unauthenticated", err)
+	}
+	_, err = grpcClient.List(grpcContext("not-a-token"), &todopb.ListRequest{})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("listing with a bad token: got %v, want Unauthenticated", err)
+	}
+
+	created, err := grpcClient.Create(ctx, &todopb.CreateRequest{Todo: &todopb.TodoItem{Description: "buy milk"}})
+	if err != nil || created.GetId() == 0 || created.GetDescription() != "buy milk" {
+		t.Fatalf("created %v: %v", created, err)
+	}
+	got, err := grpcClient.Get(ctx, &todopb.GetRequest{Id: created.GetId()})
+	if err != nil || got.GetDescription() != "buy milk" {
+		t.Fatalf("got %v: %v", got, err)
+	}
+
+	// Errors of the store get the matching codes
+	res, body := testRequest(t, server, owner, http.MethodPost, "/list", map[string]any{"name": "groceries"})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("creating list: %d %s", res.StatusCode, body)
+	}
+	listID := int64(1)
+	shared, err := grpcClient.Create(ctx, &todopb.CreateRequest{Todo: &todopb.TodoItem{Description: "eggs", ListId: &listID}})
+	if err != nil {
+		t.Fatalf("error creating todo item in list: %v", err)
+	}
+	_, body = testRequest(t, server, other, http.MethodGet, "/me", nil)
+	var otherUser User
+	decodeTestJSON(t, body, &otherUser)
+	res, body = testRequest(t, server, owner, http.MethodPut, "/list/1/shares/"+strconv.FormatInt(otherUser.ID, 10), map[string]any{"role": "viewer"})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("sharing list: %d %s", res.StatusCode, body)
+	}
+	tests := []struct {
+		name string
+		call func() error
+		code codes.Code
+	}{
+		{"get missing item", func() error {
+			_, err := grpcClient.Get(ctx, &todopb.GetRequest{Id: 100})
+			return err
+		}, codes.NotFound},
+		{"create without a description", func() error {
+			_, err := grpcClient.Create(ctx, &todopb.CreateRequest{Todo: &todopb.TodoItem{Description: " "}})
+			return err
+		}, codes.InvalidArgument},
+		{"create without an item", func() error {
+			_, err := grpcClient.Create(ctx, &todopb.CreateRequest{})
+			return err
+		}, codes.InvalidArgument},
+		{"update as a viewer", func() error {
+			_, err := grpcClient.Update(grpcContext(other), &todopb.UpdateRequest{Todo: &todopb.TodoItem{Id: shared.GetId(), Description: "oat milk"}})
+			return err
+		}, codes.PermissionDenied},
+		{"delete as a viewer", func() error {
+			_, err := grpcClient.Delete(grpcContext(other), &todopb.DeleteRequest{Id: shared.GetId()})
+			return err
+		}, codes.PermissionDenied},
+		{"list a page that is too large", func() error {
+			_, err := grpcClient.List(ctx, &todopb.ListRequest{PageSize: maxTodoPage + 1})
+			return err
+		}, codes.InvalidArgument},
+		{"list with a bad token", func() error {
+			_, err := grpcClient.List(ctx, &todopb.ListRequest{PageToken: "!"})
+			return err
+		}, codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		if err := test.call(); status.Code(err) != test.code {
+			t.Errorf("%s: got %v, want %s", test.name, err, test.code)
+		}
+	}
+
+	// List pages through the items
+	_, err = grpcClient.Create(ctx, &todopb.CreateRequest{Todo: &todopb.TodoItem{Description: "bread"}})
+	if err != nil {
+		t.Fatalf("error creating todo item: %v", err)
+	}
+	var ids []int64
+	req := &todopb.ListRequest{PageSize: 2}
+	for pages := 1; ; pages++ {
+		page, err := grpcClient.List(ctx, req)
+		if err != nil {
+			t.Fatalf("error listing todo items: %v", err)
+		}
+		for _, todo := range page.GetTodos() {
+			ids = append(ids, todo.GetId())
+		}
+		if page.GetNextPageToken() == "" {
+			if pages != 2 {
+				t.Errorf("listed %d pages, want 2", pages)
+			}
+			break
+		}
+		req.PageToken = page.GetNextPageToken()
+	}
+	if len(ids) != 3 {
+		t.Errorf("listed items %v, want 3 of them", ids)
+	}
+}
+
+func TestGRPCWatch(t *testing.T) {
+	_, issuer := setupTestServer(t)
+	grpcClient := setupTestGRPC(t)
+	ctx, cancel := context.WithTimeout(grpcContext(issuer.token(t, issuer.key, "alice", nil)), 5*time.Second)
+	defer cancel()
+
+	created, err := grpcClient.Create(ctx, &todopb.CreateRequest{Todo: &todopb.TodoItem{Description: "before"}})
+	if err != nil {
+		t.Fatalf("error creating todo item: %v", err)
+	}
+
+	// Watching from an unknown event starts with a reset, then replays nothing and follows new changes
+	stream, err := grpcClient.Watch(ctx, &todopb.WatchRequest{LastEventId: "other-1"})
+	if err != nil {
+		t.Fatalf("error watching: %v", err)
+	}
+	event, err := stream.Recv()
+	if err != nil || event.GetType() != todopb.Event_TYPE_RESET {
+		t.Fatalf("watching from an unknown event got %v, want a reset: %v", event, err)
+	}
+	_, err = grpcClient.Delete(ctx, &todopb.DeleteRequest{Id: created.GetId()})
+	if err != nil {
+		t.Fatalf("error deleting todo item: %v", err)
+	}
+	event, err = stream.Recv()
+	if err != nil || event.GetType() != todopb.Event_TYPE_DELETED || event.GetTodo().GetId() != created.GetId() || event.GetId() == "" {
+		t.Fatalf("deleting sent %v: %v", event, err)
+	}
+
+	// Watching from an event replays the changes after it
+	stream, err = grpcClient.Watch(ctx, &todopb.WatchRequest{LastEventId: hub.epoch + "-1"})
+	if err != nil {
+		t.Fatalf("error watching: %v", err)
+	}
+	event, err = stream.Recv()
+	if err != nil || event.GetId() != hub.epoch+"-2" || event.GetType() != todopb.Event_TYPE_DELETED {
+		t.Fatalf("resuming got %v, want the delete: %v", event, err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Check is the result of one of the checks done by the readiness endpoint
+type Check struct {
+	Status string `json:"status"`           // "ok" or "fail"
+	Detail any    `json:"detail,omitempty"` // what was found
+}
+
+// Health is the response of the health endpoints
+type Health struct {
+	Status string           `json:"status"` // "ok" only if every check is ok
+	Checks map[string]Check `json:"checks,omitempty"`
+}
+
+// Set once the server starts shutting down so that load balancers stop sending traffic
+var shuttingDown atomic.Bool
+
+// HTTP handler for checking that the process is alive
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	// Tell the client that we are going to return JSON
+	w.Header().Add("Content-Type", "application/json")
+	// Tell the client that the status of the request is 200
+	w.WriteHeader(http.StatusOK)
+	// Return the JSON-encoded health
+	err := json.NewEncoder(w).Encode(Health{Status: "ok"})
+	if err != nil {
+		// Log encoding error for debugging
+		slog.ErrorContext(r.Context(), "error encoding health", "error", err)
+	}
+}
+
+// HTTP handler for checking that the server can handle requests
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	// Don't let a hanging database make the probe hang as well
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	health := Health{Status: "ok", Checks: map[string]Check{}}
+
+	// Make sure the database can be reached
+	err := db.PingContext(ctx)
+	if err != nil {
+		health.Checks["database"] = Check{Status: "fail", Detail: err.Error()}
+	} else {
+		health.Checks["database"] = Check{Status: "ok"}
+	}
+
+	// Make sure every migration has been applied
+	version, err := SchemaVersion(ctx, db)
+	switch {
+	case err != nil:
+		health.Checks["migrations"] = Check{Status: "fail", Detail: err.Error()}
+	case version != len(migrations):
+		health.Checks["migrations"] = Check{Status: "fail", Detail: "schema version " + strconv.Itoa(version) + " but expected " + strconv.Itoa(len(migrations))}
+	default:
+		health.Checks["migrations"] = Check{Status: "ok", Detail: "schema version " + strconv.Itoa(version)}
+	}
+
+	// Make sure no background worker failed
+	status := workers.Status()
+	health.Checks["workers"] = Check{Status: "ok", Detail: status}
+	for _, s := range status {
+		if strings.HasPrefix(s, "failed") {
+			health.Checks["workers"] = Check{Status: "fail", Detail: status}
+		}
+	}
+
+	// Stop getting new traffic while in-flight requests are drained
+	if shuttingDown.Load() {
+		health.Checks["shutdown"] = Check{Status: "fail", Detail: "server is shutting down"}
+	}
+
+	// A single failed check makes the server not ready
+	code := http.StatusOK
+	for _, check := range health.Checks {
+		if check.Status != "ok" {
+			health.Status = "fail"
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	// Tell the client that we are going to return JSON
+	w.Header().Add("Content-Type", "application/json")
+	// Tell the client that the status of the request is 200 or 503
+	w.WriteHeader(code)
+	// Return the JSON-encoded health
+	err = json.NewEncoder(w).Encode(health)
+	if err != nil {
+		// Log encoding error for debugging
+		slog.ErrorContext(r.Context(), "error encoding health", "error", err)
+	}
+}
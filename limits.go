@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Limits of a single request and its database queries, 0 means unlimited
+var (
+	maxBodyBytes   int64
+	requestTimeout time.Duration
+	queryTimeout   time.Duration
+)
+
+// Limits wraps the router so that request bodies can only be so large and database queries only take so long
+func Limits(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Reading past the limit fails with an *http.MaxBytesError and closes the connection
+		if maxBodyBytes > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+		}
+
+		// Handlers pass the context on to their queries, which stop once the deadline is reached.
+		// Streams stay open for as long as the client wants so they don't get a deadline, the route
+		// is looked up without running it since the router hasn't matched the request yet.
+		_, pattern := mux.Handler(r)
+		if requestTimeout > 0 && !streamRoutes[pattern] {
+			ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Status code nginx uses for requests the client gave up on, there is no standard one
+const StatusClientClosedRequest = 499
+
+// Routes whose response is streamed for as long as the client stays connected
+var streamRoutes = map[string]bool{
+	"GET /todos/events": true, // change feed
+	"GET /ws":           true, // WebSocket of todo items
+	"GET /graphql":      true, // GraphQL subscriptions over a WebSocket
+}
+
+// ErrorResponse returns the HTTPError matching an error of handling a request, a generic 500 unless a limit was hit
+// or the request was cancelled. APIs other than REST use it to map errors to their own status codes.
+func ErrorResponse(ctx context.Context, err error) *HTTPError {
+	var httpErr *HTTPError
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &httpErr):
+		// Errors meant for the client already have their status
+		return httpErr
+	case errors.As(err, &maxBytesErr):
+		return &HTTPError{Message: "Request body is larger than " + strconv.FormatInt(maxBytesErr.Limit, 10) + " bytes", Status: http.StatusRequestEntityTooLarge, Detail: "Request Entity Too Large"}
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		// The read timeout of the server passed while the body was being received
+		return &HTTPError{Message: "Request body wasn't received in time", Status: http.StatusRequestTimeout, Detail: "Request Timeout"}
+	case errors.Is(err, context.Canceled) || errors.Is(ctx.Err(), context.Canceled):
+		// The client disconnected so nobody reads this, but it keeps the logs and metrics apart from real failures
+		return &HTTPError{Message: "Client closed the request", Status: StatusClientClosedRequest, Detail: "Client Closed Request"}
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded):
+		// Either the query or the whole request ran out of time, the database is probably overloaded
+		return &HTTPError{Message: "Request took too long to handle, try again later", Status: http.StatusServiceUnavailable, Detail: "Service Unavailable"}
+	default:
+		return &HTTPError{Message: err.Error(), Status: http.StatusInternalServerError, Detail: "General Error"}
+	}
+}
+
+// WriteError responds with the HTTPError matching an error of handling a request
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	httpErr := ErrorResponse(r.Context(), err)
+	if httpErr.Status == http.StatusRequestTimeout {
+		// The rest of the body is still on its way so the connection can't be reused
+		w.Header().Set("Connection", "close")
+	}
+	WriteHTTPError(w, r, httpErr.Message, httpErr.Status, httpErr.Detail)
+}
+
+// WriteBodyError responds to an error decoding the JSON body of a request, a 400 unless a limit was hit
+func WriteBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) || errors.Is(err, os.ErrDeadlineExceeded) {
+		WriteError(w, r, err)
+		return
+	}
+	WriteHTTPError(w, r, err.Error(), http.StatusBadRequest, "Bad Request")
+}
+
+// WithQueryTimeout limits a single database query to the query timeout, cancel has to be called once its rows are read
+func WithQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if queryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, queryTimeout)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitsStreamRoutes(t *testing.T) {
+	previous := requestTimeout
+	requestTimeout = time.Minute
+	t.Cleanup(func() { requestTimeout = previous })
+
+	mux := http.NewServeMux()
+	deadline := func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Deadline(); ok {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+	mux.HandleFunc("GET /todos", deadline)
+	mux.HandleFunc("GET /todos/events", deadline)
+	handler := Limits(mux, mux)
+
+	// Whether a request gets a deadline depends on its route, not on what it asks for
+	tests := []struct {
+		path     string
+		accept   string
+		deadline bool
+	}{
+		{"/todos", "application/json", true},
+		{"/todos", "text/event-stream", true},
+		{"/todos/events", "text/event-stream", false},
+		{"/todos/events", "", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.path, nil)
+		r.Header.Set("Accept", test.accept)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if got := w.Code == http.StatusOK; got != test.deadline {
+			t.Errorf("%s with Accept %q: got deadline %t, want %t", test.path, test.accept, got, test.deadline)
+		}
+	}
+}
+
+func TestLimitsBody(t *testing.T) {
+	previous := maxBodyBytes
+	maxBodyBytes = 64
+	t.Cleanup(func() { maxBodyBytes = previous })
+	setupTestDB(t)
+	issuer := setupTestAuth(t, true)
+	server := httptest.NewUnstartedServer(SetupRouter())
+	server.Config.ReadTimeout = 200 * time.Millisecond
+	server.Start()
+	t.Cleanup(server.Close)
+	token := issuer.token(t, issuer.key, "alice", nil)
+
+	// Bodies over the limit are refused
+	res, body := testRequest(t, server, token, http.MethodPost, "/todo", map[string]any{"description": strings.Repeat("a", 100)})
+	var httpErr HTTPError
+	decodeTestJSON(t, body, &httpErr)
+	if res.StatusCode != http.StatusRequestEntityTooLarge || httpErr.Status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("sending a large body: got status %d, want 413: %s", res.StatusCode, body)
+	}
+
+	// Bodies that don't arrive before the read timeout are refused and the connection isn't kept
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "POST /todo HTTP/1.1\r\nHost: %s\r\nAuthorization: Bearer %s\r\n"+
+		"Content-Type: application/json\r\nContent-Length: 40\r\n\r\n{\"description\":", server.Listener.Addr(), token)
+	if err != nil {
+		t.Fatalf("error sending request: %v", err)
+	}
+	res, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+	body, _ = io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusRequestTimeout || !res.Close {
+		t.Fatalf("sending a slow body: got status %d and close %t, want 408 and closing the connection: %s", res.StatusCode,
+			res.Close, body)
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now())
+	defer cancelExpired()
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		err    error
+		status int
+	}{
+		{"error meant for the client", context.Background(), NewHTTPError("No todo", http.StatusNotFound, "Not Found"), http.StatusNotFound},
+		{"body over the limit", context.Background(), fmt.Errorf("reading body: %w", &http.MaxBytesError{Limit: 10}), http.StatusRequestEntityTooLarge},
+		{"body past the read timeout", context.Background(), fmt.Errorf("reading body: %w", os.ErrDeadlineExceeded), http.StatusRequestTimeout},
+		{"client went away", cancelled, errors.New("interrupted"), StatusClientClosedRequest},
+		{"request past its deadline", expired, errors.New("interrupted"), http.StatusServiceUnavailable},
+		{"query past its deadline", context.Background(), context.DeadlineExceeded, http.StatusServiceUnavailable},
+		{"anything else", context.Background(), errors.New("disk full"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		if got := ErrorResponse(test.ctx, test.err).Status; got != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, got, test.status)
+		}
+	}
+}
+
+func TestLimitsStreamOutlivesTimeout(t *testing.T) {
+	previousTimeout, previousHeartbeat := requestTimeout, eventHeartbeat
+	requestTimeout, eventHeartbeat = 20*time.Millisecond, 100*time.Millisecond
+	t.Cleanup(func() { requestTimeout, eventHeartbeat = previousTimeout, previousHeartbeat })
+	server, issuer := setupTestServer(t)
+
+	// The change feed is still open and sending heartbeats well after the request timeout
+	lines, _ := openTestEvents(t, server, issuer.token(t, issuer.key, "alice", nil), "")
+	readTestEvent(t, lines, ": heartbeat")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// First file descriptor passed by systemd socket activation, see sd_listen_fds(3)
+const systemdListenFDsStart = 3
+
+// ListenAddress returns the address the server listens on, the port alone means all interfaces
+func ListenAddress(cfg *Config) string {
+	if cfg.Listen != "" {
+		return cfg.Listen
+	}
+	return ":" + cfg.Port
+}
+
+// Listen opens the socket of the server. A socket passed by systemd is used when there is one,
+// otherwise the address is either unix:/path/to.sock or a TCP host:port like 127.0.0.1:8080 or [::1]:8080.
+func Listen(address string, socketMode string) (net.Listener, error) {
+	listener, err := systemdListener()
+	if err != nil {
+		return nil, fmt.Errorf("[Listen] error using systemd socket: %w", err)
+	}
+	if listener != nil {
+		return listener, nil
+	}
+	return listenOn(address, socketMode)
+}
+
+// listenOn opens a socket on an address, either unix:/path/to.sock or a TCP host:port
+func listenOn(address string, socketMode string) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(address, "unix:")
+	if !isUnix {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, fmt.Errorf("[listenOn] error listening on %s: %w", address, err)
+		}
+		return listener, nil
+	}
+
+	// A socket left behind by a server that didn't shut down cleanly would make listening fail
+	if info, err := os.Lstat(path); err == nil && info.Mode()&fs.ModeSocket != 0 {
+		err = os.Remove(path)
+		if err != nil {
+			return nil, fmt.Errorf("[listenOn] error removing stale socket: %w", err)
+		}
+	}
+
+	if socketMode == "" {
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("[listenOn] error listening on %s: %w", path, err)
+		}
+		return listener, nil
+	}
+	mode, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("[listenOn] error parsing socket permissions: %w", err)
+	}
+
+	// Limit who can connect, for example only the group of the reverse proxy. The socket is created in a directory
+	// only the server can enter and moved into place once it has its permissions, so nobody else can connect before.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".listen-")
+	if err != nil {
+		return nil, fmt.Errorf("[listenOn] error creating socket directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	hidden := filepath.Join(dir, "socket")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: hidden, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("[listenOn] error listening on %s: %w", path, err)
+	}
+	// The socket file moves so the listener can't remove it by its old path
+	listener.SetUnlinkOnClose(false)
+	err = os.Chmod(hidden, fs.FileMode(mode))
+	if err == nil {
+		err = os.Rename(hidden, path)
+	}
+	if err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("[listenOn] error setting socket permissions: %w", err)
+	}
+	return &unixListener{UnixListener: listener, path: path}, nil
+}
+
+// unixListener is a Unix socket that was moved after it was created, it removes the socket file at its new path
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+// Close stops listening and removes the socket file
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	_ = os.Remove(l.path)
+	return err
+}
+
+// Addr returns the path clients connect to
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+// systemdListener returns the socket passed by systemd socket activation, nil when the server wasn't activated
+func systemdListener() (net.Listener, error) {
+	// The sockets are meant for the process systemd started, not for one that inherited the environment
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("[systemdListener] error parsing LISTEN_FDS: %w", err)
+	}
+	if fds < 1 {
+		return nil, errors.New("[systemdListener] error: no sockets were passed")
+	}
+	if fds > 1 {
+		slog.Warn("systemd passed more than one socket, only the first is used", "sockets", fds)
+	}
+
+	// Don't pass the sockets on to processes started by the server
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	// The listener gets its own copy of the file descriptor so the original can be closed
+	file := os.NewFile(systemdListenFDsStart, "systemd-socket")
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("[systemdListener] error using socket: %w", err)
+	}
+	return listener, nil
+}
+
+// ListenPort returns the TCP port of a listener, empty for Unix sockets
+func ListenPort(listener net.Listener) string {
+	addr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	return strconv.Itoa(addr.Port)
+}
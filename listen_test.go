@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnixSocketMode(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "todo.sock")
+
+	// A socket left behind by a server that didn't shut down cleanly is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("error creating stale socket: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	listener, err := listenOn("unix:"+path, "0600")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+
+	// The socket is in place with its permissions and nothing else is left in the directory
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&fs.ModeSocket == 0 || info.Mode().Perm() != 0o600 {
+		t.Fatalf("socket has mode %v, want 0600: %v", info.Mode(), err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("directory has %v, want only the socket: %v", entries, err)
+	}
+	if addr := listener.Addr().String(); addr != path {
+		t.Errorf("listener address is %s, want %s", addr, path)
+	}
+
+	// Clients connect at the path
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	_ = conn.Close()
+
+	// Closing removes the socket
+	err = listener.Close()
+	if err != nil {
+		t.Fatalf("error closing listener: %v", err)
+	}
+	if _, err := os.Lstat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("socket is still there after closing: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Context key under which the ID of the request is stored
+const requestIDContextKey contextKey = "requestID"
+
+// contextHandler adds the request and trace IDs stored in the context to every log record
+type contextHandler struct {
+	slog.Handler
+}
+
+// Handle adds the IDs of the context to the record before passing it on
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestID := RequestIDFromContext(ctx); requestID != "" {
+		record.AddAttrs(slog.String("request_id", requestID))
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.HasTraceID() {
+		record.AddAttrs(slog.String("trace_id", spanContext.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+// WithAttrs keeps the wrapper around handlers with attributes
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup keeps the wrapper around handlers with groups
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// SetupLogging configures the level and format of the default logger
+func SetupLogging(options LogOptions) error {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(options.Level))
+	if err != nil {
+		return fmt.Errorf("[SetupLogging] error parsing level: %w", err)
+	}
+	handlerOptions := &slog.HandlerOptions{Level: level}
+
+	// Text is easier to read in a terminal, JSON easier to ship to a log store
+	var handler slog.Handler
+	switch options.Format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, handlerOptions)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, handlerOptions)
+	default:
+		return fmt.Errorf("[SetupLogging] error: unknown format %q", options.Format)
+	}
+
+	slog.SetDefault(slog.New(contextHandler{handler}))
+
+	return nil
+}
+
+// fatal logs an error that the server can't recover from and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// validRequestID reports whether an incoming request ID is safe to log and send back
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		// Only allow printable ASCII so the ID can't break log lines or headers
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestID wraps the router so that every request has an ID, taken from the X-Request-ID header or generated
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Keep the ID of a proxy or caller so the request can be followed across services
+		requestID := r.Header.Get("X-Request-ID")
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+
+		// Tell the client the ID so it can be mentioned when reporting problems
+		w.Header().Set("X-Request-ID", requestID)
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey, requestID)))
+	})
+}
+
+// newRequestID generates a random request ID
+func newRequestID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// RequestIDFromContext returns the ID of the request stored in the context, if any
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey).(string)
+	return requestID
+}
+
+// AccessLog wraps the router so that a line is logged for every request once it's handled
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		slog.InfoContext(r.Context(), "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", r.Pattern,
+			"status", recorder.status,
+			"size", recorder.size,
+			"latency", time.Since(start),
+			"client_ip", ClientIP(r),
+		)
+	})
+}
+
+// WriteHTTPError responds with a JSON-encoded HTTPError that includes the ID of the request
+func WriteHTTPError(w http.ResponseWriter, r *http.Request, message string, status int, detail string) {
+	// Tell the client that we are going to return JSON
+	w.Header().Set("Content-Type", "application/json")
+	// Tell the client the status of the request
+	w.WriteHeader(status)
+	// Create a new error of our custom type
+	e := &HTTPError{
+		Message:   message,
+		Detail:    detail,
+		Status:    status,
+		RequestID: RequestIDFromContext(r.Context()),
+	}
+	// Server errors are our problem so keep a record of them
+	if status >= http.StatusInternalServerError {
+		slog.ErrorContext(r.Context(), "error handling request", "error", e.Error(), "status", status)
+	}
+	// Return the JSON-encoded error message
+	err := json.NewEncoder(w).Encode(e)
+	if err != nil {
+		// Log encoding error for debugging
+		slog.ErrorContext(r.Context(), "error encoding error", "error", err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/insanitywholesale/go-todo/todopb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// syncBuffer is a buffer the logger of every request can write to at once
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// records returns the JSON log records written so far
+func (b *syncBuffer) records(t *testing.T) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("error decoding log record %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// setupTestLogs sends log records to a buffer as JSON for the duration of the test
+func setupTestLogs(t *testing.T) *syncBuffer {
+	t.Helper()
+	logs := &syncBuffer{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(contextHandler{slog.NewJSONHandler(logs, nil)}))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return logs
+}
+
+func TestRequestID(t *testing.T) {
+	server, issuer := setupTestServer(t)
+	token := issuer.token(t, issuer.key, "alice", nil)
+
+	tests := []struct {
+		name string
+		sent string
+		kept bool
+	}{
+		{"ID of the caller", "caller-1234", true},
+		{"no ID", "", false},
+		{"ID with spaces", "bad id", false},
+		{"ID that is too long", strings.Repeat("a", 129), false},
+	}
+	for _, test := range tests {
+		logs := setupTestLogs(t)
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/todo/42", nil)
+		if err != nil {
+			t.Fatalf("error creating request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		if test.sent != "" {
+			req.Header.Set("X-Request-ID", test.sent)
+		}
+		res, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var httpErr HTTPError
+		err = json.NewDecoder(res.Body).Decode(&httpErr)
+		_ = res.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: error decoding response: %v", test.name, err)
+		}
+
+		// Valid IDs of callers are kept, others are replaced by a generated one
+		requestID := res.Header.Get("X-Request-ID")
+		if test.kept && requestID != test.sent {
+			t.Errorf("%s: got ID %q, want %q", test.name, requestID, test.sent)
+		}
+		if !test.kept && (len(requestID) != 32 || requestID == test.sent) {
+			t.Errorf("%s: got ID %q, want a generated one", test.name, requestID)
+		}
+
+		// Error responses and the access log mention the ID
+		if httpErr.RequestID != requestID {
+			t.Errorf("%s: error response has ID %q, want %q", test.name, httpErr.RequestID, requestID)
+		}
+		logged := false
+		for _, record := range logs.records(t) {
+			if record["msg"] == "request" && record["request_id"] == requestID {
+				logged = true
+			}
+		}
+		if !logged {
+			t.Errorf("%s: the request wasn't logged with its ID", test.name)
+		}
+	}
+}
+
+func TestRequestIDGRPC(t *testing.T) {
+	_, issuer := setupTestServer(t)
+	grpcClient := setupTestGRPC(t)
+	logs := setupTestLogs(t)
+
+	// Calls keep the ID of the caller and send it back as metadata
+	ctx := metadata.AppendToOutgoingContext(grpcContext(issuer.token(t, issuer.key, "alice", nil)), "x-request-id", "caller-5678")
+	var header metadata.MD
+	_, err := grpcClient.Get(ctx, &todopb.GetRequest{Id: 42}, grpc.Header(&header))
+	if err == nil {
+		t.Fatal("getting a missing todo item succeeded")
+	}
+	if ids := header.Get("x-request-id"); len(ids) != 1 || ids[0] != "caller-5678" {
+		t.Errorf("got request IDs %v, want the one of the caller", ids)
+	}
+	logged := false
+	for _, record := range logs.records(t) {
+		if record["msg"] == "call" && record["request_id"] == "caller-5678" {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Error("the call wasn't logged with its ID")
+	}
+}
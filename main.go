@@ -1,16 +1,24 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
+	"github.com/XSAM/otelsql"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"google.golang.org/grpc"
 	_ "modernc.org/sqlite" // no-CGo database/sql driver for sqlite
 )
 
@@ -19,13 +27,15 @@ type TodoItem struct {
 	ID          int64  `json:"id"`
 	Description string `json:"description"`
 	Done        bool   `json:"done"`
+	ListID      *int64 `json:"list_id,omitempty"` // list the item belongs to, if any
 }
 
 // HTTPError is a custom HTTP error type
 type HTTPError struct {
-	Message string `json:"error"`
-	Detail  string `json:"detail"` // the error as a string
-	Status  int    `json:"status"`
+	Message   string `json:"error"`
+	Detail    string `json:"detail"` // the error as a string
+	Status    int    `json:"status"`
+	RequestID string `json:"request_id,omitempty"`
 }
 
 // Error returns the custom HTTPError as a string
@@ -48,114 +58,38 @@ func NewHTTPError(err string, status int, detail string) error {
 // Global database object
 var db *sql.DB
 
+// How long a query waits for another connection or process that is writing to the database file
+const dbBusyTimeout = 5 * time.Second
+
 // HTTP handler for the root endpoint
-func Home(w http.ResponseWriter, _ *http.Request) {
+func Home(w http.ResponseWriter, r *http.Request) {
 	welcomeMessage := "Welcome to the Todo API demo"
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
 	_, err := w.Write([]byte(welcomeMessage))
 	if err != nil {
-		log.Println("[Home] error writing to client:", err)
+		slog.ErrorContext(r.Context(), "error writing to client", "error", err)
 	}
 }
 
-// HTTP handler for getting all todo items
-func ReadTodos(w http.ResponseWriter, _ *http.Request) {
-	// Get all rows from the todo table in the database
-	rows, err := db.Query(`SELECT id, description, done FROM todo;`)
-	if err != nil {
-		// If the error is that no rows were returned that's not actually our problem
-		if errors.Is(err, sql.ErrNoRows) {
-			// Tell the client that we are going to return JSON
-			w.Header().Add("Content-Type", "application/json")
-			// Tell the client that the status of the request is 404
-			w.WriteHeader(http.StatusNotFound)
-			// Create a new error of our custom type
-			e := NewHTTPError(err.Error(), http.StatusNotFound, "Not Found")
-			// Return the JSON-encoded error message
-			err := json.NewEncoder(w).Encode(e)
-			if err != nil {
-				// Log encoding error for debugging
-				log.Println("[ReadTodos] error encoding error:", err)
-			}
-			return
-		}
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 500
-		w.WriteHeader(http.StatusInternalServerError)
-		// Create a new error of our custom type
-		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "General Error")
+// Largest page of todo items the REST API returns at once
+const maxTodoPage = 100
+
+// HTTP handler for getting all todo items, or a filtered page of them
+func ReadTodos(w http.ResponseWriter, r *http.Request) {
+	// Get the filter and page from the query parameters
+	filter, after, limit, err := parseTodoQuery(r)
+	if err != nil {
 		// Return the JSON-encoded error message
-		err := json.NewEncoder(w).Encode(e)
-		if err != nil {
-			// Log encoding error for debugging
-			log.Println("[ReadTodos] error encoding error:", err)
-		}
+		WriteError(w, r, err)
 		return
 	}
 
-	// Store todo items in a slice
-	var todos []*TodoItem
-
-	// Leave closing the rows object for later after we've read the results
-	defer rows.Close()
-	// Map each returned row from the database query to a temp item and append to the slice
-	for rows.Next() {
-		// Check if there is an error without scanning
-		if rows.Err() != nil {
-			// Tell the client that we are going to return JSON
-			w.Header().Add("Content-Type", "application/json")
-			// Tell the client that the status of the request is 500
-			w.WriteHeader(http.StatusInternalServerError)
-			// Create a new error of our custom type
-			e := NewHTTPError(rows.Err().Error(), http.StatusInternalServerError, "General Error")
-			// Return the JSON-encoded error message
-			err := json.NewEncoder(w).Encode(e)
-			if err != nil {
-				// Log encoding error for debugging
-				log.Println("[ReadTodos] error encoding error:", err)
-				return
-			}
-		}
-
-		// Store current todo item we're working with
-		var todo TodoItem
-
-		// Put row from database into variable
-		err = rows.Scan(&todo.ID, &todo.Description, &todo.Done)
-		if err != nil {
-			// If the error is that no rows were returned that's not actually our problem
-			if errors.Is(err, sql.ErrNoRows) {
-				// Tell the client that we are going to return JSON
-				w.Header().Add("Content-Type", "application/json")
-				// Tell the client that the status of the request is 404
-				w.WriteHeader(http.StatusNotFound)
-				// Create a new error of our custom type
-				e := NewHTTPError(err.Error(), http.StatusNotFound, "Not Found")
-				// Return the JSON-encoded error message
-				err := json.NewEncoder(w).Encode(e)
-				if err != nil {
-					// Log encoding error for debugging
-					log.Println("[ReadTodo] error encoding error:", err)
-				}
-				return
-			}
-			// Tell the client that we are going to return JSON
-			w.Header().Add("Content-Type", "application/json")
-			// Tell the client that the status of the request is 500
-			w.WriteHeader(http.StatusInternalServerError)
-			// Create a new error of our custom type
-			e := NewHTTPError(err.Error(), http.StatusInternalServerError, "General Error")
-			// Return the JSON-encoded error message
-			err := json.NewEncoder(w).Encode(e)
-			if err != nil {
-				// Log encoding error for debugging
-				log.Println("[ReadTodos] error encoding error:", err)
-				return
-			}
-		}
-
-		// Add returned todo item to the list
-		todos = append(todos, &todo)
+	// Get the todo items the user can see
+	todos, err := store.Find(r.Context(), filter, after, limit)
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return
 	}
 
 	// Tell the client that we are going to return JSON
@@ -166,84 +100,67 @@ func ReadTodos(w http.ResponseWriter, _ *http.Request) {
 	err = json.NewEncoder(w).Encode(todos)
 	if err != nil {
 		// Log encoding error for debugging
-		log.Println("[ReadTodos] error encoding todo item list:", err)
+		slog.ErrorContext(r.Context(), "error encoding todo item list", "error", err)
 	}
 }
 
-// HTTP handler for getting a todo item
-func ReadTodo(w http.ResponseWriter, r *http.Request) {
-	// Get URL parameter named todo_id
-	todoIDfromURL := r.PathValue("todo_id")
-	if todoIDfromURL == "" {
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 400
-		w.WriteHeader(http.StatusBadRequest)
-		// Create a new error of our custom type
-		e := NewHTTPError("Parameter todo_id is empty", http.StatusBadRequest, "Bad Request")
-		// Return the JSON-encoded error message
-		err := json.NewEncoder(w).Encode(e)
+// parseTodoQuery returns the filter, the ID the page starts after and the size of the page asked for in the query
+// parameters of the request. Without a limit every matching todo item is returned.
+func parseTodoQuery(r *http.Request) (TodoFilter, int64, int, error) {
+	query := r.URL.Query()
+	var filter TodoFilter
+	if v := query.Get("done"); v != "" {
+		done, err := strconv.ParseBool(v)
 		if err != nil {
-			// Log encoding error for debugging
-			log.Println("[ReadTodo] error encoding error:", err)
+			return filter, 0, 0, NewHTTPError("Parameter done is not a boolean", http.StatusBadRequest, "Bad Request")
 		}
-		return
+		filter.Done = &done
 	}
-
-	todoID, err := strconv.Atoi(todoIDfromURL)
-	if err != nil {
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 400
-		w.WriteHeader(http.StatusBadRequest)
-		// Create a new error of our custom type
-		e := NewHTTPError("Parameter todo_id is not a number", http.StatusBadRequest, "Bad Request")
-		// Return the JSON-encoded error message
-		err := json.NewEncoder(w).Encode(e)
+	if v := query.Get("list_id"); v != "" {
+		listID, err := strconv.ParseInt(v, 10, 64)
 		if err != nil {
-			// Log encoding error for debugging
-			log.Println("[ReadTodo] error encoding error:", err)
+			return filter, 0, 0, NewHTTPError("Parameter list_id is not a number", http.StatusBadRequest, "Bad Request")
 		}
-		return
+		filter.ListIDs = []int64{listID}
 	}
+	filter.Tag = query.Get("tag")
+	filter.Search = query.Get("search")
 
-	// Todo item we are going to return
-	var todo TodoItem
+	var after int64
+	if v := query.Get("after"); v != "" {
+		var err error
+		after, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return filter, 0, 0, NewHTTPError("Parameter after is not a number", http.StatusBadRequest, "Bad Request")
+		}
+	}
 
-	// Get row from the todo table in the database with the id
-	row := db.QueryRow(`SELECT id, description, done FROM todo WHERE id = ?;`, todoID)
-	// Put row from database into variable
-	err = row.Scan(&todo.ID, &todo.Description, &todo.Done)
-	if err != nil {
-		// If the error is that no rows were returned that's not actually our problem
-		if errors.Is(err, sql.ErrNoRows) {
-			// Tell the client that we are going to return JSON
-			w.Header().Add("Content-Type", "application/json")
-			// Tell the client that the status of the request is 404
-			w.WriteHeader(http.StatusNotFound)
-			// Create a new error of our custom type
-			e := NewHTTPError(err.Error(), http.StatusNotFound, "Not Found")
-			// Return the JSON-encoded error message
-			err := json.NewEncoder(w).Encode(e)
-			if err != nil {
-				// Log encoding error for debugging
-				log.Println("[ReadTodo] error encoding error:", err)
-			}
-			return
+	// A negative limit means no limit to sqlite
+	limit := -1
+	if v := query.Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxTodoPage {
+			return filter, 0, 0, NewHTTPError("Parameter limit has to be between 1 and "+strconv.Itoa(maxTodoPage), http.StatusBadRequest, "Bad Request")
 		}
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 500
-		w.WriteHeader(http.StatusInternalServerError)
-		// Create a new error of our custom type
-		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "General Error")
+	}
+	return filter, after, limit, nil
+}
+
+// HTTP handler for getting a todo item
+func ReadTodo(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter named todo_id
+	todoID, ok := parseIDParam(w, r, "todo_id")
+	if !ok {
+		return
+	}
+
+	// Get the todo item if the user can see it
+	todo, err := store.Get(r.Context(), todoID)
+	if err != nil {
 		// Return the JSON-encoded error message
-		err := json.NewEncoder(w).Encode(e)
-		if err != nil {
-			// Log encoding error for debugging
-			log.Println("[ReadTodo] error encoding error:", err)
-			return
-		}
+		WriteError(w, r, err)
+		return
 	}
 
 	// Tell the client that we are going to return JSON
@@ -254,7 +171,7 @@ func ReadTodo(w http.ResponseWriter, r *http.Request) {
 	err = json.NewEncoder(w).Encode(todo)
 	if err != nil {
 		// Log encoding error for debugging
-		log.Println("[ReadTodo] error encoding todo item:", err)
+		slog.ErrorContext(r.Context(), "error encoding todo item", "error", err)
 	}
 }
 
@@ -266,61 +183,19 @@ func CreateTodo(w http.ResponseWriter, r *http.Request) {
 	// Map todo from request body to variable
 	err := json.NewDecoder(r.Body).Decode(&todo)
 	if err != nil {
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 500
-		w.WriteHeader(http.StatusInternalServerError)
-		// Create a new error of our custom type
-		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "General Error")
 		// Return the JSON-encoded error message
-		err := json.NewEncoder(w).Encode(e)
-		// Log encoding error for debugging
-		log.Println("[CreateTodo] error encoding error:", err)
+		WriteBodyError(w, r, err)
 		return
 	}
 
-	// Save todo item in database and return generated id
-	res, err := db.Exec(`INSERT INTO todo (done, description) VALUES (?, ?);`,
-		&todo.Done,
-		&todo.Description,
-	)
+	// Save todo item in database and get it back with its generated id
+	todo, err = store.Create(r.Context(), todo)
 	if err != nil {
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 500
-		w.WriteHeader(http.StatusInternalServerError)
-		// Create a new error of our custom type
-		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "General Error")
 		// Return the JSON-encoded error message
-		err := json.NewEncoder(w).Encode(e)
-		if err != nil {
-			// Log encoding error for debugging
-			log.Println("[CreateTodo] error encoding error:", err)
-		}
+		WriteError(w, r, err)
 		return
 	}
 
-	// Get id of last inserted row which should be the autoincrement id of the todo
-	rowID, err := res.LastInsertId()
-	if err != nil {
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 500
-		w.WriteHeader(http.StatusInternalServerError)
-		// Create a new error of our custom type
-		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "General Error")
-		// Return the JSON-encoded error message
-		err := json.NewEncoder(w).Encode(e)
-		if err != nil {
-			// Log encoding error for debugging
-			log.Println("[CreateTodo] error encoding error:", err)
-		}
-		return
-	}
-
-	// Set todo ID to last insert ID
-	todo.ID = rowID
-
 	// Tell the client that we are going to return JSON
 	w.Header().Add("Content-Type", "application/json")
 	// Tell the client that the status of the request is 200
@@ -329,7 +204,7 @@ func CreateTodo(w http.ResponseWriter, r *http.Request) {
 	err = json.NewEncoder(w).Encode(todo)
 	if err != nil {
 		// Log encoding error for debugging
-		log.Println("[CreateTodo] error encoding todo item:", err)
+		slog.ErrorContext(r.Context(), "error encoding todo item", "error", err)
 		return
 	}
 }
@@ -337,38 +212,8 @@ func CreateTodo(w http.ResponseWriter, r *http.Request) {
 // HTTP handler for updating a todo item
 func UpdateTodo(w http.ResponseWriter, r *http.Request) {
 	// Get URL parameter named todo_id
-	todoIDfromURL := r.PathValue("todo_id")
-	if todoIDfromURL == "" {
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 400
-		w.WriteHeader(http.StatusBadRequest)
-		// Create a new error of our custom type
-		e := NewHTTPError("Parameter todo_id is empty", http.StatusBadRequest, "Bad Request")
-		// Return the JSON-encoded error message
-		err := json.NewEncoder(w).Encode(e)
-		if err != nil {
-			// Log encoding error for debugging
-			log.Println("[UpdateTodo] error encoding error:", err)
-		}
-		return
-	}
-
-	// Convert string variable from URL to integer
-	todoID, err := strconv.Atoi(todoIDfromURL)
-	if err != nil {
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 400
-		w.WriteHeader(http.StatusBadRequest)
-		// Create a new error of our custom type
-		e := NewHTTPError("Parameter todo_id is not a number", http.StatusBadRequest, "Bad Request")
-		// Return the JSON-encoded error message
-		err := json.NewEncoder(w).Encode(e)
-		if err != nil {
-			// Log encoding error for debugging
-			log.Println("[UpdateTodo] error encoding error:", err)
-		}
+	todoID, ok := parseIDParam(w, r, "todo_id")
+	if !ok {
 		return
 	}
 
@@ -376,229 +221,59 @@ func UpdateTodo(w http.ResponseWriter, r *http.Request) {
 	var todo TodoItem
 
 	// Map todo from request body to variable
-	err = json.NewDecoder(r.Body).Decode(&todo)
-	if err != nil {
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 500
-		w.WriteHeader(http.StatusInternalServerError)
-		// Create a new error of our custom type
-		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "General Error")
+	err := json.NewDecoder(r.Body).Decode(&todo)
+	if err != nil {
 		// Return the JSON-encoded error message
-		err := json.NewEncoder(w).Encode(e)
-		if err != nil {
-			// Log encoding error for debugging
-			log.Println("[UpdateTodo] error encoding error:", err)
-		}
+		WriteBodyError(w, r, err)
 		return
 	}
 	// Set its ID equal to the URL path variable
-	todo.ID = int64(todoID)
+	todo.ID = todoID
 
 	// Update todo item in database based on specified id
-	res, err := db.Exec(`UPDATE todo SET done = ?, description = ? WHERE id = ?;`,
-		&todo.Done,
-		&todo.Description,
-		todoID, // URL path variable instead of the ID in the struct
-	)
-	if err != nil {
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 500
-		w.WriteHeader(http.StatusInternalServerError)
-		// Create a new error of our custom type
-		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "General Error")
-		// Return the JSON-encoded error message
-		err := json.NewEncoder(w).Encode(e)
-		if err != nil {
-			// Log encoding error for debugging
-			log.Println("[UpdateTodo] error encoding error:", err)
-		}
-		return
-	}
-
-	// Get amount of changed rows
-	rowsAffected, err := res.RowsAffected()
+	todo, err = store.Update(r.Context(), todo)
 	if err != nil {
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 500
-		w.WriteHeader(http.StatusInternalServerError)
-		// Create a new error of our custom type
-		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "General Error")
 		// Return the JSON-encoded error message
-		err := json.NewEncoder(w).Encode(e)
-		if err != nil {
-			// Log encoding error for debugging
-			log.Println("[UpdateTodo] error encoding error:", err)
-		}
+		WriteError(w, r, err)
 		return
 	}
 
-	switch rowsAffected {
-	case 0:
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 404
-		w.WriteHeader(http.StatusNotFound)
-		// Create a new error of our custom type
-		e := NewHTTPError("No todo with id "+strconv.Itoa(todoID)+" exists", http.StatusNotFound, "Not Found")
-		// Return the JSON-encoded error message
-		err := json.NewEncoder(w).Encode(e)
-		if err != nil {
-			// Log encoding error for debugging
-			log.Println("[DeleteTodo] error encoding error:", err)
-		}
-		return
-	case 1:
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 200
-		w.WriteHeader(http.StatusOK)
-		// Return the JSON-encoded new todo item
-		err = json.NewEncoder(w).Encode(todo)
-		if err != nil {
-			// Log encoding error for debugging
-			log.Println("[UpdateTodo] error encoding todo item:", err)
-			return
-		}
-	default:
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 404
-		w.WriteHeader(http.StatusInternalServerError)
-		// Create a new error of our custom type
-		e := NewHTTPError("updated more than 1 record", http.StatusInternalServerError, "Internal Server Error")
-		// Return the JSON-encoded error message
-		err := json.NewEncoder(w).Encode(e)
-		if err != nil {
-			// Log encoding error for debugging
-			log.Println("[UpdateTodo] error encoding error:", err)
-			return
-		}
-		return
+	// Tell the client that we are going to return JSON
+	w.Header().Add("Content-Type", "application/json")
+	// Tell the client that the status of the request is 200
+	w.WriteHeader(http.StatusOK)
+	// Return the JSON-encoded new todo item
+	err = json.NewEncoder(w).Encode(todo)
+	if err != nil {
+		// Log encoding error for debugging
+		slog.ErrorContext(r.Context(), "error encoding todo item", "error", err)
 	}
 }
 
 // HTTP handler for deleting a todo item
 func DeleteTodo(w http.ResponseWriter, r *http.Request) {
 	// Get URL parameter named todo_id
-	todoIDfromURL := r.PathValue("todo_id")
-	if todoIDfromURL == "" {
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 400
-		w.WriteHeader(http.StatusBadRequest)
-		// Create a new error of our custom type
-		e := NewHTTPError("Parameter todo_id is empty", http.StatusBadRequest, "Bad Request")
-		// Return the JSON-encoded error message
-		err := json.NewEncoder(w).Encode(e)
-		if err != nil {
-			// Log encoding error for debugging
-			log.Println("[DeleteTodo] error encoding error:", err)
-		}
-		return
-	}
-
-	todoID, err := strconv.Atoi(todoIDfromURL)
-	if err != nil {
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 400
-		w.WriteHeader(http.StatusBadRequest)
-		// Create a new error of our custom type
-		e := NewHTTPError("Parameter todo_id is not a number", http.StatusBadRequest, "Bad Request")
-		// Return the JSON-encoded error message
-		err := json.NewEncoder(w).Encode(e)
-		if err != nil {
-			// Log encoding error for debugging
-			log.Println("[DeleteTodo] error encoding error:", err)
-		}
+	todoID, ok := parseIDParam(w, r, "todo_id")
+	if !ok {
 		return
 	}
 
 	// Delete todo item from database
-	res, err := db.Exec(`DELETE FROM todo WHERE id = ?;`, todoID)
-	if err != nil {
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 500
-		w.WriteHeader(http.StatusInternalServerError)
-		// Create a new error of our custom type
-		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "General Error")
-		// Return the JSON-encoded error message
-		err := json.NewEncoder(w).Encode(e)
-		if err != nil {
-			// Log encoding error for debugging
-			log.Println("[DeleteTodo] error encoding error:", err)
-		}
-		return
-	}
-
-	rowsAffected, err := res.RowsAffected()
+	err := store.Delete(r.Context(), todoID)
 	if err != nil {
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 500
-		w.WriteHeader(http.StatusInternalServerError)
-		// Create a new error of our custom type
-		e := NewHTTPError(err.Error(), http.StatusInternalServerError, "General Error")
 		// Return the JSON-encoded error message
-		err := json.NewEncoder(w).Encode(e)
-		if err != nil {
-			// Log encoding error for debugging
-			log.Println("[DeleteTodo] error encoding error:", err)
-		}
+		WriteError(w, r, err)
 		return
 	}
 
-	switch rowsAffected {
-	case 0:
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 404
-		w.WriteHeader(http.StatusNotFound)
-		// Create a new error of our custom type
-		e := NewHTTPError("No todo with id "+strconv.Itoa(todoID)+" exists", http.StatusNotFound, "Not Found")
-		// Return the JSON-encoded error message
-		err := json.NewEncoder(w).Encode(e)
-		if err != nil {
-			// Log encoding error for debugging
-			log.Println("[DeleteTodo] error encoding error:", err)
-		}
-		return
-	case 1:
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 204
-		w.WriteHeader(http.StatusNoContent)
-		return
-	default:
-		// Tell the client that we are going to return JSON
-		w.Header().Add("Content-Type", "application/json")
-		// Tell the client that the status of the request is 404
-		w.WriteHeader(http.StatusInternalServerError)
-		// Create a new error of our custom type
-		e := NewHTTPError("deleted more than 1 record", http.StatusInternalServerError, "Internal Server Error")
-		// Return the JSON-encoded error message
-		err := json.NewEncoder(w).Encode(e)
-		if err != nil {
-			// Log encoding error for debugging
-			log.Println("[DeleteTodo] error encoding error:", err)
-		}
-		return
-	}
+	// Tell the client that we are going to return JSON
+	w.Header().Add("Content-Type", "application/json")
+	// Tell the client that the status of the request is 204
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// SetupDB initializes the database and returns a client object to access it
-func SetupDB() (*sql.DB, error) {
-	// Get database file path from environment
-	dbPath := os.Getenv("TODO_DB_PATH")
-	// If the environment variable is empty use a default path of the current directory
-	if dbPath == "" {
-		dbPath = "todo.db"
-	}
-
+// OpenDB opens the sqlite database at the given path, creating the file and tables if needed
+func OpenDB(dbPath string) (*sql.DB, error) {
 	// Check if file exists and if not, create it
 	fileInfo, err := os.Stat(dbPath)
 	if err != nil {
@@ -607,7 +282,12 @@ func SetupDB() (*sql.DB, error) {
 		case errors.Is(err, os.ErrPermission): // If there is a permission error just exit
 			return nil, fmt.Errorf("[SetupDB] error with permissions trying to open file: %w", err)
 		case errors.Is(err, os.ErrNotExist): // If the file doesn't exist try to create it
-			_, err := os.Create(dbPath)
+			file, err := os.Create(dbPath)
+			if err != nil {
+				return nil, fmt.Errorf("[SetupDB] error trying to create file: %w", err)
+			}
+			// Close it right away, closing it later would drop the locks sqlite holds on the file in this process
+			err = file.Close()
 			if err != nil {
 				return nil, fmt.Errorf("[SetupDB] error trying to create file: %w", err)
 			}
@@ -621,8 +301,11 @@ func SetupDB() (*sql.DB, error) {
 		return nil, errors.New("[SetupDB] error: " + dbPath + " is not a regular file")
 	}
 
-	// Since the file exists, use it for sqlite
-	sqlite, err := sql.Open("sqlite", dbPath)
+	// Since the file exists, use it for sqlite with every query traced as a child span of its request.
+	// Other processes like the command-line client can use the file at the same time, so connections wait for their
+	// writes to finish and transactions take the write lock right away instead of failing when they try to upgrade.
+	dsn := dbPath + "?_pragma=busy_timeout(" + strconv.FormatInt(dbBusyTimeout.Milliseconds(), 10) + ")&_txlock=immediate"
+	sqlite, err := otelsql.Open("sqlite", dsn, otelsql.WithAttributes(semconv.DBSystemSqlite))
 	if err != nil {
 		return nil, fmt.Errorf("[SetupDB] error opening sqlite file: %w", err)
 	}
@@ -633,6 +316,12 @@ func SetupDB() (*sql.DB, error) {
 		return nil, fmt.Errorf("[SetupDB] error pinging sqlite database: %w", err)
 	}
 
+	// Use a write-ahead log so reads don't block on writes, this is stored in the file and checkpointed on shutdown
+	_, err = sqlite.Exec(`PRAGMA journal_mode = WAL;`)
+	if err != nil {
+		return nil, fmt.Errorf("[SetupDB] error enabling WAL: %w", err)
+	}
+
 	// Create todos table
 	_, err = sqlite.Exec(`CREATE TABLE if not exists todo (
 		id INTEGER NOT NULL,
@@ -644,34 +333,162 @@ func SetupDB() (*sql.DB, error) {
 		return nil, fmt.Errorf("[SetupDB] error creating todo database: %w", err)
 	}
 
+	// Create users table for accounts mapped from OIDC subjects
+	_, err = sqlite.Exec(`CREATE TABLE if not exists user (
+		id INTEGER NOT NULL,
+		subject TEXT NOT NULL UNIQUE,
+		email TEXT NOT NULL DEFAULT(''),
+		name TEXT NOT NULL DEFAULT(''),
+		PRIMARY KEY (id AUTOINCREMENT)
+	);`)
+	if err != nil {
+		return nil, fmt.Errorf("[SetupDB] error creating user table: %w", err)
+	}
+
+	// Bring the rest of the schema up to date
+	err = MigrateDB(sqlite)
+	if err != nil {
+		return nil, fmt.Errorf("[SetupDB] error migrating database: %w", err)
+	}
+
+	return sqlite, nil
+}
+
+// OpenExistingDB opens the sqlite database at the given path without creating or migrating it, for tools like the
+// command-line client that work on the file of a server. The schema has to be the one this binary expects.
+func OpenExistingDB(dbPath string) (*sql.DB, error) {
+	fileInfo, err := os.Stat(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("[OpenExistingDB] error opening database: %w", err)
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return nil, errors.New("[OpenExistingDB] error: " + dbPath + " is not a regular file")
+	}
+
+	// Open it like OpenDB does, except that sqlite refuses to create the file if it's removed in the meantime
+	dsn := "file:" + dbPath + "?mode=rw&_pragma=busy_timeout(" + strconv.FormatInt(dbBusyTimeout.Milliseconds(), 10) + ")&_txlock=immediate"
+	sqlite, err := otelsql.Open("sqlite", dsn, otelsql.WithAttributes(semconv.DBSystemSqlite))
+	if err != nil {
+		return nil, fmt.Errorf("[OpenExistingDB] error opening sqlite file: %w", err)
+	}
+
+	// A file of an older server is missing tables and one of a newer server may have changed them
+	version, err := SchemaVersion(context.Background(), sqlite)
+	if err != nil {
+		_ = sqlite.Close()
+		return nil, fmt.Errorf("[OpenExistingDB] error checking database: %w", err)
+	}
+	if version != len(migrations) {
+		_ = sqlite.Close()
+		return nil, fmt.Errorf("[OpenExistingDB] error: %s has schema version %d but this binary uses %d, run the server of the same version on it first", dbPath, version, len(migrations))
+	}
+
 	return sqlite, nil
 }
 
-// SetupRouter creates and returns a new HTTP router
+// SetupRouter creates and returns a new HTTP router with every middleware
 func SetupRouter() http.Handler {
-	router := &http.ServeMux{}
+	router := newRouter()
+
+	// Let browser clients on other origins use the routes, then log, measure and trace every request under its own ID
+	return RequestID(Limits(router.ServeMux, Tracing(Metrics(AccessLog(CORS(router.ServeMux))))))
+}
+
+// newRouter creates the router of the API, every route has to be described in openapi.yaml
+func newRouter() *documentedMux {
+	router := &documentedMux{ServeMux: http.NewServeMux()}
+
+	// Handlers working with todo data run against the database of the tenant, for an authenticated user, within rate
+	// limits, and only get requests matching openapi.yaml. Addresses are limited first so that floods of bad tokens
+	// don't get to verification, and only authenticated requests are read for validation.
+	protect := func(handler http.HandlerFunc) http.HandlerFunc {
+		return LimitIP(VerifyToken(ResolveTenant(RequireAuth(RateLimit(Validate(handler))))))
+	}
 
 	// Set up HTTP routes
-	router.HandleFunc("GET /", Home)                        // Display homepage
-	router.HandleFunc("GET /todo", ReadTodos)               // Return all todo items
-	router.HandleFunc("GET /todos", ReadTodos)              // Return all todo items
-	router.HandleFunc("GET /todo/{todo_id}", ReadTodo)      // Return a todo item by ID
-	router.HandleFunc("POST /todo", CreateTodo)             // Add a todo item and return it
-	router.HandleFunc("PUT /todo/{todo_id}", UpdateTodo)    // Change a todo item by ID
-	router.HandleFunc("DELETE /todo/{todo_id}", DeleteTodo) // Remove a todo item by ID
+	router.HandleFunc("GET /", Validate(Home))                                // Display homepage
+	router.HandleFunc("GET /healthz", Validate(Healthz))                      // Report that the process is alive
+	router.HandleFunc("GET /readyz", Validate(Readyz))                        // Report whether requests can be handled
+	router.HandleFunc("GET /metrics", Validate(promhttp.Handler().ServeHTTP)) // Return metrics in Prometheus format
+	router.HandleFunc("GET /openapi.json", Validate(OpenAPI))                 // Return the OpenAPI document of the API
+	router.HandleFunc("GET /docs", Validate(Docs))                            // Browse and try out the API
+	router.HandleFunc("GET /me", protect(ReadMe))                             // Return the authenticated user
+	router.HandleFunc("GET /todo", protect(ReadTodos))                        // Return all todo items or a page of them
+	router.HandleFunc("GET /todos", protect(ReadTodos))                       // Return all todo items or a page of them
+	router.HandleFunc("GET /todos/events", protect(TodoEvents))               // Stream changes to todo items
+	router.HandleFunc("GET /ws", protect(TodoSocket))                         // Follow and change todo items over a WebSocket
+	router.HandleFunc("POST /graphql", protect(GraphQL))                      // Run GraphQL queries and mutations
+	router.HandleFunc("GET /graphql", protect(GraphQLSocket))                 // Run GraphQL subscriptions over a WebSocket
+	router.HandleFunc("GET /todo/{todo_id}", protect(ReadTodo))               // Return a todo item by ID
+	router.HandleFunc("POST /todo", protect(CreateTodo))                      // Add a todo item and return it
+	router.HandleFunc("PUT /todo/{todo_id}", protect(UpdateTodo))             // Change a todo item by ID
+	router.HandleFunc("DELETE /todo/{todo_id}", protect(DeleteTodo))          // Remove a todo item by ID
+
+	router.HandleFunc("GET /lists", protect(ReadLists))                                // Return lists of the user
+	router.HandleFunc("POST /list", protect(CreateList))                               // Add a list owned by the user
+	router.HandleFunc("GET /list/{list_id}/shares", protect(ReadShares))               // Return who a list is shared with
+	router.HandleFunc("PUT /list/{list_id}/shares/{user_id}", protect(UpdateShare))    // Share a list with a user
+	router.HandleFunc("DELETE /list/{list_id}/shares/{user_id}", protect(DeleteShare)) // Stop sharing a list with a user
+	router.HandleFunc("POST /list/{list_id}/invitations", protect(CreateInvitation))   // Create an invitation to a list
+	router.HandleFunc("POST /invitations/{token}", protect(AcceptInvitation))          // Join a list with an invitation
+
+	router.HandleFunc("GET /webhooks", protect(ReadWebhooks))                                                      // Return webhooks of the user
+	router.HandleFunc("POST /webhooks", protect(CreateWebhook))                                                    // Add a webhook and return it with its secret
+	router.HandleFunc("GET /webhooks/{webhook_id}", protect(ReadWebhook))                                          // Return a webhook by ID
+	router.HandleFunc("PUT /webhooks/{webhook_id}", protect(UpdateWebhook))                                        // Change a webhook by ID
+	router.HandleFunc("DELETE /webhooks/{webhook_id}", protect(DeleteWebhook))                                     // Remove a webhook by ID
+	router.HandleFunc("GET /webhooks/{webhook_id}/deliveries", protect(ReadWebhookDeliveries))                     // Return the delivery log of a webhook
+	router.HandleFunc("POST /webhooks/{webhook_id}/deliveries/{delivery_id}/retry", protect(RetryWebhookDelivery)) // Send a dead delivery again
 
 	return router
 }
 
 func main() {
+	// Run a subcommand instead of the server if one is given
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		err := ConfigCommand(os.Args[2:])
+		if err != nil {
+			fatal("error running config command", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && IsCLICommand(os.Args[1]) {
+		os.Exit(CLICommand(os.Args[1], os.Args[2:]))
+	}
+
+	// Load settings from the config file, environment and flags
+	cfg, err := LoadConfig("go-todo", os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fatal("error loading config", err)
+	}
+
+	// Set up logging first so that everything after it uses the configured format
+	err = SetupLogging(cfg.Log)
+	if err != nil {
+		fatal("error setting up logging", err)
+	}
+
+	// Get a context that is cancelled when Kubernetes, systemd or Ctrl+C asks us to stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Set up tracing first so that the database connection is traced as well
+	shutdownTracing, err := SetupTracing(ctx, cfg.Tracing)
+	if err != nil {
+		fatal("error setting up tracing", err)
+	}
+
 	// Create database object
-	mydb, err := SetupDB()
+	mydb, err := OpenDB(cfg.DBPath)
 	if err != nil {
-		log.Fatalln("[main] error setting up database:", err)
+		fatal("error setting up database", err)
 	}
 
 	// Print a nice message on the terminal
-	log.Println("[main] database initialized successfully")
+	slog.Info("database initialized successfully")
 
 	// Assign returned database client object to the global variable
 	db = mydb
@@ -679,29 +496,193 @@ func main() {
 	// Check that the databse is accessible through the global variable as well
 	err = db.Ping()
 	if err != nil {
-		log.Fatalln("[main] error pinging sqlite database:", err)
+		fatal("error pinging sqlite database", err)
+	}
+
+	// Set up OIDC authentication if an issuer is configured
+	auth, err = SetupAuth(ctx, cfg.OIDC)
+	if err != nil {
+		fatal("error setting up authentication", err)
 	}
+	if auth != nil {
+		slog.Info("OIDC authentication enabled")
+	}
+
+	// Set up multi-tenant mode if a tenant resolution mode is configured
+	tenants, err = SetupTenants(cfg.Tenant)
+	if err != nil {
+		fatal("error setting up tenants", err)
+	}
+	if tenants != nil {
+		slog.Info("multi-tenant mode enabled")
+	}
+
+	// Set up rate limiting of reads and writes
+	readLimiter, writeLimiter, ipLimiter = SetupRateLimit(cfg.RateLimit)
+	trustProxy = cfg.TrustProxy
+
+	// Register metrics that report on the database
+	err = SetupMetrics()
+	if err != nil {
+		fatal("error setting up metrics", err)
+	}
+
+	// Limit the size of request bodies and how long their queries can take
+	maxBodyBytes = cfg.Server.MaxBodyBytes
+	validateResponses = cfg.Server.ValidateResponses
+	requestTimeout = cfg.Server.RequestTimeout
+	queryTimeout = cfg.Server.QueryTimeout
+
+	// Keep recent changes for change feed clients that reconnect
+	hub = NewHub(cfg.Events.Replay)
+	eventHeartbeat = cfg.Events.Heartbeat
+
+	// Send webhooks from the outbox in the background until the server shuts down
+	webhooks = SetupWebhooks(cfg.Webhook)
+	workers.Go(ctx, "webhooks", webhooks.Run)
+
+	// Set up CORS for browser clients on other origins
+	cors = SetupCORS(cfg.CORS)
 
 	// Create HTTP router
 	router := SetupRouter()
 
-	// Get HTTP server port from environment
-	port := os.Getenv("TODO_PORT")
-	// If the environment variable is empty use port 8080
-	if port == "" {
-		port = "8080"
+	// Set up TLS if a certificate is configured
+	tlsConfig, err := SetupTLS(cfg.TLS)
+	if err != nil {
+		fatal("error setting up TLS", err)
 	}
 
-	// Create and configure HTTP server
+	// Open the socket before serving so that its real address can be reported
+	listener, err := Listen(ListenAddress(cfg), cfg.SocketMode)
+	if err != nil {
+		fatal("error opening listener", err)
+	}
+
+	// Create and configure HTTP server, slow clients can't hold on to connections forever
 	server := &http.Server{
-		Addr:              ":" + port, // Listen on all interfaces on the port defined above
 		Handler:           router,
-		ReadHeaderTimeout: 2 * time.Second, // Prevent slowloris attack
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+		MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+		TLSConfig:         tlsConfig,
 	}
 
+	// Servers that have to be shut down before exiting
+	servers := []*http.Server{server}
+	// Change feed streams only end when asked to, so end them when the server shuts down
+	server.RegisterOnShutdown(hub.Close)
+	// Errors of servers that stopped without being asked to
+	serverErr := make(chan error, 3)
+
 	// Print a nice message on the terminal
-	log.Println("[main] starting server at port 8080")
+	slog.Info("starting server", "network", listener.Addr().Network(), "address", listener.Addr().String(), "tls", tlsConfig != nil)
+
+	go func() {
+		// Plain HTTP is used unless TLS is configured
+		if tlsConfig == nil {
+			serverErr <- server.Serve(listener)
+			return
+		}
+		// Use the certificate from the TLS configuration
+		serverErr <- server.ServeTLS(listener, "", "")
+	}()
+
+	// Optionally send plain HTTP clients to the HTTPS server
+	if redirectPort := cfg.TLS.RedirectPort; tlsConfig != nil && redirectPort != "" {
+		// Behind a Unix socket the HTTPS port is up to the proxy in front, assume the default one
+		httpsPort := ListenPort(listener)
+		if httpsPort == "" {
+			httpsPort = "443"
+		}
+		redirectServer := &http.Server{
+			Addr:              ":" + redirectPort,
+			Handler:           RedirectToHTTPS(httpsPort),
+			ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+			ReadTimeout:       cfg.Server.ReadTimeout,
+			WriteTimeout:      cfg.Server.WriteTimeout,
+			IdleTimeout:       cfg.Server.IdleTimeout,
+			MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+		}
+		servers = append(servers, redirectServer)
+		go func() {
+			slog.Info("redirecting HTTP to HTTPS", "port", redirectPort)
+			serverErr <- redirectServer.ListenAndServe()
+		}()
+	}
+
+	// Optionally serve the gRPC API on its own socket
+	var grpcServer *grpc.Server
+	if cfg.GRPC.Listen != "" {
+		grpcListener, err := listenOn(cfg.GRPC.Listen, cfg.SocketMode)
+		if err != nil {
+			fatal("error opening gRPC listener", err)
+		}
+		grpcServer = SetupGRPC(tlsConfig)
+		go func() {
+			slog.Info("starting gRPC server", "network", grpcListener.Addr().Network(), "address", grpcListener.Addr().String(), "tls", tlsConfig != nil)
+			serverErr <- grpcServer.Serve(grpcListener)
+		}()
+	}
+
+	// Wait until we're asked to stop or a server fails to start
+	select {
+	case err := <-serverErr:
+		fatal("error starting server", err)
+	case <-ctx.Done():
+		// Restore default signal handling so a second Ctrl+C exits right away
+		stop()
+		// Fail readiness checks while draining
+		shuttingDown.Store(true)
+		slog.Info("shutting down, draining connections", "delay", cfg.ShutdownDelay, "timeout", cfg.ShutdownTimeout)
+	}
+
+	// Keep serving until load balancers have seen the failing readiness check and stopped sending new requests,
+	// a second signal exits right away
+	time.Sleep(cfg.ShutdownDelay)
+
+	// Everything below has to finish within the drain timeout
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// Stop accepting connections and wait for in-flight requests to finish
+	for _, s := range servers {
+		err := s.Shutdown(shutdownCtx)
+		if err != nil {
+			slog.Error("error shutting down server", "error", err)
+		}
+	}
+
+	// Change feed streams were ended with the HTTP server so only short calls are left
+	if grpcServer != nil {
+		StopGRPC(shutdownCtx, grpcServer)
+	}
+
+	// Background workers use ctx so they are already stopping, wait for them to finish
+	err = workers.Wait(shutdownCtx)
+	if err != nil {
+		slog.Error("error stopping background workers", "error", err)
+	}
+
+	// Nothing uses the databases anymore so write everything to disk and close them
+	if tenants != nil {
+		err = tenants.Close()
+		if err != nil {
+			slog.Error("error closing tenant databases", "error", err)
+		}
+	}
+	err = CloseDB(db)
+	if err != nil {
+		slog.Error("error closing database", "error", err)
+	}
+
+	// Send the spans that haven't been exported yet
+	err = shutdownTracing(shutdownCtx)
+	if err != nil {
+		slog.Error("error flushing traces", "error", err)
+	}
 
-	// Start the server and in case that fails print an error message
-	log.Fatalln("[main] error starting server:", server.ListenAndServe())
+	slog.Info("shutdown complete")
 }
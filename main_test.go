@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// Keep the output of the tests to their failures
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// setupTestDB points the global database at a new file for the duration of the test
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	mydb, err := OpenDB(filepath.Join(t.TempDir(), "todo.db"))
+	if err != nil {
+		t.Fatalf("error opening test database: %v", err)
+	}
+	previous := db
+	db = mydb
+	t.Cleanup(func() {
+		db = previous
+		_ = mydb.Close()
+	})
+}
+
+// setupTestServer serves the router on a local address with a new database and authentication by a local OIDC
+// provider that creates users on their first request, until the test ends
+func setupTestServer(t *testing.T) (*httptest.Server, *testIssuer) {
+	t.Helper()
+	setupTestDB(t)
+	issuer := setupTestAuth(t, true)
+	server := httptest.NewServer(SetupRouter())
+	t.Cleanup(server.Close)
+
+	// Give the test its own change feed, closing it ends streams that would keep the server from closing
+	previousHub := hub
+	hub = NewHub(100)
+	t.Cleanup(func() {
+		hub.Close()
+		hub = previousHub
+	})
+	return server, issuer
+}
+
+// testRequest sends a request with body encoded as JSON and the token of the subject, if any, and returns the
+// response with its body
+func testRequest(t *testing.T, server *httptest.Server, token, method, path string, body any) (*http.Response, []byte) {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("error encoding request body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, server.URL+path, reader)
+	if err != nil {
+		t.Fatalf("error creating request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("error reading response body: %v", err)
+	}
+	return res, data
+}
+
+// decodeTestJSON decodes the body of a response into v
+func decodeTestJSON(t *testing.T, data []byte, v any) {
+	t.Helper()
+	err := json.Unmarshal(data, v)
+	if err != nil {
+		t.Fatalf("error decoding %q: %v", data, err)
+	}
+}
+
+func TestOpenExistingDB(t *testing.T) {
+	dir := t.TempDir()
+
+	// A missing file isn't created
+	missing := filepath.Join(dir, "missing.db")
+	_, err := OpenExistingDB(missing)
+	if err == nil {
+		t.Fatal("opening a missing file succeeded")
+	}
+	if _, statErr := os.Stat(missing); !errors.Is(statErr, os.ErrNotExist) {
+		t.Fatalf("opening a missing file created it: %v", statErr)
+	}
+
+	// A file the server set up is opened
+	path := filepath.Join(dir, "todo.db")
+	mydb, err := OpenDB(path)
+	if err != nil {
+		t.Fatalf("error creating database: %v", err)
+	}
+	_ = mydb.Close()
+	existing, err := OpenExistingDB(path)
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+
+	// A file of another version of the server is refused instead of migrated
+	for _, version := range []int{len(migrations) - 1, len(migrations) + 1} {
+		_, err = existing.Exec(fmt.Sprintf(`PRAGMA user_version = %d;`, version))
+		if err != nil {
+			t.Fatalf("error changing schema version: %v", err)
+		}
+		other, err := OpenExistingDB(path)
+		if err == nil {
+			_ = other.Close()
+			t.Errorf("opening a database of schema version %d succeeded", version)
+		}
+	}
+	_ = existing.Close()
+}
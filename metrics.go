@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics exposed at /metrics in the Prometheus text format
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "todo_http_requests_total",
+		Help: "HTTP requests handled, by method, route pattern and status code.",
+	}, []string{"method", "route", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "todo_http_request_duration_seconds",
+		Help:    "Time taken to handle HTTP requests, by method, route pattern and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "code"})
+
+	storeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "todo_store_operation_duration_seconds",
+		Help:    "Time taken by database queries, by store operation and result.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation", "result"})
+)
+
+// statusRecorder remembers the status code and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+// WriteHeader records the status code before sending it
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the size of the body, a body without a header means status 200
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.size += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the original writer, for example to flush it
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Hijack hands the connection over for WebSocket upgrades, which check for http.Hijacker themselves
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(s.ResponseWriter).Hijack()
+	if err == nil && s.status == 0 {
+		s.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Metrics wraps the router so that every request is counted and timed by route pattern
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(recorder, r)
+
+		// The router stores the pattern that matched in the request, the path itself would make too many series
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		code := strconv.Itoa(recorder.status)
+
+		httpRequests.WithLabelValues(r.Method, route, code).Inc()
+		httpDuration.WithLabelValues(r.Method, route, code).Observe(time.Since(start).Seconds())
+	})
+}
+
+// ObserveQuery records how long a database query of a store operation took
+func ObserveQuery(operation string, start time.Time, err error) {
+	result := "ok"
+	// Not finding a row is an answer, not a failure
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		result = "error"
+	}
+	storeDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
+
+// todoCollector reports the amount of open and completed todo items each time metrics are scraped
+type todoCollector struct {
+	items *prometheus.Desc
+}
+
+// Describe sends the descriptions of the todo item metrics
+func (c *todoCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.items
+}
+
+// Collect counts the todo items in the global database and in every opened tenant database
+func (c *todoCollector) Collect(ch chan<- prometheus.Metric) {
+	// Don't let a slow database hold up the scrape
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	c.collect(ctx, ch, "", db)
+	if tenants != nil {
+		tenants.EachOpened(func(tenantID string, tenantDB *sql.DB) {
+			c.collect(ctx, ch, tenantID, tenantDB)
+		})
+	}
+}
+
+// collect counts the todo items in the database of a tenant
+func (c *todoCollector) collect(ctx context.Context, ch chan<- prometheus.Metric, tenantID string, tenantDB *sql.DB) {
+	var open, completed int
+	start := time.Now()
+	err := tenantDB.QueryRowContext(ctx, `SELECT count(*) FILTER (WHERE NOT done), count(*) FILTER (WHERE done) FROM todo;`).Scan(&open, &completed)
+	ObserveQuery("count_todos", start, err)
+	if err != nil {
+		slog.Error("error counting todo items", "tenant", tenantID, "error", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.items, prometheus.GaugeValue, float64(open), "open", tenantID)
+	ch <- prometheus.MustNewConstMetric(c.items, prometheus.GaugeValue, float64(completed), "completed", tenantID)
+}
+
+// SetupMetrics registers the metrics that need the database
+func SetupMetrics() error {
+	// Connection pool gauges of the global database, tenant databases are registered when opened
+	err := prometheus.Register(collectors.NewDBStatsCollector(db, "todo"))
+	if err != nil {
+		return err
+	}
+	return prometheus.Register(&todoCollector{
+		items: prometheus.NewDesc("todo_items", "Todo items in the database, by state and tenant.", []string{"state", "tenant"}, nil),
+	})
+}
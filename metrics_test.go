@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsRoutes(t *testing.T) {
+	server, issuer := setupTestServer(t)
+	token := issuer.token(t, issuer.key, "alice", nil)
+	res, body := testRequest(t, server, token, http.MethodPost, "/todo", map[string]any{"description": "milk"})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("creating todo item: %d %s", res.StatusCode, body)
+	}
+
+	// Requests are counted by the pattern of their route, not their path
+	tests := []struct {
+		method string
+		path   string
+		route  string
+		code   string
+	}{
+		{http.MethodGet, "/todo/1", "GET /todo/{todo_id}", "200"},
+		{http.MethodGet, "/todo/2", "GET /todo/{todo_id}", "404"},
+		{http.MethodDelete, "/todo/1", "DELETE /todo/{todo_id}", "204"},
+		{http.MethodPatch, "/todo/1", "unmatched", "405"},
+	}
+	for _, test := range tests {
+		counter := httpRequests.WithLabelValues(test.method, test.route, test.code)
+		before := testutil.ToFloat64(counter)
+		testRequest(t, server, token, test.method, test.path, nil)
+		if got := testutil.ToFloat64(counter) - before; got != 1 {
+			t.Errorf("%s %s: counted %v requests of %s with code %s, want 1", test.method, test.path, got, test.route, test.code)
+		}
+	}
+
+	// Paths with IDs don't become labels of their own
+	_, body = testRequest(t, server, "", http.MethodGet, "/metrics", nil)
+	if !strings.Contains(string(body), `route="GET /todo/{todo_id}"`) || strings.Contains(string(body), `/todo/1"`) {
+		t.Errorf("metrics don't label requests by route pattern:\n%s", body)
+	}
+}
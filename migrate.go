@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Schema changes applied in order on top of the tables created in SetupDB.
+// The number of applied migrations is stored in PRAGMA user_version so only add to the end of this list.
+var migrations = []string{
+	// 1: lists owned by users, shared with other users through roles or invitations
+	`CREATE TABLE list (
+		id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		owner_id INTEGER NOT NULL REFERENCES user(id),
+		PRIMARY KEY (id AUTOINCREMENT)
+	);
+	ALTER TABLE todo ADD COLUMN list_id INTEGER REFERENCES list(id);
+	CREATE TABLE share (
+		list_id INTEGER NOT NULL REFERENCES list(id),
+		user_id INTEGER NOT NULL REFERENCES user(id),
+		role TEXT NOT NULL CHECK(role IN ('viewer', 'editor', 'admin')),
+		PRIMARY KEY (list_id, user_id)
+	);
+	CREATE TABLE invitation (
+		token TEXT NOT NULL,
+		list_id INTEGER NOT NULL REFERENCES list(id),
+		role TEXT NOT NULL CHECK(role IN ('viewer', 'editor', 'admin')),
+		created_by INTEGER NOT NULL REFERENCES user(id),
+		accepted_by INTEGER REFERENCES user(id),
+		PRIMARY KEY (token)
+	);`,
+	// 2: webhooks and the outbox of their deliveries, written in the same transaction as the change
+	`CREATE TABLE webhook (
+		id INTEGER NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT NOT NULL DEFAULT(''),
+		list_id INTEGER REFERENCES list(id),
+		owner_id INTEGER REFERENCES user(id),
+		PRIMARY KEY (id AUTOINCREMENT)
+	);
+	CREATE TABLE webhook_delivery (
+		id INTEGER NOT NULL,
+		webhook_id INTEGER NOT NULL REFERENCES webhook(id),
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL CHECK(status IN ('pending', 'delivered', 'dead')),
+		attempts INTEGER NOT NULL DEFAULT(0),
+		last_status_code INTEGER,
+		last_error TEXT NOT NULL DEFAULT(''),
+		created_at INTEGER NOT NULL,
+		next_attempt_at INTEGER NOT NULL,
+		PRIMARY KEY (id AUTOINCREMENT)
+	);
+	CREATE INDEX webhook_delivery_due ON webhook_delivery (status, next_attempt_at);
+	CREATE INDEX webhook_delivery_webhook ON webhook_delivery (webhook_id, id);`,
+	// 3: tags shared by the todo items of a tenant
+	`CREATE TABLE tag (
+		id INTEGER NOT NULL,
+		name TEXT NOT NULL UNIQUE,
+		PRIMARY KEY (id AUTOINCREMENT)
+	);
+	CREATE TABLE todo_tag (
+		todo_id INTEGER NOT NULL REFERENCES todo(id),
+		tag_id INTEGER NOT NULL REFERENCES tag(id),
+		PRIMARY KEY (todo_id, tag_id)
+	);
+	CREATE INDEX todo_tag_tag ON todo_tag (tag_id);`,
+}
+
+// SchemaVersion returns the amount of migrations that have been applied to the database
+func SchemaVersion(ctx context.Context, sqlite *sql.DB) (int, error) {
+	var version int
+	err := sqlite.QueryRowContext(ctx, `PRAGMA user_version;`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("[SchemaVersion] error getting schema version: %w", err)
+	}
+	return version, nil
+}
+
+// MigrateDB applies the migrations the database hasn't seen yet
+func MigrateDB(sqlite *sql.DB) error {
+	// Get the amount of migrations that have already been applied
+	version, err := SchemaVersion(context.Background(), sqlite)
+	if err != nil {
+		return fmt.Errorf("[MigrateDB] error checking database: %w", err)
+	}
+
+	// Apply each remaining migration in its own transaction together with the version bump
+	for i := version; i < len(migrations); i++ {
+		tx, err := sqlite.Begin()
+		if err != nil {
+			return fmt.Errorf("[MigrateDB] error starting transaction: %w", err)
+		}
+
+		// Another process opening the same file may have applied it in the meantime, which can't change anymore
+		// now that the transaction holds the write lock
+		var current int
+		err = tx.QueryRow(`PRAGMA user_version;`).Scan(&current)
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("[MigrateDB] error checking schema version: %w", err)
+		}
+		if current > i {
+			_ = tx.Rollback()
+			i = current - 1
+			continue
+		}
+
+		_, err = tx.Exec(migrations[i])
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("[MigrateDB] error applying migration %d: %w", i+1, err)
+		}
+
+		// PRAGMA doesn't accept placeholders but the value is always an integer we control
+		_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d;`, i+1))
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("[MigrateDB] error setting schema version: %w", err)
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("[MigrateDB] error committing migration %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/routers"
+	"gopkg.in/yaml.v3"
+)
+
+// OpenAPI document of every route of the router, served as JSON
+//
+//go:embed openapi.yaml
+var openapiYAML []byte
+
+// Page rendering the OpenAPI document, it only needs the server so it works without internet access
+//
+//go:embed docs.html
+var docsHTML []byte
+
+// Parsed OpenAPI document and the same document as JSON
+var openapiSpec, openapiJSON = loadOpenAPI()
+
+// loadOpenAPI parses the embedded OpenAPI document, which can only fail when it was edited wrongly
+func loadOpenAPI() (*openapi3.T, []byte) {
+	spec, err := openapi3.NewLoader().LoadFromData(openapiYAML)
+	if err != nil {
+		panic("[loadOpenAPI] error parsing openapi.yaml: " + err.Error())
+	}
+	var doc any
+	err = yaml.Unmarshal(openapiYAML, &doc)
+	if err != nil {
+		panic("[loadOpenAPI] error parsing openapi.yaml: " + err.Error())
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		panic("[loadOpenAPI] error converting openapi.yaml to JSON: " + err.Error())
+	}
+	return spec, data
+}
+
+// openapiRoute returns the operation of a route pattern like "GET /todo/{todo_id}", nil if it isn't documented
+func openapiRoute(pattern string) *routers.Route {
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok {
+		return nil
+	}
+	pathItem := openapiSpec.Paths.Value(path)
+	if pathItem == nil {
+		return nil
+	}
+	operation := pathItem.GetOperation(method)
+	if operation == nil {
+		return nil
+	}
+	return &routers.Route{Spec: openapiSpec, Path: path, PathItem: pathItem, Method: method, Operation: operation}
+}
+
+// documentedMux is a router that keeps track of its patterns, so that a test can make sure every route is documented
+type documentedMux struct {
+	*http.ServeMux
+	patterns []string
+}
+
+// Handle registers the handler for a pattern, which should be in the OpenAPI document
+func (m *documentedMux) Handle(pattern string, handler http.Handler) {
+	m.patterns = append(m.patterns, pattern)
+	m.ServeMux.Handle(pattern, handler)
+}
+
+// HandleFunc registers the handler function for a pattern, which should be in the OpenAPI document
+func (m *documentedMux) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	m.Handle(pattern, http.HandlerFunc(handler))
+}
+
+// HTTP handler for the OpenAPI document
+func OpenAPI(w http.ResponseWriter, r *http.Request) {
+	// Tell the client that we are going to return JSON
+	w.Header().Add("Content-Type", "application/json")
+	// Tell the client that the status of the request is 200
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(openapiJSON)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error writing to client", "error", err)
+	}
+}
+
+// HTTP handler for the interactive documentation page
+func Docs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	// Tell the client that the status of the request is 200
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(docsHTML)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error writing to client", "error", err)
+	}
+}
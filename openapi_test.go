@@ -0,0 +1,34 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRoutesDocumented(t *testing.T) {
+	router := newRouter()
+
+	// Every route of the router is described in openapi.yaml
+	for _, pattern := range router.patterns {
+		if openapiRoute(pattern) == nil {
+			t.Errorf("route %s is missing from openapi.yaml", pattern)
+		}
+	}
+
+	// Every operation in openapi.yaml is served by the router
+	for path, pathItem := range openapiSpec.Paths.Map() {
+		for method := range pathItem.Operations() {
+			pattern := method + " " + path
+			if !slices.Contains(router.patterns, pattern) {
+				t.Errorf("openapi.yaml describes %s which the router doesn't have", pattern)
+			}
+		}
+	}
+
+	// Streams are exempt from the request timeout by their route
+	for pattern := range streamRoutes {
+		if !slices.Contains(router.patterns, pattern) {
+			t.Errorf("stream route %s isn't a route of the router", pattern)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bucket is the token bucket of a single client
+type bucket struct {
+	tokens float64
+	last   time.Time // when tokens was last refilled
+}
+
+// RateLimiter hands out tokens from one bucket per client, refilling them at a fixed rate
+type RateLimiter struct {
+	rate  float64 // tokens added per second
+	burst float64 // maximum amount of tokens in a bucket
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewRateLimiter creates a rate limiter, a rate of 0 or less means it allows everything
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	// A bucket must fit at least one request
+	if burst < 1 {
+		burst = max(1, int(math.Ceil(rate)))
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*bucket{},
+	}
+}
+
+// Allow takes a token from the bucket of a client. It returns whether that worked, the tokens
+// left and how long until the next token is available when it didn't.
+func (l *RateLimiter) Allow(key string, now time.Time) (bool, int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Forget buckets that have been idle long enough to be full again, they're the same as new ones
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.lastSweep) > full {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > full {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	// Add the tokens earned since the last request
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, 0, wait
+	}
+
+	b.tokens--
+	return true, int(b.tokens), 0
+}
+
+// Reset returns how long until the bucket of a client is full again
+func (l *RateLimiter) Reset(remaining int) time.Duration {
+	return time.Duration((l.burst - float64(remaining)) / l.rate * float64(time.Second))
+}
+
+// Rate limiters of each route class, nil when the class isn't limited
+var (
+	readLimiter  *RateLimiter
+	writeLimiter *RateLimiter
+)
+
+// Rate limiter of requests by IP address before they are authenticated, nil when they aren't limited
+var ipLimiter *RateLimiter
+
+// Whether the X-Forwarded-For header set by a reverse proxy can be used to find the client IP
+var trustProxy bool
+
+// SetupRateLimit creates the rate limiters of reads, writes and IP addresses, nil for those that aren't limited
+func SetupRateLimit(options RateLimitOptions) (*RateLimiter, *RateLimiter, *RateLimiter) {
+	var reads, writes, ips *RateLimiter
+	if options.Reads > 0 {
+		reads = NewRateLimiter(options.Reads, options.ReadsBurst)
+	}
+	if options.Writes > 0 {
+		writes = NewRateLimiter(options.Writes, options.WritesBurst)
+	}
+	if options.IP > 0 {
+		ips = NewRateLimiter(options.IP, options.IPBurst)
+	}
+	return reads, writes, ips
+}
+
+// ClientIP returns the IP address the request came from
+func ClientIP(r *http.Request) string {
+	// The proxy appends the address it got the request from, so the last entry is the one it saw
+	if trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			entries := strings.Split(forwarded, ",")
+			return strings.TrimSpace(entries[len(entries)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RateLimit wraps an HTTP handler so that each client can only make a limited amount of requests.
+// Clients are told apart by their user when authenticated and by their IP address otherwise.
+func RateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Reads and writes are limited separately
+		limiter := writeLimiter
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || isGraphQL(r) {
+			// GraphQL mutations use the write limit on their own
+			limiter = readLimiter
+		}
+		// If the route class is not limited let every request through
+		if limiter == nil {
+			next(w, r)
+			return
+		}
+
+		allowed, remaining, wait := limiter.Allow(rateLimitKey(r), time.Now())
+
+		// Tell the client about its limit, see draft-ietf-httpapi-ratelimit-headers
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(int(limiter.burst)))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(limiter.Reset(remaining).Seconds()))))
+
+		if !allowed {
+			// Tell the client when it can try again
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			// Return the JSON-encoded error message
+			WriteHTTPError(w, r, "Rate limit exceeded, try again later", http.StatusTooManyRequests, "Too Many Requests")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// LimitIP wraps an HTTP handler so that each IP address can only make a limited amount of requests, before
+// verifying their token or opening a tenant database costs anything
+func LimitIP(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ipLimiter == nil {
+			next(w, r)
+			return
+		}
+
+		allowed, _, wait := ipLimiter.Allow(ClientIP(r), time.Now())
+		if !allowed {
+			// Tell the client when it can try again
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			// Return the JSON-encoded error message
+			WriteHTTPError(w, r, "Rate limit exceeded, try again later", http.StatusTooManyRequests, "Too Many Requests")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// AllowWrite applies the write rate limit to a change made within a request that was only limited as a read
+func AllowWrite(r *http.Request) error {
+	if writeLimiter == nil {
+		return nil
+	}
+	allowed, _, wait := writeLimiter.Allow(rateLimitKey(r), time.Now())
+	if !allowed {
+		return NewHTTPError("Rate limit exceeded, try again in "+strconv.Itoa(int(math.Ceil(wait.Seconds())))+" seconds",
+			http.StatusTooManyRequests, "Too Many Requests")
+	}
+	return nil
+}
+
+// rateLimitKey returns who is making the request, users of different tenants can have the same ID
+func rateLimitKey(r *http.Request) string {
+	if user, ok := UserFromContext(r.Context()); ok {
+		tenantID, _ := r.Context().Value(tenantIDContextKey).(string)
+		return "user:" + tenantID + ":" + strconv.FormatInt(user.ID, 10)
+	}
+	return "ip:" + ClientIP(r)
+}
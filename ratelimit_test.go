@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/insanitywholesale/go-todo/todopb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// setupTestRateLimit replaces the rate limiters for the duration of the test, refilling so slowly that they don't
+// during it
+func setupTestRateLimit(t *testing.T, reads, writes, ips int) {
+	t.Helper()
+	previousReads, previousWrites, previousIPs := readLimiter, writeLimiter, ipLimiter
+	readLimiter, writeLimiter, ipLimiter = nil, nil, nil
+	if reads > 0 {
+		readLimiter = NewRateLimiter(0.001, reads)
+	}
+	if writes > 0 {
+		writeLimiter = NewRateLimiter(0.001, writes)
+	}
+	if ips > 0 {
+		ipLimiter = NewRateLimiter(0.001, ips)
+	}
+	t.Cleanup(func() { readLimiter, writeLimiter, ipLimiter = previousReads, previousWrites, previousIPs })
+}
+
+func TestRateLimit(t *testing.T) {
+	server, issuer := setupTestServer(t)
+	setupTestRateLimit(t, 2, 1, 0)
+	alice := issuer.token(t, issuer.key, "alice", nil)
+	bob := issuer.token(t, issuer.key, "bob", nil)
+
+	tests := []struct {
+		name      string
+		token     string
+		method    string
+		path      string
+		body      any
+		status    int
+		limit     string
+		remaining string
+	}{
+		{"first read", alice, http.MethodGet, "/todos", nil, http.StatusOK, "2", "1"},
+		{"second read", alice, http.MethodGet, "/todos", nil, http.StatusOK, "2", "0"},
+		{"read over the limit", alice, http.MethodGet, "/todos", nil, http.StatusTooManyRequests, "2", "0"},
+		// Writes have a bucket of their own
+		{"first write", alice, http.MethodPost, "/todo", map[string]any{"description": "milk"}, http.StatusOK, "1", "0"},
+		{"write over the limit", alice, http.MethodPost, "/todo", map[string]any{"description": "bread"}, http.StatusTooManyRequests, "1", "0"},
+		// Every user has buckets of their own
+		{"read of another user", bob, http.MethodGet, "/todos", nil, http.StatusOK, "2", "1"},
+		{"write of another user", bob, http.MethodPost, "/todo", map[string]any{"description": "eggs"}, http.StatusOK, "1", "0"},
+	}
+	for _, test := range tests {
+		res, body := testRequest(t, server, test.token, test.method, test.path, test.body)
+		if res.StatusCode != test.status {
+			t.Fatalf("%s: got status %d, want %d: %s", test.name, res.StatusCode, test.status, body)
+		}
+		if res.Header.Get("RateLimit-Limit") != test.limit || res.Header.Get("RateLimit-Remaining") != test.remaining {
+			t.Errorf("%s: got RateLimit-Limit %q and RateLimit-Remaining %q, want %s and %s", test.name,
+				res.Header.Get("RateLimit-Limit"), res.Header.Get("RateLimit-Remaining"), test.limit, test.remaining)
+		}
+		if reset, err := strconv.Atoi(res.Header.Get("RateLimit-Reset")); err != nil || reset <= 0 {
+			t.Errorf("%s: got RateLimit-Reset %q", test.name, res.Header.Get("RateLimit-Reset"))
+		}
+
+		// Refused requests are told when to try again
+		if test.status == http.StatusTooManyRequests {
+			if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err != nil || seconds <= 0 {
+				t.Errorf("%s: got Retry-After %q", test.name, res.Header.Get("Retry-After"))
+			}
+		}
+	}
+}
+
+func TestLimitIPBeforeAuth(t *testing.T) {
+	server, _ := setupTestServer(t)
+	setupTestRateLimit(t, 0, 0, 2)
+
+	// Requests with bad tokens use up the limit of the address before their tokens are looked at
+	for i, status := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		res, body := testRequest(t, server, "not-a-token", http.MethodGet, "/todos", nil)
+		if res.StatusCode != status {
+			t.Fatalf("request %d: got status %d, want %d: %s", i, res.StatusCode, status, body)
+		}
+	}
+}
+
+func TestLimitIPGRPC(t *testing.T) {
+	setupTestDB(t)
+	setupTestAuth(t, true)
+	setupTestRateLimit(t, 0, 0, 2)
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}})
+
+	// Calls without a token use up the limit of the address like requests do
+	for i, code := range []codes.Code{codes.Unauthenticated, codes.Unauthenticated, codes.ResourceExhausted} {
+		_, err := grpcCall(ctx, todopb.TodoService_List_FullMethodName, func(ctx context.Context) error {
+			t.Fatal("call was handled without a token")
+			return nil
+		})
+		if status.Code(err) != code {
+			t.Fatalf("call %d: got %v, want %s", i, err, code)
+		}
+	}
+}
@@ -0,0 +1,640 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Role is the permission level a user has on a list
+type Role string
+
+// Roles from least to most privileged, the owner of a list always has every permission
+const (
+	RoleViewer Role = "viewer" // can read todo items
+	RoleEditor Role = "editor" // can also create, update and delete todo items
+	RoleAdmin  Role = "admin"  // can also manage shares and invitations
+	RoleOwner  Role = "owner"  // created the list
+)
+
+// rank returns how privileged a role is, unknown roles have no privileges
+func (r Role) rank() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleEditor:
+		return 2
+	case RoleAdmin:
+		return 3
+	case RoleOwner:
+		return 4
+	default:
+		return 0
+	}
+}
+
+// Grantable reports whether the role can be given to another user through a share
+func (r Role) Grantable() bool {
+	return r == RoleViewer || r == RoleEditor || r == RoleAdmin
+}
+
+// List is a collection of todo items that can be shared with other users
+type List struct {
+	ID      int64  `json:"id"`
+	Name    string `json:"name"`
+	OwnerID int64  `json:"owner_id"`
+	Role    Role   `json:"role"` // role of the user making the request
+}
+
+// Share gives a user a role on a list
+type Share struct {
+	ListID int64 `json:"list_id"`
+	UserID int64 `json:"user_id"`
+	Role   Role  `json:"role"`
+}
+
+// Invitation lets whoever holds the token join a list with a role
+type Invitation struct {
+	Token  string `json:"token"`
+	ListID int64  `json:"list_id"`
+	Role   Role   `json:"role"`
+}
+
+// ListRole returns the role a user has on a list, an empty role means no access
+func ListRole(ctx context.Context, userID, listID int64) (Role, error) {
+	var ownerID int64
+	var role sql.NullString
+
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(ctx)
+	defer cancel()
+	// Get the owner of the list together with the share of the user, if any
+	start := time.Now()
+	row := DBFromContext(ctx).QueryRowContext(queryCtx, `SELECT list.owner_id, share.role FROM list
+		LEFT JOIN share ON share.list_id = list.id AND share.user_id = ?
+		WHERE list.id = ?;`, userID, listID)
+	err := row.Scan(&ownerID, &role)
+	ObserveQuery("get_list_role", start, err)
+	if err != nil {
+		// A list that doesn't exist is the same as one the user can't access
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	if ownerID == userID {
+		return RoleOwner, nil
+	}
+	return Role(role.String), nil
+}
+
+// ListAccess makes sure the user of the context has at least the needed role on the list.
+// Todo items without a list are accessible to everyone and so is every list when authentication is disabled.
+func ListAccess(ctx context.Context, listID *int64, need Role) error {
+	user, ok := UserFromContext(ctx)
+	if listID == nil || !ok {
+		return nil
+	}
+
+	role, err := ListRole(ctx, user.ID, *listID)
+	if err != nil {
+		return err
+	}
+
+	// Users without any role shouldn't learn that the list exists
+	if role == "" {
+		return NewHTTPError("No list with id "+strconv.FormatInt(*listID, 10)+" exists", http.StatusNotFound, "Not Found")
+	}
+
+	if role.rank() < need.rank() {
+		return NewHTTPError("Role "+string(role)+" on list "+strconv.FormatInt(*listID, 10)+" is not allowed to do this", http.StatusForbidden, "Forbidden")
+	}
+
+	return nil
+}
+
+// checkListAccess makes sure the user of the request has at least the needed role on the list
+// and responds with an error if not
+func checkListAccess(w http.ResponseWriter, r *http.Request, listID *int64, need Role) bool {
+	err := ListAccess(r.Context(), listID, need)
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return false
+	}
+	return true
+}
+
+// requireUser returns the user of the request and responds with an error if there is none
+func requireUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		// Return the JSON-encoded error message
+		WriteHTTPError(w, r, "Lists need authentication to be enabled", http.StatusNotFound, "Not Found")
+		return nil, false
+	}
+	return user, true
+}
+
+// parseIDParam gets a numeric URL parameter and responds with an error if it's missing or invalid
+func parseIDParam(w http.ResponseWriter, r *http.Request, name string) (int64, bool) {
+	fromURL := r.PathValue(name)
+	if fromURL == "" {
+		// Return the JSON-encoded error message
+		WriteHTTPError(w, r, "Parameter "+name+" is empty", http.StatusBadRequest, "Bad Request")
+		return 0, false
+	}
+
+	id, err := strconv.ParseInt(fromURL, 10, 64)
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteHTTPError(w, r, "Parameter "+name+" is not a number", http.StatusBadRequest, "Bad Request")
+		return 0, false
+	}
+
+	return id, true
+}
+
+// HTTP handler for creating a list owned by the authenticated user
+func CreateList(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	// List from the request body
+	var list List
+
+	// Map list from request body to variable
+	err := json.NewDecoder(r.Body).Decode(&list)
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteBodyError(w, r, err)
+		return
+	}
+
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(r.Context())
+	defer cancel()
+	// Save list in database and return generated id
+	start := time.Now()
+	res, err := DBFromContext(r.Context()).ExecContext(queryCtx, `INSERT INTO list (name, owner_id) VALUES (?, ?);`, list.Name, user.ID)
+	ObserveQuery("create_list", start, err)
+	if err == nil {
+		list.ID, err = res.LastInsertId()
+	}
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return
+	}
+
+	list.OwnerID = user.ID
+	list.Role = RoleOwner
+
+	// Tell the client that we are going to return JSON
+	w.Header().Add("Content-Type", "application/json")
+	// Tell the client that the status of the request is 200
+	w.WriteHeader(http.StatusOK)
+	// Return the JSON-encoded new list
+	err = json.NewEncoder(w).Encode(list)
+	if err != nil {
+		// Log encoding error for debugging
+		slog.ErrorContext(r.Context(), "error encoding list", "error", err)
+	}
+}
+
+// HTTP handler for getting all lists the authenticated user owns or has been shared
+func ReadLists(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	// Get owned lists together with the ones shared with the user
+	lists, err := UserLists(r.Context(), user.ID)
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return
+	}
+
+	// Tell the client that we are going to return JSON
+	w.Header().Add("Content-Type", "application/json")
+	// Tell the client that the status of the request is 200
+	w.WriteHeader(http.StatusOK)
+	// Return the JSON-encoded list of lists
+	err = json.NewEncoder(w).Encode(lists)
+	if err != nil {
+		// Log encoding error for debugging
+		slog.ErrorContext(r.Context(), "error encoding lists", "error", err)
+	}
+}
+
+// UserLists returns the lists a user owns together with the ones shared with them
+func UserLists(ctx context.Context, userID int64) ([]*List, error) {
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	rows, err := DBFromContext(ctx).QueryContext(queryCtx, `SELECT id, name, owner_id, 'owner' FROM list WHERE owner_id = ?
+		UNION ALL
+		SELECT list.id, list.name, list.owner_id, share.role FROM list
+		JOIN share ON share.list_id = list.id WHERE share.user_id = ?;`, userID, userID)
+	ObserveQuery("list_lists", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Return an empty array instead of null when there are no lists
+	lists := []*List{}
+	for rows.Next() {
+		var list List
+		err = rows.Scan(&list.ID, &list.Name, &list.OwnerID, &list.Role)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, &list)
+	}
+	return lists, rows.Err()
+}
+
+// ListsByID returns those of the lists the user of the context has access to, with the role of the user on them
+func ListsByID(ctx context.Context, ids []int64) (map[int64]*List, error) {
+	lists := map[int64]*List{}
+	if len(ids) == 0 {
+		return lists, nil
+	}
+	var args []any
+	query := `SELECT id, name, owner_id, 'owner' FROM list WHERE id IN (` + placeholders(len(ids)) + `);`
+	if user, ok := UserFromContext(ctx); ok {
+		query = `SELECT list.id, list.name, list.owner_id, CASE WHEN list.owner_id = ? THEN 'owner' ELSE share.role END FROM list
+			LEFT JOIN share ON share.list_id = list.id AND share.user_id = ?
+			WHERE (list.owner_id = ? OR share.role IS NOT NULL) AND list.id IN (` + placeholders(len(ids)) + `);`
+		args = append(args, user.ID, user.ID, user.ID)
+	}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	rows, err := DBFromContext(ctx).QueryContext(queryCtx, query, args...)
+	ObserveQuery("get_lists", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var list List
+		err = rows.Scan(&list.ID, &list.Name, &list.OwnerID, &list.Role)
+		if err != nil {
+			return nil, err
+		}
+		lists[list.ID] = &list
+	}
+	return lists, rows.Err()
+}
+
+// HTTP handler for getting the shares of a list
+func ReadShares(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireUser(w, r); !ok {
+		return
+	}
+	listID, ok := parseIDParam(w, r, "list_id")
+	if !ok {
+		return
+	}
+	if !checkListAccess(w, r, &listID, RoleAdmin) {
+		return
+	}
+
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(r.Context())
+	defer cancel()
+	// Get all users the list is shared with
+	start := time.Now()
+	rows, err := DBFromContext(r.Context()).QueryContext(queryCtx, `SELECT list_id, user_id, role FROM share WHERE list_id = ?;`, listID)
+	ObserveQuery("list_shares", start, err)
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	// Return an empty array instead of null when there are no shares
+	shares := []*Share{}
+	for rows.Next() {
+		var share Share
+		err = rows.Scan(&share.ListID, &share.UserID, &share.Role)
+		if err != nil {
+			break
+		}
+		shares = append(shares, &share)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return
+	}
+
+	// Tell the client that we are going to return JSON
+	w.Header().Add("Content-Type", "application/json")
+	// Tell the client that the status of the request is 200
+	w.WriteHeader(http.StatusOK)
+	// Return the JSON-encoded list of shares
+	err = json.NewEncoder(w).Encode(shares)
+	if err != nil {
+		// Log encoding error for debugging
+		slog.ErrorContext(r.Context(), "error encoding shares", "error", err)
+	}
+}
+
+// HTTP handler for giving a user a role on a list or changing it
+func UpdateShare(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireUser(w, r); !ok {
+		return
+	}
+	listID, ok := parseIDParam(w, r, "list_id")
+	if !ok {
+		return
+	}
+	userID, ok := parseIDParam(w, r, "user_id")
+	if !ok {
+		return
+	}
+	if !checkListAccess(w, r, &listID, RoleAdmin) {
+		return
+	}
+
+	// Share from the request body
+	var share Share
+
+	// Map share from request body to variable
+	err := json.NewDecoder(r.Body).Decode(&share)
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteBodyError(w, r, err)
+		return
+	}
+	if !share.Role.Grantable() {
+		// Return the JSON-encoded error message
+		WriteHTTPError(w, r, "Role must be one of viewer, editor or admin", http.StatusBadRequest, "Bad Request")
+		return
+	}
+	// Set its IDs equal to the URL path variables
+	share.ListID = listID
+	share.UserID = userID
+
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(r.Context())
+	defer cancel()
+	err = inTx(queryCtx, func(tx *sql.Tx) error {
+		// Only users that exist can be given a share
+		var exists bool
+		start := time.Now()
+		err := tx.QueryRowContext(queryCtx, `SELECT EXISTS (SELECT 1 FROM user WHERE id = ?);`, userID).Scan(&exists)
+		ObserveQuery("get_user", start, err)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return NewHTTPError("No user with id "+strconv.FormatInt(userID, 10)+" exists", http.StatusNotFound, "Not Found")
+		}
+
+		// The owner always keeps full access so it can't be given a share
+		role, err := ListRole(r.Context(), userID, listID)
+		if err != nil {
+			return err
+		}
+		if role == RoleOwner {
+			return NewHTTPError("The owner of a list can't be given a share", http.StatusBadRequest, "Bad Request")
+		}
+
+		// Create the share or replace the role of an existing one
+		start = time.Now()
+		_, err = tx.ExecContext(queryCtx, `INSERT INTO share (list_id, user_id, role) VALUES (?, ?, ?)
+			ON CONFLICT (list_id, user_id) DO UPDATE SET role = excluded.role;`,
+			share.ListID,
+			share.UserID,
+			share.Role,
+		)
+		ObserveQuery("upsert_share", start, err)
+		return err
+	})
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return
+	}
+
+	// Tell the client that we are going to return JSON
+	w.Header().Add("Content-Type", "application/json")
+	// Tell the client that the status of the request is 200
+	w.WriteHeader(http.StatusOK)
+	// Return the JSON-encoded share
+	err = json.NewEncoder(w).Encode(share)
+	if err != nil {
+		// Log encoding error for debugging
+		slog.ErrorContext(r.Context(), "error encoding share", "error", err)
+	}
+}
+
+// HTTP handler for removing a user from a list
+func DeleteShare(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	listID, ok := parseIDParam(w, r, "list_id")
+	if !ok {
+		return
+	}
+	userID, ok := parseIDParam(w, r, "user_id")
+	if !ok {
+		return
+	}
+	// Users can always leave a list, removing others needs admin
+	need := RoleAdmin
+	if userID == user.ID {
+		need = RoleViewer
+	}
+	if !checkListAccess(w, r, &listID, need) {
+		return
+	}
+
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(r.Context())
+	defer cancel()
+	// Delete share from database
+	start := time.Now()
+	res, err := DBFromContext(r.Context()).ExecContext(queryCtx, `DELETE FROM share WHERE list_id = ? AND user_id = ?;`, listID, userID)
+	ObserveQuery("delete_share", start, err)
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err == nil && rowsAffected == 0 {
+		err = NewHTTPError("List "+strconv.FormatInt(listID, 10)+" is not shared with user "+strconv.FormatInt(userID, 10), http.StatusNotFound, "Not Found")
+	}
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return
+	}
+
+	// Tell the client that the status of the request is 204
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HTTP handler for creating an invitation to a list
+func CreateInvitation(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	listID, ok := parseIDParam(w, r, "list_id")
+	if !ok {
+		return
+	}
+	if !checkListAccess(w, r, &listID, RoleAdmin) {
+		return
+	}
+
+	// Invitation from the request body
+	var invitation Invitation
+
+	// Map invitation from request body to variable
+	err := json.NewDecoder(r.Body).Decode(&invitation)
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteBodyError(w, r, err)
+		return
+	}
+	if !invitation.Role.Grantable() {
+		// Return the JSON-encoded error message
+		WriteHTTPError(w, r, "Role must be one of viewer, editor or admin", http.StatusBadRequest, "Bad Request")
+		return
+	}
+	invitation.ListID = listID
+
+	// Generate a random token that can't be guessed
+	token := make([]byte, 16)
+	_, err = rand.Read(token)
+	if err == nil {
+		invitation.Token = hex.EncodeToString(token)
+		// Stop the query once it takes longer than the query timeout
+		queryCtx, cancel := WithQueryTimeout(r.Context())
+		defer cancel()
+		// Save invitation in database
+		start := time.Now()
+		_, err = DBFromContext(r.Context()).ExecContext(queryCtx, `INSERT INTO invitation (token, list_id, role, created_by) VALUES (?, ?, ?, ?);`,
+			invitation.Token,
+			invitation.ListID,
+			invitation.Role,
+			user.ID,
+		)
+		ObserveQuery("create_invitation", start, err)
+	}
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return
+	}
+
+	// Tell the client that we are going to return JSON
+	w.Header().Add("Content-Type", "application/json")
+	// Tell the client that the status of the request is 200
+	w.WriteHeader(http.StatusOK)
+	// Return the JSON-encoded invitation
+	err = json.NewEncoder(w).Encode(invitation)
+	if err != nil {
+		// Log encoding error for debugging
+		slog.ErrorContext(r.Context(), "error encoding invitation", "error", err)
+	}
+}
+
+// HTTP handler for accepting an invitation, which shares the list with the authenticated user
+func AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	var invitation Invitation
+	var share Share
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(r.Context())
+	defer cancel()
+	// The invitation is only used up together with the share it grants
+	err := inTx(queryCtx, func(tx *sql.Tx) error {
+		// Mark the invitation as used and get its details in one step so it can't be accepted twice
+		start := time.Now()
+		row := tx.QueryRowContext(queryCtx, `UPDATE invitation SET accepted_by = ?
+			WHERE token = ? AND accepted_by IS NULL RETURNING token, list_id, role;`, user.ID, r.PathValue("token"))
+		err := row.Scan(&invitation.Token, &invitation.ListID, &invitation.Role)
+		ObserveQuery("accept_invitation", start, err)
+		if errors.Is(err, sql.ErrNoRows) {
+			return NewHTTPError("Invitation doesn't exist or was already accepted", http.StatusNotFound, "Not Found")
+		}
+		if err != nil {
+			return err
+		}
+
+		// Owners and users that already have a better role keep theirs
+		share = Share{ListID: invitation.ListID, UserID: user.ID, Role: invitation.Role}
+		role, err := ListRole(r.Context(), user.ID, invitation.ListID)
+		if err != nil {
+			return err
+		}
+		if role.rank() >= invitation.Role.rank() {
+			share.Role = role
+			return nil
+		}
+
+		start = time.Now()
+		_, err = tx.ExecContext(queryCtx, `INSERT INTO share (list_id, user_id, role) VALUES (?, ?, ?)
+			ON CONFLICT (list_id, user_id) DO UPDATE SET role = excluded.role;`,
+			share.ListID,
+			share.UserID,
+			share.Role,
+		)
+		ObserveQuery("upsert_share", start, err)
+		return err
+	})
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return
+	}
+
+	// Tell the client that we are going to return JSON
+	w.Header().Add("Content-Type", "application/json")
+	// Tell the client that the status of the request is 200
+	w.WriteHeader(http.StatusOK)
+	// Return the JSON-encoded share
+	err = json.NewEncoder(w).Encode(share)
+	if err != nil {
+		// Log encoding error for debugging
+		slog.ErrorContext(r.Context(), "error encoding share", "error", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestShares(t *testing.T) {
+	server, issuer := setupTestServer(t)
+	owner := issuer.token(t, issuer.key, "owner", nil)
+	other := issuer.token(t, issuer.key, "other", nil)
+
+	var ownerUser, otherUser User
+	_, body := testRequest(t, server, owner, http.MethodGet, "/me", nil)
+	decodeTestJSON(t, body, &ownerUser)
+	_, body = testRequest(t, server, other, http.MethodGet, "/me", nil)
+	decodeTestJSON(t, body, &otherUser)
+
+	var list List
+	res, body := testRequest(t, server, owner, http.MethodPost, "/list", map[string]any{"name": "groceries"})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("creating list: %d %s", res.StatusCode, body)
+	}
+	decodeTestJSON(t, body, &list)
+	shares := "/list/" + strconv.FormatInt(list.ID, 10) + "/shares/"
+
+	tests := []struct {
+		name   string
+		method string
+		user   int64
+		body   any
+		status int
+	}{
+		{"share with a missing user", http.MethodPut, otherUser.ID + 100, map[string]any{"role": RoleEditor}, http.StatusNotFound},
+		{"share with the owner", http.MethodPut, ownerUser.ID, map[string]any{"role": RoleEditor}, http.StatusBadRequest},
+		{"remove missing share", http.MethodDelete, otherUser.ID, nil, http.StatusNotFound},
+		{"share with another user", http.MethodPut, otherUser.ID, map[string]any{"role": RoleEditor}, http.StatusOK},
+		{"remove share", http.MethodDelete, otherUser.ID, nil, http.StatusNoContent},
+	}
+	for _, test := range tests {
+		res, body := testRequest(t, server, owner, test.method, shares+strconv.FormatInt(test.user, 10), test.body)
+		if res.StatusCode != test.status {
+			t.Fatalf("%s: got status %d, want %d: %s", test.name, res.StatusCode, test.status, body)
+		}
+	}
+}
+
+func TestAcceptInvitationAtomic(t *testing.T) {
+	server, issuer := setupTestServer(t)
+	owner := issuer.token(t, issuer.key, "owner", nil)
+	other := issuer.token(t, issuer.key, "other", nil)
+
+	res, body := testRequest(t, server, owner, http.MethodPost, "/list", map[string]any{"name": "groceries"})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("creating list: %d %s", res.StatusCode, body)
+	}
+	var invitation Invitation
+	res, body = testRequest(t, server, owner, http.MethodPost, "/list/1/invitations", map[string]any{"role": "editor"})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("creating invitation: %d %s", res.StatusCode, body)
+	}
+	decodeTestJSON(t, body, &invitation)
+
+	// An invitation whose share couldn't be added isn't used up
+	_, err := db.Exec(`CREATE TRIGGER refuse_share BEFORE INSERT ON share BEGIN SELECT RAISE(ABORT, 'refused'); END;`)
+	if err != nil {
+		t.Fatalf("error creating trigger: %v", err)
+	}
+	res, body = testRequest(t, server, other, http.MethodPost, "/invitations/"+invitation.Token, nil)
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("accepting with a failing share: got status %d, want 500: %s", res.StatusCode, body)
+	}
+	_, err = db.Exec(`DROP TRIGGER refuse_share;`)
+	if err != nil {
+		t.Fatalf("error dropping trigger: %v", err)
+	}
+	res, body = testRequest(t, server, other, http.MethodPost, "/invitations/"+invitation.Token, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("accepting again: got status %d, want 200: %s", res.StatusCode, body)
+	}
+	res, body = testRequest(t, server, other, http.MethodPost, "/invitations/"+invitation.Token, nil)
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("accepting a used invitation: got status %d, want 404: %s", res.StatusCode, body)
+	}
+}
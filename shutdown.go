@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// Workers keeps track of goroutines that run in the background for as long as the server does
+type Workers struct {
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	status map[string]string // what each worker is doing, shown by the readiness endpoint
+}
+
+// Global background workers object
+var workers = &Workers{status: map[string]string{}}
+
+// Go starts a named background worker that has to return once ctx is done
+func (w *Workers) Go(ctx context.Context, name string, fn func(ctx context.Context) error) {
+	w.setStatus(name, "running")
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		err := fn(ctx)
+		// Workers returning on their own before shutdown is something to look into
+		if err != nil && ctx.Err() == nil {
+			slog.Error("worker failed", "worker", name, "error", err)
+			w.setStatus(name, "failed: "+err.Error())
+			return
+		}
+		w.setStatus(name, "stopped")
+	}()
+}
+
+// setStatus records what a worker is doing
+func (w *Workers) setStatus(name, status string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.status[name] = status
+}
+
+// Status returns what each worker is doing
+func (w *Workers) Status() map[string]string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	status := make(map[string]string, len(w.status))
+	for name, s := range w.status {
+		status[name] = s
+	}
+	return status
+}
+
+// Wait blocks until every worker returned or ctx is done
+func (w *Workers) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("[Wait] error waiting for background workers: %w", ctx.Err())
+	}
+}
+
+// CloseDB moves everything from the write-ahead log into the database file and closes it
+func CloseDB(sqlite *sql.DB) error {
+	_, err := sqlite.Exec(`PRAGMA wal_checkpoint(TRUNCATE);`)
+	if err != nil {
+		// Still close the database, the WAL is checkpointed the next time it's opened
+		slog.Error("error checkpointing WAL", "error", err)
+	}
+	err = sqlite.Close()
+	if err != nil {
+		return fmt.Errorf("[CloseDB] error closing database: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReadyzShuttingDown(t *testing.T) {
+	server, _ := setupTestServer(t)
+
+	res, body := testRequest(t, server, "", http.MethodGet, "/readyz", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d before shutting down, want 200: %s", res.StatusCode, body)
+	}
+
+	// Load balancers stop sending requests once the server starts shutting down
+	shuttingDown.Store(true)
+	t.Cleanup(func() { shuttingDown.Store(false) })
+	res, body = testRequest(t, server, "", http.MethodGet, "/readyz", nil)
+	var health Health
+	decodeTestJSON(t, body, &health)
+	if res.StatusCode != http.StatusServiceUnavailable || health.Checks["shutdown"].Status != "fail" {
+		t.Fatalf("got status %d and %+v while shutting down, want 503 and a failed shutdown check", res.StatusCode, health)
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	testServer, issuer := setupTestServer(t)
+	token := issuer.token(t, issuer.key, "alice", nil)
+
+	// Requests to /slow stay in flight until they're let go
+	router := SetupRouter()
+	started, finish := make(chan struct{}), make(chan struct{})
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				close(started)
+				<-finish
+				r.URL.Path = "/healthz"
+			}
+			router.ServeHTTP(w, r)
+		}),
+		ReadHeaderTimeout: time.Second,
+	}
+	server.RegisterOnShutdown(hub.Close)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	go func() { _ = server.Serve(listener) }()
+	url := "http://" + listener.Addr().String()
+	client := testServer.Client()
+
+	// The change feed stays open until the server shuts down
+	req, err := http.NewRequest(http.MethodGet, url+"/todos/events", nil)
+	if err != nil {
+		t.Fatalf("error creating request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	stream, err := client.Do(req)
+	if err != nil || stream.StatusCode != http.StatusOK {
+		t.Fatalf("error following changes: %v", err)
+	}
+	defer stream.Body.Close()
+
+	slow := make(chan *http.Response, 1)
+	go func() {
+		res, err := client.Get(url + "/slow")
+		if err != nil {
+			t.Errorf("in-flight request failed: %v", err)
+		}
+		slow <- res
+	}()
+	<-started
+
+	shutdownDone := make(chan error, 1)
+	go func() { shutdownDone <- server.Shutdown(context.Background()) }()
+
+	// Shutting down waits for the request in flight but ends the change feed
+	select {
+	case err := <-shutdownDone:
+		t.Fatalf("shutdown returned with a request in flight: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(finish)
+	if res := <-slow; res == nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("in-flight request got %v, want 200", res)
+	} else {
+		_ = res.Body.Close()
+	}
+	select {
+	case err := <-shutdownDone:
+		if err != nil {
+			t.Fatalf("error shutting down: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown didn't return after the request finished")
+	}
+
+	// No new requests are accepted
+	_, err = http.Get(url + "/healthz")
+	if err == nil {
+		t.Fatal("request after shutting down succeeded")
+	}
+	var netErr *net.OpError
+	if !errors.As(err, &netErr) {
+		t.Errorf("request after shutting down failed with %v, want a connection error", err)
+	}
+}
+
+func TestWorkersWait(t *testing.T) {
+	w := &Workers{status: map[string]string{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	w.Go(ctx, "stops", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	w.Go(ctx, "fails", func(ctx context.Context) error {
+		return errors.New("broken")
+	})
+
+	// Workers that returned before shutdown are reported as failed
+	deadline := time.Now().Add(5 * time.Second)
+	for w.Status()["fails"] != "failed: broken" {
+		if time.Now().After(deadline) {
+			t.Fatalf("worker status is %v, want the failure", w.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Shutting down waits for the others to return
+	cancel()
+	waitCtx, cancelWait := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelWait()
+	err := w.Wait(waitCtx)
+	if err != nil || w.Status()["stops"] != "stopped" {
+		t.Fatalf("waiting for workers got status %v: %v", w.Status(), err)
+	}
+}
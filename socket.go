@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Time limits of WebSocket connections
+const (
+	socketWriteWait  = 10 * time.Second        // time a message may take to send
+	socketPongWait   = 60 * time.Second        // time without hearing from the client after which it's considered gone
+	socketPingPeriod = socketPongWait * 9 / 10 // time between pings, shorter than the pong wait
+)
+
+// Kinds of messages WebSocket clients send
+const (
+	SocketSubscribe   = "subscribe"
+	SocketUnsubscribe = "unsubscribe"
+	SocketCreate      = "create"
+	SocketUpdate      = "update"
+	SocketDelete      = "delete"
+)
+
+// Kinds of replies to WebSocket clients, changes are sent with the kind of event
+const (
+	SocketAck   = "ack"
+	SocketError = "error"
+)
+
+// SocketRequest is a message sent by a WebSocket client
+type SocketRequest struct {
+	ID     string    `json:"id"`                // correlation ID sent back with the reply
+	Type   string    `json:"type"`              // one of the Socket* kinds of messages
+	ListID *int64    `json:"list_id,omitempty"` // list to (un)subscribe, none means items without a list
+	Todo   *TodoItem `json:"todo,omitempty"`    // item to create, update or delete
+}
+
+// SocketMessage is a message sent to a WebSocket client, either a reply to a request or a change to a todo item
+type SocketMessage struct {
+	ID    string     `json:"id,omitempty"`    // correlation ID of the request replied to
+	Type  string     `json:"type"`            // ack, error or the kind of event
+	Todo  *TodoItem  `json:"todo,omitempty"`  // item that was changed
+	Todos []TodoItem `json:"todos,omitempty"` // items in a list that was subscribed to
+	Error *HTTPError `json:"error,omitempty"` // why a request failed
+}
+
+// Upgrades requests to WebSocket connections, browsers can only connect from the same host or an origin allowed by CORS
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+		return cors != nil && cors.allowOrigin(origin)
+	},
+}
+
+// isWebSocket reports whether the request asks to switch to the WebSocket protocol
+func isWebSocket(r *http.Request) bool {
+	return websocket.IsWebSocketUpgrade(r)
+}
+
+// socketSession is the state of one WebSocket connection
+type socketSession struct {
+	r     *http.Request // the upgraded request, its context has the user and the database of the tenant
+	conn  *websocket.Conn
+	lists map[int64]bool // lists the client subscribed to, 0 stands for items without a list
+}
+
+// HTTP handler for WebSocket connections, clients follow the lists they subscribe to and change todo items
+func TodoSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already responded with an error
+		slog.DebugContext(r.Context(), "error upgrading to WebSocket", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	// Start following changes before handling requests so none are missed
+	tenantID, _ := r.Context().Value(tenantIDContextKey).(string)
+	sub, _, _ := hub.Subscribe(tenantID, "")
+	defer hub.Unsubscribe(sub)
+
+	// Messages can be as large as request bodies and the client has to answer pings to stay connected
+	if maxBodyBytes > 0 {
+		conn.SetReadLimit(maxBodyBytes)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	})
+
+	// Only one goroutine may read and one may write, so messages are read here and handled below
+	messages := make(chan []byte)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case messages <- data:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	session := &socketSession{r: r, conn: conn, lists: map[int64]bool{}}
+	ping := time.NewTicker(socketPingPeriod)
+	defer ping.Stop()
+
+	for err == nil {
+		select {
+		case err = <-readErr: // The client disconnected or stopped answering pings
+		case data := <-messages:
+			err = session.handle(data)
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(socketWriteWait))
+		case event, ok := <-sub.events:
+			if !ok {
+				// The client fell behind or the server is shutting down, it reconnects and subscribes again
+				_ = conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "reconnect"),
+					time.Now().Add(socketWriteWait))
+				return
+			}
+			err = session.notify(event)
+		}
+	}
+	slog.DebugContext(r.Context(), "WebSocket client went away", "error", err)
+}
+
+// handle replies to a message of the client, errors are only returned when the connection broke
+func (s *socketSession) handle(data []byte) error {
+	var req SocketRequest
+	err := json.Unmarshal(data, &req)
+	if err != nil {
+		return s.sendError(req.ID, NewHTTPError(err.Error(), http.StatusBadRequest, "Bad Request"))
+	}
+
+	reply, err := s.do(req)
+	if err != nil {
+		return s.sendError(req.ID, err)
+	}
+	reply.ID = req.ID
+	reply.Type = SocketAck
+	return s.send(reply)
+}
+
+// do carries out a request of the client, mutations go through the store like those of the REST API
+func (s *socketSession) do(req SocketRequest) (SocketMessage, error) {
+	ctx := s.r.Context()
+
+	switch req.Type {
+	case SocketSubscribe:
+		// Make sure the user is allowed to see the list
+		err := ListAccess(ctx, req.ListID, RoleViewer)
+		if err != nil {
+			return SocketMessage{}, err
+		}
+		s.lists[listKey(req.ListID)] = true
+
+		// Send the items already in the list, later changes follow as events
+		filter := TodoFilter{NoList: req.ListID == nil}
+		if req.ListID != nil {
+			filter.ListIDs = []int64{*req.ListID}
+		}
+		todos, err := store.Find(ctx, filter, 0, -1)
+		if err != nil {
+			return SocketMessage{}, err
+		}
+		return SocketMessage{Todos: todos}, nil
+	case SocketUnsubscribe:
+		delete(s.lists, listKey(req.ListID))
+		return SocketMessage{}, nil
+	case SocketCreate, SocketUpdate, SocketDelete:
+		if req.Todo == nil {
+			return SocketMessage{}, NewHTTPError("Missing todo item", http.StatusBadRequest, "Bad Request")
+		}
+		// The connection only passed the rate limit once when it was opened
+		err := AllowWrite(s.r)
+		if err != nil {
+			return SocketMessage{}, err
+		}
+
+		todo := *req.Todo
+		switch req.Type {
+		case SocketCreate:
+			todo, err = store.Create(ctx, todo)
+		case SocketUpdate:
+			todo, err = store.Update(ctx, todo)
+		case SocketDelete:
+			err = store.Delete(ctx, todo.ID)
+			todo = TodoItem{ID: todo.ID}
+		}
+		if err != nil {
+			return SocketMessage{}, err
+		}
+		return SocketMessage{Todo: &todo}, nil
+	default:
+		return SocketMessage{}, NewHTTPError("Unknown message type "+strconv.Quote(req.Type), http.StatusBadRequest, "Bad Request")
+	}
+}
+
+// notify sends a change to the client if it follows the list of the todo item and is still allowed to see it
+func (s *socketSession) notify(event Event) error {
+	if !s.lists[listKey(event.Todo.ListID)] || !canSeeEvent(s.r.Context(), event) {
+		return nil
+	}
+	todo := event.Todo
+	return s.send(SocketMessage{Type: event.Type, Todo: &todo})
+}
+
+// sendError replies to a request that failed with the HTTPError the REST API would respond with
+func (s *socketSession) sendError(id string, err error) error {
+	e := *ErrorResponse(s.r.Context(), err)
+	e.RequestID = RequestIDFromContext(s.r.Context())
+	// Server errors are our problem so keep a record of them
+	if e.Status >= http.StatusInternalServerError {
+		slog.ErrorContext(s.r.Context(), "error handling WebSocket message", "error", e.Error(), "status", e.Status)
+	}
+	return s.send(SocketMessage{ID: id, Type: SocketError, Error: &e})
+}
+
+// send writes a message to the client
+func (s *socketSession) send(msg SocketMessage) error {
+	err := s.conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+	if err != nil {
+		return err
+	}
+	return s.conn.WriteJSON(msg)
+}
+
+// listKey returns the key of a list in the subscriptions of a session
+func listKey(listID *int64) int64 {
+	if listID == nil {
+		return 0
+	}
+	return *listID
+}
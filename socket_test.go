@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialTestSocket opens a WebSocket to the server with the token in the query like browsers send it
+func dialTestSocket(t *testing.T, serverURL, token string) *websocket.Conn {
+	t.Helper()
+	u := "ws" + strings.TrimPrefix(serverURL, "http") + "/ws?access_token=" + token
+	conn, res, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		status := 0
+		if res != nil {
+			status = res.StatusCode
+		}
+		t.Fatalf("error opening WebSocket, status %d: %v", status, err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// readTestSocket returns the next message of the server
+func readTestSocket(t *testing.T, conn *websocket.Conn) SocketMessage {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg SocketMessage
+	err := conn.ReadJSON(&msg)
+	if err != nil {
+		t.Fatalf("error reading WebSocket message: %v", err)
+	}
+	return msg
+}
+
+func TestTodoSocket(t *testing.T) {
+	server, issuer := setupTestServer(t)
+	token := issuer.token(t, issuer.key, "alice", nil)
+
+	// Connections without a token are refused before upgrading
+	_, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err == nil || res == nil || res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("WebSocket without token: got %v, want a 401", err)
+	}
+
+	conn := dialTestSocket(t, server.URL, token)
+
+	// Subscribing to items without a list replies with the items already there
+	res, body := testRequest(t, server, token, http.MethodPost, "/todo", map[string]any{"description": "before"})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("creating todo item: %d %s", res.StatusCode, body)
+	}
+	res, body = testRequest(t, server, token, http.MethodPost, "/list", map[string]any{"name": "groceries"})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("creating list: %d %s", res.StatusCode, body)
+	}
+	res, body = testRequest(t, server, token, http.MethodPost, "/todo", map[string]any{"description": "in list", "list_id": 1})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("creating todo item in list: %d %s", res.StatusCode, body)
+	}
+	err = conn.WriteJSON(SocketRequest{ID: "1", Type: SocketSubscribe})
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	msg := readTestSocket(t, conn)
+	if msg.ID != "1" || msg.Type != SocketAck || len(msg.Todos) != 1 || msg.Todos[0].Description != "before" {
+		t.Fatalf("subscribing replied %+v", msg)
+	}
+
+	// Subscribing to a list replies with the items in it
+	listID := int64(1)
+	err = conn.WriteJSON(SocketRequest{ID: "list", Type: SocketSubscribe, ListID: &listID})
+	if err != nil {
+		t.Fatalf("error subscribing to list: %v", err)
+	}
+	msg = readTestSocket(t, conn)
+	if msg.ID != "list" || msg.Type != SocketAck || len(msg.Todos) != 1 || msg.Todos[0].Description != "in list" {
+		t.Fatalf("subscribing to list replied %+v", msg)
+	}
+
+	// Changes made through the socket are acknowledged and followed by their event
+	err = conn.WriteJSON(SocketRequest{ID: "2", Type: SocketCreate, Todo: &TodoItem{Description: "over the socket"}})
+	if err != nil {
+		t.Fatalf("error creating todo item: %v", err)
+	}
+	var ack, event SocketMessage
+	for range 2 {
+		msg := readTestSocket(t, conn)
+		if msg.Type == SocketAck {
+			ack = msg
+		} else {
+			event = msg
+		}
+	}
+	if ack.ID != "2" || ack.Todo == nil || ack.Todo.ID == 0 {
+		t.Fatalf("creating replied %+v", ack)
+	}
+	if event.Type != EventCreated || event.Todo == nil || event.Todo.ID != ack.Todo.ID {
+		t.Fatalf("creating sent event %+v", event)
+	}
+
+	// Changes made through the REST API arrive as events
+	res, body = testRequest(t, server, token, http.MethodDelete, "/todo/1", nil)
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("deleting todo item: %d %s", res.StatusCode, body)
+	}
+	msg = readTestSocket(t, conn)
+	if msg.Type != EventDeleted || msg.Todo == nil || msg.Todo.ID != 1 {
+		t.Fatalf("deleting sent event %+v", msg)
+	}
+
+	// Bad requests get an error reply and the connection stays open
+	err = conn.WriteJSON(SocketRequest{ID: "3", Type: "shout"})
+	if err != nil {
+		t.Fatalf("error sending unknown message: %v", err)
+	}
+	msg = readTestSocket(t, conn)
+	if msg.ID != "3" || msg.Type != SocketError || msg.Error == nil || msg.Error.Status != http.StatusBadRequest {
+		t.Fatalf("unknown message replied %+v", msg)
+	}
+
+	// Items are checked like those sent to the REST API
+	err = conn.WriteJSON(SocketRequest{ID: "4", Type: SocketCreate, Todo: &TodoItem{}})
+	if err != nil {
+		t.Fatalf("error creating todo item: %v", err)
+	}
+	msg = readTestSocket(t, conn)
+	if msg.ID != "4" || msg.Type != SocketError || msg.Error == nil || msg.Error.Status != http.StatusBadRequest {
+		t.Fatalf("creating without a description replied %+v", msg)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TodoStore reads and changes todo items in the database of the tenant the context belongs to, checking that the
+// user of the context is allowed to. Every API uses it so they all behave the same. Errors meant for the client
+// are *HTTPError, which other protocols map to their own status codes.
+type TodoStore struct{}
+
+// Global todo item store
+var store TodoStore
+
+// TodoFilter narrows down the todo items Find returns, the zero value matches every item
+type TodoFilter struct {
+	Done    *bool   // only items that are (not) done
+	ListIDs []int64 // only items in one of these lists
+	NoList  bool    // only items without a list
+	Tag     string  // only items with this tag
+	Search  string  // only items whose description contains this, ignoring case
+}
+
+// Find returns the todo items matching the filter that the user can see, ordered by ID and starting after the
+// given one. At most limit items are returned, or at most limit items per list when the filter has several lists.
+func (TodoStore) Find(ctx context.Context, filter TodoFilter, after int64, limit int) ([]TodoItem, error) {
+	visible, args := visibleTodos(ctx)
+	where := visible + ` AND id > ?`
+	args = append(args, after)
+	if filter.Done != nil {
+		where += ` AND done = ?`
+		args = append(args, *filter.Done)
+	}
+	if filter.ListIDs != nil {
+		where += ` AND list_id IN (` + placeholders(len(filter.ListIDs)) + `)`
+		for _, id := range filter.ListIDs {
+			args = append(args, id)
+		}
+	}
+	if filter.NoList {
+		where += ` AND list_id IS NULL`
+	}
+	if filter.Tag != "" {
+		where += ` AND id IN (SELECT todo_tag.todo_id FROM todo_tag JOIN tag ON tag.id = todo_tag.tag_id WHERE tag.name = ?)`
+		args = append(args, filter.Tag)
+	}
+	if filter.Search != "" {
+		where += ` AND instr(lower(description), lower(?)) > 0`
+		args = append(args, filter.Search)
+	}
+
+	query := `SELECT id, description, done, list_id FROM todo WHERE ` + where + ` ORDER BY id LIMIT ?;`
+	if len(filter.ListIDs) > 1 {
+		// Number the items of every list so each of them gets its own page
+		query = `SELECT id, description, done, list_id FROM (
+			SELECT id, description, done, list_id, row_number() OVER (PARTITION BY list_id ORDER BY id) AS n
+			FROM todo WHERE ` + where + `
+		) WHERE n <= ? ORDER BY id;`
+	}
+	args = append(args, limit)
+
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	rows, err := DBFromContext(ctx).QueryContext(queryCtx, query, args...)
+	ObserveQuery("find_todos", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanTodos(rows)
+}
+
+// Get returns a todo item if the user can see the list it's in
+func (TodoStore) Get(ctx context.Context, id int64) (TodoItem, error) {
+	var todo TodoItem
+
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	row := DBFromContext(ctx).QueryRowContext(queryCtx, `SELECT id, description, done, list_id FROM todo WHERE id = ?;`, id)
+	err := row.Scan(&todo.ID, &todo.Description, &todo.Done, &todo.ListID)
+	ObserveQuery("get_todo", start, err)
+	if errors.Is(err, sql.ErrNoRows) {
+		return todo, todoNotFound(id)
+	}
+	if err != nil {
+		return todo, err
+	}
+
+	// Make sure the user is allowed to see the list the item is in
+	err = ListAccess(ctx, todo.ListID, RoleViewer)
+	if err != nil {
+		return todo, err
+	}
+	return todo, nil
+}
+
+// Create adds a todo item and returns it with its ID
+func (s TodoStore) Create(ctx context.Context, todo TodoItem) (TodoItem, error) {
+	return s.CreateWithTags(ctx, todo, nil)
+}
+
+// CreateWithTags adds a todo item with tags, creating the tags that don't exist yet, and returns it with its ID
+func (TodoStore) CreateWithTags(ctx context.Context, todo TodoItem, tags []string) (TodoItem, error) {
+	// Make sure the item and the tag names are usable
+	err := checkTodo(todo)
+	if err != nil {
+		return todo, err
+	}
+	tags, err = TagNames(tags)
+	if err != nil {
+		return todo, err
+	}
+
+	// Make sure the user is allowed to add items to the list
+	err = ListAccess(ctx, todo.ListID, RoleEditor)
+	if err != nil {
+		return todo, err
+	}
+
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(ctx)
+	defer cancel()
+	err = inTx(queryCtx, func(tx *sql.Tx) error {
+		// Make sure the tenant has room for another item
+		err := TodoQuota(queryCtx, tx)
+		if err != nil {
+			return err
+		}
+
+		start := time.Now()
+		res, err := tx.ExecContext(queryCtx, `INSERT INTO todo (done, description, list_id) VALUES (?, ?, ?);`,
+			todo.Done,
+			todo.Description,
+			todo.ListID,
+		)
+		ObserveQuery("create_todo", start, err)
+		if err != nil {
+			return err
+		}
+
+		// Get id of last inserted row which should be the autoincrement id of the todo
+		todo.ID, err = res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		// The item and its tags are saved together
+		if len(tags) > 0 {
+			err = setTags(queryCtx, tx, todo.ID, tags)
+			if err != nil {
+				return err
+			}
+		}
+
+		return EnqueueWebhooks(queryCtx, tx, EventCreated, todo)
+	})
+	if err != nil {
+		return todo, err
+	}
+
+	// Let clients following the change feed know
+	hub.Publish(ctx, EventCreated, todo)
+
+	return todo, nil
+}
+
+// Update replaces a todo item, keeping it in its current list unless a list is given
+func (s TodoStore) Update(ctx context.Context, todo TodoItem) (TodoItem, error) {
+	return s.UpdateWithTags(ctx, todo, nil)
+}
+
+// UpdateWithTags replaces a todo item and its tags, nil tags keep the current ones
+func (TodoStore) UpdateWithTags(ctx context.Context, todo TodoItem, tags []string) (TodoItem, error) {
+	// Make sure the item and the tag names are usable
+	err := checkTodo(todo)
+	if err != nil {
+		return todo, err
+	}
+	if tags != nil {
+		tags, err = TagNames(tags)
+		if err != nil {
+			return todo, err
+		}
+	}
+
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(ctx)
+	defer cancel()
+	err = inTx(queryCtx, func(tx *sql.Tx) error {
+		// Get the item as it is now, the transaction holds the write lock so it can't change before the update
+		var current TodoItem
+		start := time.Now()
+		err := tx.QueryRowContext(queryCtx, `SELECT done, list_id FROM todo WHERE id = ?;`, todo.ID).Scan(&current.Done, &current.ListID)
+		ObserveQuery("get_todo", start, err)
+		if errors.Is(err, sql.ErrNoRows) {
+			return todoNotFound(todo.ID)
+		}
+		if err != nil {
+			return err
+		}
+		// Keep the item in its current list if the request doesn't move it
+		if todo.ListID == nil {
+			todo.ListID = current.ListID
+		}
+
+		// Make sure the user is allowed to change items in the current list and the one it moves to
+		err = ListAccess(ctx, current.ListID, RoleEditor)
+		if err == nil {
+			err = ListAccess(ctx, todo.ListID, RoleEditor)
+		}
+		if err != nil {
+			return err
+		}
+
+		start = time.Now()
+		res, err := tx.ExecContext(queryCtx, `UPDATE todo SET done = ?, description = ?, list_id = ? WHERE id = ?;`,
+			todo.Done,
+			todo.Description,
+			todo.ListID,
+			todo.ID,
+		)
+		ObserveQuery("update_todo", start, err)
+		if err != nil {
+			return err
+		}
+
+		// Get amount of changed rows
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		switch rowsAffected {
+		case 0:
+			return todoNotFound(todo.ID)
+		case 1:
+		default:
+			return NewHTTPError("updated more than 1 record", http.StatusInternalServerError, "Internal Server Error")
+		}
+
+		// The item and its tags are saved together
+		if tags != nil {
+			err = setTags(queryCtx, tx, todo.ID, tags)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = EnqueueWebhooks(queryCtx, tx, EventUpdated, todo)
+		if err == nil && todo.Done && !current.Done {
+			err = EnqueueWebhooks(queryCtx, tx, EventCompleted, todo)
+		}
+		return err
+	})
+	if err != nil {
+		return todo, err
+	}
+
+	// Let clients following the change feed know
+	hub.Publish(ctx, EventUpdated, todo)
+
+	return todo, nil
+}
+
+// Delete removes a todo item
+func (TodoStore) Delete(ctx context.Context, id int64) error {
+	var listID *int64
+
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(ctx)
+	defer cancel()
+	err := inTx(queryCtx, func(tx *sql.Tx) error {
+		// Get the list the item is in, the transaction holds the write lock so it can't move before the delete
+		start := time.Now()
+		err := tx.QueryRowContext(queryCtx, `SELECT list_id FROM todo WHERE id = ?;`, id).Scan(&listID)
+		ObserveQuery("get_todo_list", start, err)
+		if errors.Is(err, sql.ErrNoRows) {
+			return todoNotFound(id)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Make sure the user is allowed to remove items from the list
+		err = ListAccess(ctx, listID, RoleEditor)
+		if err != nil {
+			return err
+		}
+
+		start = time.Now()
+		_, err = tx.ExecContext(queryCtx, `DELETE FROM todo_tag WHERE todo_id = ?;`, id)
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(queryCtx, `DELETE FROM todo WHERE id = ?;`, id)
+		ObserveQuery("delete_todo", start, err)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		switch rowsAffected {
+		case 0:
+			return todoNotFound(id)
+		case 1:
+		default:
+			return NewHTTPError("deleted more than 1 record", http.StatusInternalServerError, "Internal Server Error")
+		}
+
+		return EnqueueWebhooks(queryCtx, tx, EventDeleted, TodoItem{ID: id, ListID: listID})
+	})
+	if err != nil {
+		return err
+	}
+
+	// Let clients following the change feed know
+	hub.Publish(ctx, EventDeleted, TodoItem{ID: id, ListID: listID})
+
+	return nil
+}
+
+// inTx runs fn in a transaction of the database of the context, so a change and the webhooks it triggers are saved
+// together. Webhook deliveries are sent once the transaction is committed.
+func inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := DBFromContext(ctx).BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	webhooks.Wake()
+	return nil
+}
+
+// visibleTodos returns the condition matching the todo items the user of the context can see, those without a list
+// and those in lists the user has access to, or every item when authentication is disabled
+func visibleTodos(ctx context.Context) (string, []any) {
+	user, ok := UserFromContext(ctx)
+	if !ok {
+		return `TRUE`, nil
+	}
+	return `(list_id IS NULL
+		OR list_id IN (SELECT id FROM list WHERE owner_id = ? UNION SELECT list_id FROM share WHERE user_id = ?))`,
+		[]any{user.ID, user.ID}
+}
+
+// scanTodos reads the todo items of a query selecting id, description, done and list_id
+func scanTodos(rows *sql.Rows) ([]TodoItem, error) {
+	var todos []TodoItem
+	for rows.Next() {
+		var todo TodoItem
+		err := rows.Scan(&todo.ID, &todo.Description, &todo.Done, &todo.ListID)
+		if err != nil {
+			return nil, err
+		}
+		todos = append(todos, todo)
+	}
+	return todos, rows.Err()
+}
+
+// placeholders returns n comma-separated query parameters for an IN clause
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// checkTodo makes sure a todo item can be saved, the same way for every API
+func checkTodo(todo TodoItem) error {
+	if strings.TrimSpace(todo.Description) == "" {
+		return NewHTTPError("The description can't be empty", http.StatusBadRequest, "Bad Request")
+	}
+	return nil
+}
+
+// todoNotFound returns the error of a todo item that doesn't exist
+func todoNotFound(id int64) error {
+	return NewHTTPError("No todo with id "+strconv.FormatInt(id, 10)+" exists", http.StatusNotFound, "Not Found")
+}
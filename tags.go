@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Longest tag name that can be given to a todo item
+const maxTagLength = 64
+
+// Tag is a label todo items of a tenant can share
+type Tag struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// Tags returns the tags of the todo items the user can see
+func (TodoStore) Tags(ctx context.Context) ([]Tag, error) {
+	visible, args := visibleTodos(ctx)
+
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	rows, err := DBFromContext(ctx).QueryContext(queryCtx, `SELECT id, name FROM tag WHERE id IN (
+		SELECT todo_tag.tag_id FROM todo_tag JOIN todo ON todo.id = todo_tag.todo_id WHERE `+visible+`
+	) ORDER BY name;`, args...)
+	ObserveQuery("list_tags", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Return an empty array instead of null when there are no tags
+	tags := []Tag{}
+	for rows.Next() {
+		var tag Tag
+		err = rows.Scan(&tag.ID, &tag.Name)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// TagsOf returns the tags of several todo items at once, the items have to be visible to the user already
+func (TodoStore) TagsOf(ctx context.Context, todoIDs []int64) (map[int64][]Tag, error) {
+	tags := map[int64][]Tag{}
+	if len(todoIDs) == 0 {
+		return tags, nil
+	}
+	args := make([]any, len(todoIDs))
+	for i, id := range todoIDs {
+		args[i] = id
+	}
+
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	rows, err := DBFromContext(ctx).QueryContext(queryCtx, `SELECT todo_tag.todo_id, tag.id, tag.name FROM todo_tag
+		JOIN tag ON tag.id = todo_tag.tag_id WHERE todo_tag.todo_id IN (`+placeholders(len(todoIDs))+`) ORDER BY tag.name;`, args...)
+	ObserveQuery("list_todo_tags", start, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var todoID int64
+		var tag Tag
+		err = rows.Scan(&todoID, &tag.ID, &tag.Name)
+		if err != nil {
+			return nil, err
+		}
+		tags[todoID] = append(tags[todoID], tag)
+	}
+	return tags, rows.Err()
+}
+
+// setTags replaces the tags of a todo item in the transaction of a change to it, tags that don't exist yet are created
+func setTags(ctx context.Context, tx *sql.Tx, todoID int64, names []string) error {
+	start := time.Now()
+	_, err := tx.ExecContext(ctx, `DELETE FROM todo_tag WHERE todo_id = ?;`, todoID)
+	for _, name := range names {
+		if err != nil {
+			break
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO tag (name) VALUES (?) ON CONFLICT (name) DO NOTHING;`, name)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, `INSERT INTO todo_tag (todo_id, tag_id) SELECT ?, id FROM tag WHERE name = ?
+				ON CONFLICT DO NOTHING;`, todoID, name)
+		}
+	}
+	ObserveQuery("set_todo_tags", start, err)
+	return err
+}
+
+// TagNames trims the names of tags and makes sure they aren't empty or too long, so they can be checked before a change
+func TagNames(names []string) ([]string, error) {
+	trimmed := make([]string, len(names))
+	for i, name := range names {
+		trimmed[i] = strings.TrimSpace(name)
+		if trimmed[i] == "" {
+			return nil, NewHTTPError("Tags can't be empty", http.StatusBadRequest, "Bad Request")
+		}
+		if utf8.RuneCountInString(trimmed[i]) > maxTagLength {
+			return nil, NewHTTPError("Tags can't be longer than "+strconv.Itoa(maxTagLength)+" characters", http.StatusBadRequest, "Bad Request")
+		}
+	}
+	return trimmed, nil
+}
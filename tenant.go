@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Ways of finding out which tenant a request belongs to
+const (
+	TenantModeHeader    = "header"    // value of a request header
+	TenantModeSubdomain = "subdomain" // first label of the host in front of the base domain
+	TenantModeClaim     = "claim"     // claim of the bearer token
+)
+
+// Tenant IDs end up in file names so only allow a safe set of characters
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// Tenants keeps one lazily opened SQLite database per tenant in a directory
+type Tenants struct {
+	mode     string
+	header   string          // request header used in header mode
+	domain   string          // base domain used in subdomain mode
+	claim    string          // token claim used in claim mode
+	dir      string          // directory holding the database file of each tenant
+	known    map[string]bool // tenants whose database is created on first use, others need an existing file
+	maxOpen  int             // most databases kept open at once, 0 means unlimited
+	maxTodos int             // default todo item quota, 0 means unlimited
+	quotas   map[string]int  // todo item quota of specific tenants
+
+	mu  sync.Mutex // only guards the map and use counts, opening and closing a database happens outside of it
+	dbs map[string]*tenantDB
+}
+
+// tenantDB is the database of a tenant, ready is closed once opening it is done
+type tenantDB struct {
+	ready    chan struct{}
+	db       *sql.DB
+	stats    prometheus.Collector // connection pool metrics of the database
+	err      error
+	users    int       // requests and background jobs using the database, it's only closed without any
+	lastUsed time.Time // when the last of them was done with it
+}
+
+// Global tenants object, nil when multi-tenant mode is disabled
+var tenants *Tenants
+
+// Context key under which the database of the tenant is stored
+const tenantDBContextKey contextKey = "tenantDB"
+
+// Context key under which the ID of the tenant is stored
+const tenantIDContextKey contextKey = "tenantID"
+
+// SetupTenants creates the tenants object, nil when multi-tenant mode is disabled
+func SetupTenants(options TenantOptions) (*Tenants, error) {
+	// If there is no tenant resolution mode multi-tenant mode is disabled
+	if options.Mode == "" {
+		return nil, nil
+	}
+
+	t := &Tenants{
+		mode:     options.Mode,
+		header:   options.Header,
+		domain:   strings.TrimPrefix(options.Domain, "."),
+		claim:    options.Claim,
+		dir:      options.Dir,
+		known:    map[string]bool{},
+		maxOpen:  options.MaxOpen,
+		maxTodos: options.MaxTodos,
+		quotas:   options.Quotas,
+		dbs:      map[string]*tenantDB{},
+	}
+	// Tenants with a quota of their own are configured as well
+	for _, tenantID := range options.IDs {
+		t.known[tenantID] = true
+	}
+	for tenantID := range options.Quotas {
+		t.known[tenantID] = true
+	}
+
+	// Make sure the directory for the database files exists
+	err := os.MkdirAll(t.dir, 0o750)
+	if err != nil {
+		return nil, fmt.Errorf("[SetupTenants] error creating tenant directory: %w", err)
+	}
+
+	return t, nil
+}
+
+// Resolve returns the ID of the tenant a request belongs to, empty if it can't be found
+func (t *Tenants) Resolve(r *http.Request) (string, error) {
+	switch t.mode {
+	case TenantModeHeader:
+		return r.Header.Get(t.header), nil
+	case TenantModeSubdomain:
+		// Remove the port if there is one
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		tenantID, found := strings.CutSuffix(strings.ToLower(host), "."+t.domain)
+		if !found {
+			return "", nil
+		}
+		return tenantID, nil
+	case TenantModeClaim:
+		// The claim can only be trusted once VerifyToken has verified the token
+		token, ok := r.Context().Value(tokenContextKey).(*oidc.IDToken)
+		if !ok {
+			return "", nil
+		}
+		var claims map[string]any
+		err := token.Claims(&claims)
+		if err != nil {
+			return "", fmt.Errorf("[Resolve] error decoding token claims: %w", err)
+		}
+		tenantID, _ := claims[t.claim].(string)
+		return tenantID, nil
+	default:
+		return "", nil
+	}
+}
+
+// Acquire returns the database of a tenant, opening and initializing it on first use, and a function to call once
+// done with it. Requests of other tenants don't wait for it, requests of the same tenant wait for the first one to
+// open it. When max_open databases are open the one that has been idle the longest is closed to make room.
+func (t *Tenants) Acquire(tenantID string) (*sql.DB, func(), error) {
+	t.mu.Lock()
+	entry, ok := t.dbs[tenantID]
+	var idleID string
+	var idle *tenantDB
+	if !ok {
+		if t.maxOpen > 0 && len(t.dbs) >= t.maxOpen {
+			idleID, idle = t.idlest()
+			if idle == nil {
+				t.mu.Unlock()
+				return nil, nil, NewHTTPError("Too many tenants are in use, try again later", http.StatusServiceUnavailable, "Service Unavailable")
+			}
+			delete(t.dbs, idleID)
+		}
+		entry = &tenantDB{ready: make(chan struct{})}
+		t.dbs[tenantID] = entry
+	}
+	entry.users++
+	t.mu.Unlock()
+	release := func() { t.release(entry) }
+
+	if idle != nil {
+		t.close(idleID, idle)
+	}
+
+	if ok {
+		<-entry.ready
+		if entry.err != nil {
+			release()
+			return nil, nil, entry.err
+		}
+		return entry.db, release, nil
+	}
+
+	entry.db, entry.stats, entry.err = t.open(tenantID)
+	if entry.err != nil {
+		// Let the next request try again
+		t.mu.Lock()
+		if t.dbs[tenantID] == entry {
+			delete(t.dbs, tenantID)
+		}
+		t.mu.Unlock()
+		close(entry.ready)
+		release()
+		return nil, nil, entry.err
+	}
+	close(entry.ready)
+	return entry.db, release, nil
+}
+
+// release marks a database as no longer used by one of its users
+func (t *Tenants) release(entry *tenantDB) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry.users--
+	entry.lastUsed = time.Now()
+}
+
+// idlest returns the open database nobody uses that has been idle the longest, nil if all of them are in use. The
+// lock has to be held.
+func (t *Tenants) idlest() (string, *tenantDB) {
+	var idleID string
+	var idle *tenantDB
+	for tenantID, entry := range t.dbs {
+		// Databases that are being opened have a user until they're ready
+		if entry.users > 0 {
+			continue
+		}
+		if idle == nil || entry.lastUsed.Before(idle.lastUsed) {
+			idleID, idle = tenantID, entry
+		}
+	}
+	return idleID, idle
+}
+
+// open opens and initializes the database of a tenant, which is only created for configured tenants
+func (t *Tenants) open(tenantID string) (*sql.DB, prometheus.Collector, error) {
+	path := filepath.Join(t.dir, tenantID+".db")
+	if !t.known[tenantID] {
+		_, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, NewHTTPError("Tenant "+tenantID+" doesn't exist", http.StatusNotFound, "Not Found")
+		}
+	}
+
+	tenantDB, err := OpenDB(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("[Acquire] error opening database of tenant %s: %w", tenantID, err)
+	}
+
+	// Report the connection pool of the tenant database like the global one
+	stats := collectors.NewDBStatsCollector(tenantDB, "tenant_"+tenantID)
+	err = prometheus.Register(stats)
+	if err != nil {
+		slog.Error("error registering database metrics", "tenant", tenantID, "error", err)
+		stats = nil
+	}
+
+	slog.Info("opened tenant database", "tenant", tenantID)
+
+	return tenantDB, stats, nil
+}
+
+// close writes out and closes the database of a tenant that nobody uses anymore
+func (t *Tenants) close(tenantID string, entry *tenantDB) error {
+	if entry.stats != nil {
+		prometheus.Unregister(entry.stats)
+	}
+	err := CloseDB(entry.db)
+	if err != nil {
+		return fmt.Errorf("[Close] error closing database of tenant %s: %w", tenantID, err)
+	}
+	slog.Info("closed tenant database", "tenant", tenantID)
+	return nil
+}
+
+// EachOpened calls fn with the database of every tenant that is open, which stays open until fn returns
+func (t *Tenants) EachOpened(fn func(tenantID string, tenantDB *sql.DB)) {
+	t.mu.Lock()
+	opened := map[string]*tenantDB{}
+	for tenantID, entry := range t.dbs {
+		// Skip databases that are still being opened
+		select {
+		case <-entry.ready:
+			if entry.err == nil {
+				entry.users++
+				opened[tenantID] = entry
+			}
+		default:
+		}
+	}
+	t.mu.Unlock()
+
+	for tenantID, entry := range opened {
+		fn(tenantID, entry.db)
+		t.release(entry)
+	}
+}
+
+// Quota returns the maximum amount of todo items a tenant can have, 0 means unlimited
+func (t *Tenants) Quota(tenantID string) int {
+	if quota, ok := t.quotas[tenantID]; ok {
+		return quota
+	}
+	return t.maxTodos
+}
+
+// Close writes out and closes the databases of all tenants that have been opened
+func (t *Tenants) Close() error {
+	t.mu.Lock()
+	entries := t.dbs
+	t.dbs = map[string]*tenantDB{}
+	t.mu.Unlock()
+
+	var err error
+	for tenantID, entry := range entries {
+		// Databases that are still being opened are closed once they are
+		<-entry.ready
+		if entry.err != nil {
+			continue
+		}
+		if closeErr := t.close(tenantID, entry); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// ResolveTenant wraps an HTTP handler so that it runs against the database of the tenant of the request. It goes
+// after VerifyToken so that unauthenticated requests can't make tenant databases be opened.
+func ResolveTenant(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// If multi-tenant mode is disabled everything uses the global database
+		if tenants == nil {
+			next(w, r)
+			return
+		}
+
+		tenantID, err := tenants.Resolve(r)
+		if err != nil {
+			// Log the reason for debugging since the client only gets a generic message
+			slog.WarnContext(r.Context(), "error resolving tenant", "error", err)
+			// Return the JSON-encoded error message
+			WriteHTTPError(w, r, "Invalid bearer token", http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		if !tenantIDPattern.MatchString(tenantID) {
+			// Return the JSON-encoded error message
+			WriteHTTPError(w, r, "Tenant is missing or invalid", http.StatusBadRequest, "Bad Request")
+			return
+		}
+
+		tenantDB, release, err := tenants.Acquire(tenantID)
+		if err != nil {
+			// Return the JSON-encoded error message
+			WriteError(w, r, err)
+			return
+		}
+		defer release()
+
+		// Make the tenant and its database available to the wrapped handler
+		ctx := context.WithValue(r.Context(), tenantIDContextKey, tenantID)
+		ctx = context.WithValue(ctx, tenantDBContextKey, tenantDB)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// DBFromContext returns the database of the tenant stored in the context, or the global database
+func DBFromContext(ctx context.Context) *sql.DB {
+	if tenantDB, ok := ctx.Value(tenantDBContextKey).(*sql.DB); ok {
+		return tenantDB
+	}
+	return db
+}
+
+// TodoQuota makes sure the tenant of the context can add another todo item. It counts within the transaction
+// adding the item, which holds the write lock, so concurrent additions can't both take the last place.
+func TodoQuota(ctx context.Context, tx *sql.Tx) error {
+	tenantID, ok := ctx.Value(tenantIDContextKey).(string)
+	if !ok {
+		return nil
+	}
+	quota := tenants.Quota(tenantID)
+	if quota <= 0 {
+		return nil
+	}
+
+	// Count the todo items the tenant already has
+	var count int
+	start := time.Now()
+	err := tx.QueryRowContext(ctx, `SELECT count(*) FROM todo;`).Scan(&count)
+	ObserveQuery("count_todos", start, err)
+	if err != nil {
+		return err
+	}
+
+	if count >= quota {
+		return NewHTTPError("Tenant "+tenantID+" reached its quota of "+strconv.Itoa(quota)+" todo items", http.StatusForbidden, "Quota Exceeded")
+	}
+
+	return nil
+}
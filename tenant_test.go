@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// newTestTenants returns tenants in header mode with their databases in a new directory, closed when the test ends
+func newTestTenants(t *testing.T, options TenantOptions) *Tenants {
+	t.Helper()
+	options.Mode = TenantModeHeader
+	options.Header = DefaultConfig().Tenant.Header
+	if options.Dir == "" {
+		options.Dir = t.TempDir()
+	}
+	tenantSet, err := SetupTenants(options)
+	if err != nil {
+		t.Fatalf("error setting up tenants: %v", err)
+	}
+	t.Cleanup(func() { _ = tenantSet.Close() })
+	return tenantSet
+}
+
+// setupTestTenants enables multi-tenant mode with the options in header mode for the duration of the test
+func setupTestTenants(t *testing.T, options TenantOptions) {
+	t.Helper()
+	tenantSet := newTestTenants(t, options)
+	previous := tenants
+	tenants = tenantSet
+	t.Cleanup(func() { tenants = previous })
+}
+
+// openedTenants returns the databases of the tenants that are open, by tenant ID
+func openedTenants(tenantSet *Tenants) map[string]*sql.DB {
+	opened := map[string]*sql.DB{}
+	tenantSet.EachOpened(func(tenantID string, tenantDB *sql.DB) {
+		opened[tenantID] = tenantDB
+	})
+	return opened
+}
+
+func TestTenantsAcquire(t *testing.T) {
+	tenantSet := newTestTenants(t, TenantOptions{IDs: []string{"first", "second"}})
+
+	// Every request of a tenant gets the database the first one opened
+	dbs := make([]*sql.DB, 10)
+	errs := make([]error, len(dbs))
+	var wg sync.WaitGroup
+	for i := range dbs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tenantID := "first"
+			if i%2 == 1 {
+				tenantID = "second"
+			}
+			var release func()
+			dbs[i], release, errs[i] = tenantSet.Acquire(tenantID)
+			if errs[i] == nil {
+				release()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := range dbs {
+		if errs[i] != nil {
+			t.Fatalf("request %d: %v", i, errs[i])
+		}
+		if dbs[i] != dbs[i%2] {
+			t.Fatalf("request %d got another database than request %d", i, i%2)
+		}
+	}
+	if dbs[0] == dbs[1] {
+		t.Fatal("both tenants got the same database")
+	}
+
+	opened := openedTenants(tenantSet)
+	if len(opened) != 2 || opened["first"] != dbs[0] || opened["second"] != dbs[1] {
+		t.Fatalf("opened databases are %v", opened)
+	}
+}
+
+func TestTenantsUnknown(t *testing.T) {
+	dir := t.TempDir()
+	tenantSet := newTestTenants(t, TenantOptions{Dir: dir, IDs: []string{"configured"}, Quotas: map[string]int{"limited": 10}})
+
+	// Tenants that aren't configured don't get a database file
+	_, _, err := tenantSet.Acquire("unknown")
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Status != http.StatusNotFound {
+		t.Fatalf("acquiring an unknown tenant: got %v, want a 404", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "unknown.db")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("acquiring an unknown tenant created its database: %v", err)
+	}
+
+	// Configured tenants and those with a file do
+	mydb, err := OpenDB(filepath.Join(dir, "existing.db"))
+	if err != nil {
+		t.Fatalf("error creating database: %v", err)
+	}
+	_ = mydb.Close()
+	for _, tenantID := range []string{"configured", "limited", "existing"} {
+		_, release, err := tenantSet.Acquire(tenantID)
+		if err != nil {
+			t.Fatalf("acquiring tenant %s: %v", tenantID, err)
+		}
+		release()
+	}
+}
+
+func TestTenantsMaxOpen(t *testing.T) {
+	tenantSet := newTestTenants(t, TenantOptions{IDs: []string{"first", "second", "third"}, MaxOpen: 2})
+
+	_, releaseFirst, err := tenantSet.Acquire("first")
+	if err != nil {
+		t.Fatalf("acquiring first tenant: %v", err)
+	}
+	_, releaseSecond, err := tenantSet.Acquire("second")
+	if err != nil {
+		t.Fatalf("acquiring second tenant: %v", err)
+	}
+
+	// Without an idle database there is no room for another one
+	_, _, err = tenantSet.Acquire("third")
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Status != http.StatusServiceUnavailable {
+		t.Fatalf("acquiring a tenant over the limit: got %v, want a 503", err)
+	}
+
+	// The database idle the longest makes room
+	releaseFirst()
+	releaseSecond()
+	_, releaseThird, err := tenantSet.Acquire("third")
+	if err != nil {
+		t.Fatalf("acquiring a tenant once others are idle: %v", err)
+	}
+	defer releaseThird()
+	opened := openedTenants(tenantSet)
+	if _, ok := opened["first"]; ok || len(opened) != 2 {
+		t.Fatalf("opened databases are %v, want second and third", opened)
+	}
+}
+
+func TestResolveTenantAfterAuth(t *testing.T) {
+	server, issuer := setupTestServer(t)
+	dir := t.TempDir()
+	setupTestTenants(t, TenantOptions{Dir: dir, IDs: []string{"acme"}})
+
+	request := func(token, tenantID string) int {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/todos", nil)
+		if err != nil {
+			t.Fatalf("error creating request: %v", err)
+		}
+		req.Header.Set(DefaultConfig().Tenant.Header, tenantID)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("error sending request: %v", err)
+		}
+		_ = res.Body.Close()
+		return res.StatusCode
+	}
+
+	// Requests without a valid token don't get a tenant database opened
+	for _, token := range []string{"", "not-a-token"} {
+		if status := request(token, "acme"); status != http.StatusUnauthorized {
+			t.Fatalf("got status %d without a valid token, want 401", status)
+		}
+	}
+	if opened := openedTenants(tenants); len(opened) != 0 {
+		t.Fatalf("opened databases are %v without a valid token", opened)
+	}
+
+	token := issuer.token(t, issuer.key, "alice", nil)
+	if status := request(token, "acme"); status != http.StatusOK {
+		t.Fatalf("got status %d for a configured tenant, want 200", status)
+	}
+	if status := request(token, "other"); status != http.StatusNotFound {
+		t.Fatalf("got status %d for an unknown tenant, want 404", status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "other.db")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("request of an unknown tenant created its database: %v", err)
+	}
+}
+
+func TestTodoQuotaConcurrent(t *testing.T) {
+	setupTestTenants(t, TenantOptions{Quotas: map[string]int{"acme": 50005}})
+	tenantDB, release, err := tenants.Acquire("acme")
+	if err != nil {
+		t.Fatalf("error acquiring tenant: %v", err)
+	}
+	defer release()
+	ctx := context.WithValue(context.Background(), tenantIDContextKey, "acme")
+	ctx = context.WithValue(ctx, tenantDBContextKey, tenantDB)
+
+	// Fill most of the quota so counting takes long enough for the creates to overlap
+	_, err = tenantDB.Exec(`WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 50000)
+		INSERT INTO todo (description) SELECT 'filler' FROM n;`)
+	if err != nil {
+		t.Fatalf("error adding todo items: %v", err)
+	}
+
+	// However many try at once, only as many items as the quota allows are added
+	start := make(chan struct{})
+	errs := make([]error, 20)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, errs[i] = store.Create(ctx, TodoItem{Description: "item"})
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	created := 0
+	for _, err := range errs {
+		var httpErr *HTTPError
+		switch {
+		case err == nil:
+			created++
+		case !errors.As(err, &httpErr) || httpErr.Status != http.StatusForbidden:
+			t.Errorf("creating todo item: got %v, want a 403", err)
+		}
+	}
+	var count int
+	err = tenantDB.QueryRow(`SELECT count(*) FROM todo;`).Scan(&count)
+	if err != nil || created != 5 || count != 50005 {
+		t.Fatalf("%d creates succeeded and %d items exist, want 5 more than 50000: %v", created, count, err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader serves a certificate from disk and loads it again whenever the files change,
+// so certificates rotated by something like cert-manager are used without a restart
+type CertReloader struct {
+	certPath string
+	keyPath  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // latest modification time of the files the certificate was loaded from
+	checked time.Time // when the files were last looked at
+}
+
+// Time between checks of the certificate files for changes, handshakes in between use the loaded certificate
+var certCheckInterval = 10 * time.Second
+
+// NewCertReloader loads the certificate and key for the first time
+func NewCertReloader(certPath, keyPath string) (*CertReloader, error) {
+	c := &CertReloader{certPath: certPath, keyPath: keyPath}
+	_, err := c.GetCertificate(nil)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// latestModTime returns the modification time of whichever of the certificate and key files changed last
+func (c *CertReloader) latestModTime() (time.Time, error) {
+	certInfo, err := os.Stat(c.certPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(c.keyPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
+
+// GetCertificate returns the current certificate, it's meant to be used as tls.Config.GetCertificate
+func (c *CertReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Don't look at the files on every handshake
+	now := time.Now()
+	if c.cert != nil && now.Sub(c.checked) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.checked = now
+
+	modTime, err := c.latestModTime()
+	if err != nil {
+		// Keep serving the certificate we have if the files are briefly missing during a rotation
+		if c.cert != nil {
+			slog.Error("error checking certificate files, using the loaded certificate", "error", err)
+			return c.cert, nil
+		}
+		return nil, fmt.Errorf("[GetCertificate] error checking certificate files: %w", err)
+	}
+
+	// Nothing changed since the last load
+	if c.cert != nil && !modTime.After(c.modTime) {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		// The certificate and key might be written one after the other, so try again on the next handshake
+		if c.cert != nil {
+			slog.Error("error loading new certificate, using the previous one", "error", err)
+			return c.cert, nil
+		}
+		return nil, fmt.Errorf("[GetCertificate] error loading certificate: %w", err)
+	}
+
+	if c.cert != nil {
+		slog.Info("loaded rotated certificate", "path", c.certPath)
+	}
+	c.cert = &cert
+	c.modTime = modTime
+
+	return c.cert, nil
+}
+
+// SetupTLS creates the TLS configuration of the server, nil when TLS is not configured
+func SetupTLS(options TLSOptions) (*tls.Config, error) {
+	// If there is no certificate the server uses plain HTTP
+	if options.Cert == "" {
+		return nil, nil
+	}
+
+	reloader, err := NewCertReloader(options.Cert, options.Key)
+	if err != nil {
+		return nil, fmt.Errorf("[SetupTLS] error loading certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	// Require client certificates signed by the given CA bundle for mutual TLS
+	if caPath := options.ClientCA; caPath != "" {
+		caPEM, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("[SetupTLS] error reading client CA bundle: %w", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("[SetupTLS] error: no certificates found in client CA bundle " + caPath)
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// RedirectToHTTPS returns a handler that sends clients to the same URL over HTTPS on the given port
+func RedirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Remove the port of the plain HTTP listener if there is one
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		// The default HTTPS port doesn't need to be in the URL
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
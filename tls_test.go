@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its key, signed by a CA or by itself when it's one
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert creates a certificate for the name signed by the CA, a CA itself without one
+func newTestCert(t *testing.T, name string, ca *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("error generating serial number: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("error parsing certificate: %v", err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write saves the certificate and its key as PEM files and returns their paths
+func (c *testCert) write(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("error encoding key: %v", err)
+	}
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600)
+	if err == nil {
+		err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	}
+	if err != nil {
+		t.Fatalf("error writing certificate: %v", err)
+	}
+	return certPath, keyPath
+}
+
+// tlsCertificate returns the certificate as a client certificate
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	first := newTestCert(t, "localhost", ca)
+	certPath, keyPath := first.write(t, dir)
+
+	reloader, err := NewCertReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("error loading certificate: %v", err)
+	}
+
+	// A rotated certificate isn't looked for again until the check interval passed
+	second := newTestCert(t, "localhost", ca)
+	second.write(t, dir)
+	later := time.Now().Add(time.Minute)
+	for _, path := range []string{certPath, keyPath} {
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatalf("error changing modification time: %v", err)
+		}
+	}
+	cert, err := reloader.GetCertificate(nil)
+	if err != nil || cert.Leaf.SerialNumber.Cmp(first.cert.SerialNumber) != 0 {
+		t.Fatalf("got certificate %v within the check interval, want the first one: %v", cert.Leaf.SerialNumber, err)
+	}
+
+	// Once it passed the rotated certificate is loaded
+	previous := certCheckInterval
+	certCheckInterval = 0
+	t.Cleanup(func() { certCheckInterval = previous })
+	cert, err = reloader.GetCertificate(nil)
+	if err != nil || cert.Leaf.SerialNumber.Cmp(second.cert.SerialNumber) != 0 {
+		t.Fatalf("got certificate %v after the check interval, want the rotated one: %v", cert.Leaf.SerialNumber, err)
+	}
+
+	// Files missing halfway through a rotation keep the loaded certificate in use
+	if err := os.Remove(keyPath); err != nil {
+		t.Fatalf("error removing key: %v", err)
+	}
+	cert, err = reloader.GetCertificate(nil)
+	if err != nil || cert.Leaf.SerialNumber.Cmp(second.cert.SerialNumber) != 0 {
+		t.Fatalf("got certificate %v without a key file, want the loaded one: %v", cert.Leaf.SerialNumber, err)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	certPath, keyPath := newTestCert(t, "localhost", ca).write(t, dir)
+	caPath := filepath.Join(dir, "ca.pem")
+	err := os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.der}), 0o600)
+	if err != nil {
+		t.Fatalf("error writing CA bundle: %v", err)
+	}
+
+	tlsConfig, err := SetupTLS(TLSOptions{Cert: certPath, Key: keyPath, ClientCA: caPath})
+	if err != nil {
+		t.Fatalf("error setting up TLS: %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(Healthz))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	tests := []struct {
+		name  string
+		certs []tls.Certificate
+		ok    bool
+	}{
+		{"without a client certificate", nil, false},
+		{"with a certificate of another CA", []tls.Certificate{newTestCert(t, "client", newTestCert(t, "other", nil)).tlsCertificate()}, false},
+		{"with a certificate of the client CA", []tls.Certificate{newTestCert(t, "client", ca).tlsCertificate()}, true},
+	}
+	for _, test := range tests {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			ServerName:   "localhost",
+			Certificates: test.certs,
+		}}}
+		res, err := client.Get(server.URL + "/healthz")
+		if err == nil {
+			_ = res.Body.Close()
+		}
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if err == nil && res.StatusCode != http.StatusOK {
+			t.Errorf("%s: got status %d", test.name, res.StatusCode)
+		}
+	}
+}
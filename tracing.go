@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer used for the spans of HTTP requests
+var tracer = otel.Tracer("github.com/insanitywholesale/go-todo")
+
+// SetupTracing configures where spans are exported to and returns a function that flushes them on shutdown
+func SetupTracing(ctx context.Context, options TracingOptions) (func(context.Context) error, error) {
+	// Accept W3C trace context and baggage from callers and pass them on
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch options.Exporter {
+	case "none": // Tracing is disabled and spans cost next to nothing
+		return func(context.Context) error { return nil }, nil
+	case "otlp": // Endpoint, headers and TLS are set through the standard OTEL_EXPORTER_OTLP_* environment variables
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout": // Print spans to the terminal, useful for development and tests
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("[SetupTracing] error: unknown exporter %q", options.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[SetupTracing] error creating exporter: %w", err)
+	}
+
+	// Describe this service, OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("go-todo")),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("[SetupTracing] error creating resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Tracing wraps the router so that every request gets a span, continuing the trace of the caller if there is one
+func Tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				semconv.ClientAddress(ClientIP(r)),
+			),
+		)
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		r = r.WithContext(ctx)
+
+		next.ServeHTTP(recorder, r)
+
+		// The route is only known once the router matched the request, its pattern already starts with the method
+		if r.Pattern != "" {
+			span.SetName(r.Pattern)
+			route := r.Pattern
+			if _, path, found := strings.Cut(r.Pattern, " "); found {
+				route = path
+			}
+			span.SetAttributes(semconv.HTTPRoute(route))
+		}
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(recorder.status))
+		// Only server errors mark a server span as failed
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
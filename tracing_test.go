@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// setupTestTracing records the spans of requests in memory for the duration of the test
+func setupTestTracing(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	previousTracer, previousPropagator := tracer, otel.GetTextMapPropagator()
+	tracer = provider.Tracer("github.com/insanitywholesale/go-todo")
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		tracer = previousTracer
+		otel.SetTextMapPropagator(previousPropagator)
+		_ = provider.Shutdown(context.Background())
+	})
+	return exporter
+}
+
+// spanAttribute returns the value of an attribute of a span
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracing(t *testing.T) {
+	server, issuer := setupTestServer(t)
+	exporter := setupTestTracing(t)
+	token := issuer.token(t, issuer.key, "alice", nil)
+
+	// Continue the trace of the caller
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/todo/42", nil)
+	if err != nil {
+		t.Fatalf("error creating request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	res, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("GET /todo/42: %v", err)
+	}
+	res.Body.Close()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	span := spans[0]
+	if span.Name != "GET /todo/{todo_id}" {
+		t.Errorf("span is named %q, want the route", span.Name)
+	}
+	if span.SpanContext.TraceID().String() != traceID || span.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("span doesn't continue the trace of the caller, its parent is %v", span.Parent)
+	}
+	if route := spanAttribute(span, semconv.HTTPRouteKey).AsString(); route != "/todo/{todo_id}" {
+		t.Errorf("span has route %q", route)
+	}
+	if status := spanAttribute(span, semconv.HTTPResponseStatusCodeKey).AsInt64(); status != http.StatusNotFound {
+		t.Errorf("span has status %d, want 404", status)
+	}
+	// Client errors aren't failures of the server
+	if span.Status.Code == codes.Error {
+		t.Errorf("span of a 404 is marked as failed")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+)
+
+// Whether responses are checked against the OpenAPI document too, responses that don't match it are replaced by a
+// 500 so drift between the handlers and the document can't go unnoticed. Only meant for development and tests.
+var validateResponses bool
+
+func init() {
+	// Error messages shouldn't contain the whole schema that didn't match
+	openapi3.SchemaErrorDetailsDisabled = true
+	// The documentation page is checked as the string it's documented as
+	openapi3filter.RegisterBodyDecoder("text/html", openapi3filter.PlainBodyDecoder)
+}
+
+// Options of validating requests and responses against the OpenAPI document
+var validationOptions = &openapi3filter.Options{
+	// Authentication is up to RequireAuth
+	AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+	// Clients may send back items as they got them, IDs included
+	ExcludeReadOnlyValidations: true,
+	// Defaults of the document are for clients to read, handlers pick their own
+	SkipSettingDefaults: true,
+	// Every status a route responds with has to be documented
+	IncludeResponseStatus: true,
+}
+
+// Validate wraps the handler of a route so that path and query parameters and the request body have to match its
+// operation in the OpenAPI document before the handler sees them. It goes after authentication so that clients
+// without access are refused before their requests are read.
+func Validate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Routes missing from the document can't be validated, TestRoutesDocumented fails for them
+		route := openapiRoute(r.Pattern)
+		if route == nil {
+			next(w, r)
+			return
+		}
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    validationRequest(r),
+			PathParams: pathParams(route, r),
+			Route:      route,
+			Options:    validationOptions,
+		}
+		err := openapi3filter.ValidateRequest(r.Context(), input)
+		// The body was read for validation, so the handler gets the copy that was kept
+		r.Body = input.Request.Body
+		if err != nil {
+			// Bodies that are too large or too slow hit a limit rather than being invalid
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) || errors.Is(err, os.ErrDeadlineExceeded) {
+				// Return the JSON-encoded error message
+				WriteError(w, r, err)
+				return
+			}
+			// Return the JSON-encoded error message
+			WriteHTTPError(w, r, validationMessage(err), http.StatusBadRequest, "Bad Request")
+			return
+		}
+
+		// Streams are written as they happen so they can't be held back for validation
+		if !validateResponses || streamRoutes[r.Pattern] {
+			next(w, r)
+			return
+		}
+
+		buf := &responseBuffer{header: http.Header{}, status: http.StatusOK}
+		next.ServeHTTP(buf, r)
+
+		// Server errors aren't documented on every route and are logged anyway
+		if buf.status < http.StatusInternalServerError {
+			err = openapi3filter.ValidateResponse(r.Context(), (&openapi3filter.ResponseValidationInput{
+				RequestValidationInput: input,
+				Status:                 buf.status,
+				Header:                 buf.header,
+				Options:                validationOptions,
+			}).SetBodyBytes(buf.body.Bytes()))
+			if err != nil {
+				slog.ErrorContext(r.Context(), "response doesn't match openapi.yaml", "error", err, "route", route.Method+" "+route.Path, "status", buf.status)
+				// Return the JSON-encoded error message
+				WriteHTTPError(w, r, "Response doesn't match openapi.yaml: "+err.Error(), http.StatusInternalServerError, "Internal Server Error")
+				return
+			}
+		}
+
+		for key, values := range buf.header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(buf.status)
+		_, err = w.Write(buf.body.Bytes())
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error writing to client", "error", err)
+		}
+	}
+}
+
+// validationRequest returns the request as it's validated. Handlers decode bodies as JSON whatever their content type
+// says, so bodies without a JSON content type are validated as JSON as well.
+func validationRequest(r *http.Request) *http.Request {
+	if r.ContentLength == 0 && r.Body == http.NoBody {
+		return r
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+		return r
+	}
+	clone := r.Clone(r.Context())
+	clone.Header.Set("Content-Type", "application/json")
+	return clone
+}
+
+// pathParams returns the values of the path parameters of the route
+func pathParams(route *routers.Route, r *http.Request) map[string]string {
+	params := map[string]string{}
+	for _, segment := range strings.Split(route.Path, "/") {
+		if name, ok := strings.CutPrefix(segment, "{"); ok {
+			name = strings.TrimSuffix(name, "}")
+			params[name] = r.PathValue(name)
+		}
+	}
+	return params
+}
+
+// validationMessage describes why a request doesn't match the OpenAPI document
+func validationMessage(err error) string {
+	var reqErr *openapi3filter.RequestError
+	if !errors.As(err, &reqErr) {
+		return err.Error()
+	}
+
+	reason := reqErr.Reason
+	var schemaErr *openapi3.SchemaError
+	if errors.As(err, &schemaErr) {
+		reason = schemaErr.Reason
+		if pointer := schemaErr.JSONPointer(); len(pointer) > 0 {
+			reason = "/" + strings.Join(pointer, "/") + ": " + reason
+		}
+	} else if reqErr.Err != nil {
+		reason = reqErr.Err.Error()
+	}
+
+	switch {
+	case reqErr.Parameter != nil:
+		return "Parameter " + reqErr.Parameter.Name + " in " + reqErr.Parameter.In + " is invalid: " + reason
+	case reqErr.RequestBody != nil:
+		return "Request body is invalid: " + reason
+	default:
+		return reason
+	}
+}
+
+// responseBuffer keeps a response until it was validated
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if !b.wrote {
+		b.status = status
+		b.wrote = true
+	}
+}
+
+func (b *responseBuffer) Write(data []byte) (int, error) {
+	b.wrote = true
+	return b.body.Write(data)
+}
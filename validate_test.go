@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// setupTestValidation checks responses against openapi.yaml for the duration of the test, responses that don't
+// match it become a 500
+func setupTestValidation(t *testing.T) {
+	t.Helper()
+	previous := validateResponses
+	validateResponses = true
+	t.Cleanup(func() { validateResponses = previous })
+}
+
+func TestResponsesMatchOpenAPI(t *testing.T) {
+	server, issuer := setupTestServer(t)
+	setupTestValidation(t)
+	owner := issuer.token(t, issuer.key, "owner", nil)
+	other := issuer.token(t, issuer.key, "other", nil)
+
+	// Requests covering every route with their successes and documented failures, in an order that builds on itself
+	tests := []struct {
+		token  string
+		method string
+		path   string
+		body   any
+		status int
+	}{
+		{"", http.MethodGet, "/", nil, http.StatusOK},
+		{"", http.MethodGet, "/healthz", nil, http.StatusOK},
+		{"", http.MethodGet, "/readyz", nil, http.StatusOK},
+		{"", http.MethodGet, "/metrics", nil, http.StatusOK},
+		{"", http.MethodGet, "/openapi.json", nil, http.StatusOK},
+		{"", http.MethodGet, "/docs", nil, http.StatusOK},
+		{"", http.MethodGet, "/me", nil, http.StatusUnauthorized},
+		{owner, http.MethodGet, "/me", nil, http.StatusOK},
+		{other, http.MethodGet, "/me", nil, http.StatusOK},
+
+		{owner, http.MethodGet, "/todos", nil, http.StatusOK},
+		{owner, http.MethodPost, "/todo", map[string]any{"description": "first"}, http.StatusOK},
+		{owner, http.MethodPost, "/todo", map[string]any{"description": 42}, http.StatusBadRequest},
+		{owner, http.MethodGet, "/todo", nil, http.StatusOK},
+		{owner, http.MethodGet, "/todos?done=false&search=fir&limit=10", nil, http.StatusOK},
+		{owner, http.MethodGet, "/todos?limit=1000", nil, http.StatusBadRequest},
+		{owner, http.MethodGet, "/todo/1", nil, http.StatusOK},
+		{owner, http.MethodGet, "/todo/2", nil, http.StatusNotFound},
+		{owner, http.MethodGet, "/todo/first", nil, http.StatusBadRequest},
+		{owner, http.MethodPut, "/todo/1", map[string]any{"description": "first", "done": true}, http.StatusOK},
+		{owner, http.MethodPut, "/todo/2", map[string]any{"description": "missing"}, http.StatusNotFound},
+		{owner, http.MethodPost, "/graphql", map[string]any{"query": "{ todos { id description done tags { name } } }"}, http.StatusOK},
+
+		{owner, http.MethodGet, "/lists", nil, http.StatusOK},
+		{owner, http.MethodPost, "/list", map[string]any{"name": "groceries"}, http.StatusOK},
+		{owner, http.MethodPost, "/todo", map[string]any{"description": "milk", "list_id": 1}, http.StatusOK},
+		{other, http.MethodGet, "/todo/2", nil, http.StatusNotFound},
+		{other, http.MethodPost, "/todo", map[string]any{"description": "sneaky", "list_id": 1}, http.StatusNotFound},
+		{owner, http.MethodPut, "/list/1/shares/2", map[string]any{"role": "viewer"}, http.StatusOK},
+		{owner, http.MethodGet, "/list/1/shares", nil, http.StatusOK},
+		{other, http.MethodGet, "/todo/2", nil, http.StatusOK},
+		{other, http.MethodPut, "/todo/2", map[string]any{"description": "oat milk"}, http.StatusForbidden},
+		{other, http.MethodPost, "/todo", map[string]any{"description": "sneaky", "list_id": 1}, http.StatusForbidden},
+		{other, http.MethodDelete, "/todo/2", nil, http.StatusForbidden},
+		{other, http.MethodPut, "/list/1/shares/2", map[string]any{"role": "admin"}, http.StatusForbidden},
+		{owner, http.MethodPut, "/list/1/shares/1", map[string]any{"role": "viewer"}, http.StatusBadRequest},
+		{owner, http.MethodDelete, "/list/1/shares/2", nil, http.StatusNoContent},
+		{owner, http.MethodDelete, "/list/1/shares/2", nil, http.StatusNotFound},
+		{owner, http.MethodPost, "/list/1/invitations", map[string]any{"role": "owner"}, http.StatusBadRequest},
+		{owner, http.MethodPost, "/invitations/nope", nil, http.StatusNotFound},
+
+		{owner, http.MethodGet, "/webhooks", nil, http.StatusOK},
+		{owner, http.MethodPost, "/webhooks", map[string]any{"url": "https://93.184.215.14/hook", "list_id": 1}, http.StatusOK},
+		{owner, http.MethodPost, "/webhooks", map[string]any{"url": "ftp://example.com"}, http.StatusBadRequest},
+		{owner, http.MethodGet, "/webhooks/1", nil, http.StatusOK},
+		{other, http.MethodGet, "/webhooks/1", nil, http.StatusNotFound},
+		{owner, http.MethodPut, "/webhooks/1", map[string]any{"url": "https://93.184.215.14/other", "events": []string{"completed"}, "list_id": 1}, http.StatusOK},
+		{owner, http.MethodPut, "/todo/2", map[string]any{"description": "milk", "done": true}, http.StatusOK},
+		{owner, http.MethodGet, "/webhooks/1/deliveries", nil, http.StatusOK},
+		{owner, http.MethodGet, "/webhooks/1/deliveries?status=dead", nil, http.StatusOK},
+		{owner, http.MethodPost, "/webhooks/1/deliveries/1/retry", nil, http.StatusNotFound},
+		{owner, http.MethodDelete, "/webhooks/1", nil, http.StatusNoContent},
+
+		{owner, http.MethodDelete, "/todo/2", nil, http.StatusNoContent},
+		{owner, http.MethodDelete, "/todo/2", nil, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		res, body := testRequest(t, server, test.token, test.method, test.path, test.body)
+		if res.StatusCode != test.status {
+			t.Errorf("%s %s: got status %d, want %d: %s", test.method, test.path, res.StatusCode, test.status, body)
+		}
+	}
+
+	// Invitations have a generated token
+	var invitation Invitation
+	res, body := testRequest(t, server, owner, http.MethodPost, "/list/1/invitations", map[string]any{"role": "editor"})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("creating invitation: %d %s", res.StatusCode, body)
+	}
+	decodeTestJSON(t, body, &invitation)
+	res, body = testRequest(t, server, other, http.MethodPost, "/invitations/"+invitation.Token, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("accepting invitation: %d %s", res.StatusCode, body)
+	}
+}
+
+func TestValidateAfterAuth(t *testing.T) {
+	server, _ := setupTestServer(t)
+
+	// Clients without access learn that before anything about their request
+	res, body := testRequest(t, server, "", http.MethodPost, "/todo", map[string]any{"description": 42})
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("got status %d, want 401: %s", res.StatusCode, body)
+	}
+	res, body = testRequest(t, server, "not-a-token", http.MethodGet, "/todos?limit=1000", nil)
+	if res.StatusCode != http.StatusUnauthorized || strings.Contains(string(body), "limit") {
+		t.Fatalf("got status %d, want 401: %s", res.StatusCode, body)
+	}
+}
@@ -0,0 +1,811 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Kinds of changes webhooks can be filtered on
+var webhookEvents = []string{EventCreated, EventUpdated, EventDeleted, EventCompleted}
+
+// States of a webhook delivery
+const (
+	DeliveryPending   = "pending"   // waiting for its first attempt or a retry
+	DeliveryDelivered = "delivered" // the receiver responded with a 2xx status
+	DeliveryDead      = "dead"      // every attempt failed, it's only retried when asked to
+)
+
+// Webhook sends changes to todo items in a list to a URL
+type Webhook struct {
+	ID     int64    `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`            // kinds of changes that are sent, none means all of them
+	ListID *int64   `json:"list_id,omitempty"` // list the items are in, none means items without a list
+	Secret string   `json:"secret,omitempty"`  // key of the signatures, only returned when it's set
+}
+
+// WebhookDelivery is a change sent to a webhook together with the outcome of its latest attempt
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	WebhookID      int64           `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastStatusCode *int            `json:"last_status_code,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at,omitempty"` // only while pending
+}
+
+// WebhookPayload is the body sent to webhook receivers
+type WebhookPayload struct {
+	Event     string    `json:"event"`
+	Todo      TodoItem  `json:"todo"`
+	Tenant    string    `json:"tenant,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookSender delivers the webhooks in the outbox of every database, retrying failed deliveries with exponential
+// backoff until they run out of attempts
+type WebhookSender struct {
+	client       *http.Client
+	interval     time.Duration // time between checks for deliveries that are due
+	maxAttempts  int
+	backoff      time.Duration // time before the first retry
+	maxBackoff   time.Duration
+	workers      int           // deliveries sent at the same time
+	allowPrivate bool          // whether receivers can be on internal addresses
+	wake         chan struct{} // signals that new deliveries were added
+}
+
+// Global webhook sender, nil until it's set up
+var webhooks *WebhookSender
+
+// Attempts to deliver webhooks
+var webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "todo_webhook_deliveries_total",
+	Help: "Attempts to deliver webhooks, by result.",
+}, []string{"result"})
+
+// SetupWebhooks creates the sender of webhook deliveries, which runs once started as a background worker
+func SetupWebhooks(options WebhookOptions) *WebhookSender {
+	s := &WebhookSender{
+		interval:     options.Interval,
+		maxAttempts:  options.MaxAttempts,
+		backoff:      options.Backoff,
+		maxBackoff:   options.MaxBackoff,
+		workers:      options.Workers,
+		allowPrivate: options.AllowPrivate,
+		wake:         make(chan struct{}, 1),
+	}
+
+	// Check every address that is connected to, including those of redirects and of hosts whose DNS records changed
+	// since the webhook was registered. Going through a proxy would hide the address of the receiver.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{
+		Timeout:   options.Timeout,
+		KeepAlive: 30 * time.Second,
+		Control:   s.checkDial,
+	}).DialContext
+	s.client = &http.Client{Timeout: options.Timeout, Transport: transport}
+
+	return s
+}
+
+// Addresses that are internal without being covered by the methods of netip.Addr
+var internalPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // this network
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT, used for internal networks by some clouds
+}
+
+// internalAddr reports whether an address is on the machine or the network of the server, where receivers could
+// reach services that aren't meant to be reachable from outside, like cloud metadata at 169.254.169.254
+func internalAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return true
+	}
+	for _, prefix := range internalPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDial refuses connections to internal addresses unless they're allowed
+func (s *WebhookSender) checkDial(network, address string, _ syscall.RawConn) error {
+	if s.allowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if internalAddr(addr) {
+		return fmt.Errorf("receiver address %s is internal", addr)
+	}
+	return nil
+}
+
+// checkHost makes sure the host of a webhook URL doesn't resolve to internal addresses unless they're allowed
+func (s *WebhookSender) checkHost(ctx context.Context, host string) error {
+	if s != nil && s.allowPrivate {
+		return nil
+	}
+
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{addr}
+	} else {
+		addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return NewHTTPError("Host "+strconv.Quote(host)+" of the URL can't be resolved", http.StatusBadRequest, "Bad Request")
+		}
+	}
+	for _, addr := range addrs {
+		if internalAddr(addr) {
+			return NewHTTPError("URL can't point to a loopback, private or link-local address", http.StatusBadRequest, "Bad Request")
+		}
+	}
+	return nil
+}
+
+// EnqueueWebhooks adds a delivery of a change to the outbox of every webhook that follows it. It runs in the
+// transaction of the change so that either both are saved or neither is.
+func EnqueueWebhooks(ctx context.Context, tx *sql.Tx, eventType string, todo TodoItem) error {
+	tenantID, _ := ctx.Value(tenantIDContextKey).(string)
+	now := time.Now()
+	payload, err := json.Marshal(WebhookPayload{Event: eventType, Todo: todo, Tenant: tenantID, CreatedAt: now.UTC()})
+	if err != nil {
+		return fmt.Errorf("[EnqueueWebhooks] error encoding payload: %w", err)
+	}
+
+	// Webhooks of the list of the item that want the event, whose owner can still see the list
+	start := time.Now()
+	_, err = tx.ExecContext(ctx, `INSERT INTO webhook_delivery (webhook_id, event, payload, status, created_at, next_attempt_at)
+		SELECT webhook.id, ?, ?, ?, ?, ? FROM webhook
+		WHERE webhook.list_id IS ?
+		AND (webhook.events = '' OR instr(',' || webhook.events || ',', ',' || ? || ',') > 0)
+		AND (webhook.list_id IS NULL OR webhook.owner_id IS NULL
+			OR webhook.owner_id IN (SELECT owner_id FROM list WHERE id = webhook.list_id
+				UNION SELECT user_id FROM share WHERE list_id = webhook.list_id));`,
+		eventType, string(payload), DeliveryPending, now.UnixMilli(), now.UnixMilli(),
+		todo.ListID,
+		eventType,
+	)
+	ObserveQuery("enqueue_webhooks", start, err)
+	return err
+}
+
+// Wake lets the sender know that deliveries were added so they're sent right away
+func (s *WebhookSender) Wake() {
+	if s == nil {
+		return
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+		// The sender already has a wake-up pending
+	}
+}
+
+// Run sends the deliveries that are due until ctx is done
+func (s *WebhookSender) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		err := s.deliverDue(ctx, "", db)
+		if err != nil {
+			slog.Error("error sending webhooks", "error", err)
+		}
+		// Every tenant has its own outbox. Only databases that are open are checked so that tenants nobody uses
+		// don't cost anything, their pending deliveries are sent once the tenant is back.
+		if tenants != nil {
+			tenants.EachOpened(func(tenantID string, tenantDB *sql.DB) {
+				err := s.deliverDue(ctx, tenantID, tenantDB)
+				if err != nil {
+					slog.Error("error sending webhooks", "tenant", tenantID, "error", err)
+				}
+			})
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// pendingDelivery is a delivery that is due together with where it goes
+type pendingDelivery struct {
+	id        int64
+	webhookID int64
+	event     string
+	payload   []byte
+	attempts  int
+	url       string
+	secret    string
+}
+
+// deliverDue sends the deliveries of a database that are due and records the outcome
+func (s *WebhookSender) deliverDue(ctx context.Context, tenantID string, sqlite *sql.DB) error {
+	// Get the deliveries whose time has come, oldest first
+	start := time.Now()
+	rows, err := sqlite.QueryContext(ctx, `SELECT webhook_delivery.id, webhook.id, webhook_delivery.event, webhook_delivery.payload,
+		webhook_delivery.attempts, webhook.url, webhook.secret
+		FROM webhook_delivery JOIN webhook ON webhook.id = webhook_delivery.webhook_id
+		WHERE webhook_delivery.status = ? AND webhook_delivery.next_attempt_at <= ?
+		ORDER BY webhook_delivery.next_attempt_at LIMIT 100;`, DeliveryPending, time.Now().UnixMilli())
+	ObserveQuery("list_due_webhook_deliveries", start, err)
+	if err != nil {
+		return fmt.Errorf("[deliverDue] error getting due deliveries: %w", err)
+	}
+	var due []pendingDelivery
+	for rows.Next() {
+		var d pendingDelivery
+		err = rows.Scan(&d.id, &d.webhookID, &d.event, &d.payload, &d.attempts, &d.url, &d.secret)
+		if err != nil {
+			break
+		}
+		due = append(due, d)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	// Don't hold on to the connection while waiting for receivers
+	_ = rows.Close()
+	if err != nil {
+		return fmt.Errorf("[deliverDue] error reading due deliveries: %w", err)
+	}
+
+	// Slow receivers only hold up as many deliveries as there are workers
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	slots := make(chan struct{}, max(1, s.workers))
+	for _, d := range due {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			deliverErr := s.deliver(ctx, tenantID, sqlite, d)
+			if deliverErr != nil {
+				mu.Lock()
+				err = errors.Join(err, deliverErr)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return err
+}
+
+// deliver makes an attempt to send a delivery and records the outcome
+func (s *WebhookSender) deliver(ctx context.Context, tenantID string, sqlite *sql.DB, d pendingDelivery) error {
+	statusCode, sendErr := s.send(ctx, d)
+	if ctx.Err() != nil {
+		// Shutting down, the delivery is tried again after the restart without counting this attempt
+		return nil
+	}
+
+	d.attempts++
+	status, result, lastError := DeliveryDelivered, "delivered", ""
+	next := time.Now()
+	if sendErr != nil {
+		status, result, lastError = DeliveryPending, "failed", sendErr.Error()
+		next = next.Add(s.retryDelay(d.attempts))
+		if d.attempts >= s.maxAttempts {
+			status, result = DeliveryDead, "dead"
+		}
+		slog.Warn("error delivering webhook", "tenant", tenantID, "webhook", d.webhookID, "delivery", d.id,
+			"attempt", d.attempts, "status", status, "error", sendErr)
+	}
+	webhookDeliveries.WithLabelValues(result).Inc()
+
+	var lastStatusCode *int
+	if statusCode != 0 {
+		lastStatusCode = &statusCode
+	}
+	start := time.Now()
+	_, err := sqlite.ExecContext(ctx, `UPDATE webhook_delivery SET status = ?, attempts = ?, last_status_code = ?, last_error = ?,
+		next_attempt_at = ? WHERE id = ?;`, status, d.attempts, lastStatusCode, lastError, next.UnixMilli(), d.id)
+	ObserveQuery("update_webhook_delivery", start, err)
+	if err != nil {
+		return fmt.Errorf("[deliver] error recording delivery %d: %w", d.id, err)
+	}
+	return nil
+}
+
+// send posts a delivery to its receiver, returning the status code of the response if there was one
+func (s *WebhookSender) send(ctx context.Context, d pendingDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(d.payload))
+	if err != nil {
+		return 0, err
+	}
+	// Signing the time together with the body lets receivers reject old deliveries that are sent again
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-todo-webhooks")
+	req.Header.Set("X-Webhook-Event", d.event)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(d.id, 10))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+webhookSignature(d.secret, timestamp, d.payload))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	// Read some of the body so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// retryDelay returns the time to wait after a failed attempt, doubling every time with some jitter so that
+// deliveries that failed together aren't all retried at once
+func (s *WebhookSender) retryDelay(attempts int) time.Duration {
+	// Double until the maximum is reached, stopping before the delay could overflow
+	delay := s.backoff
+	for range attempts - 1 {
+		if delay >= s.maxBackoff/2 {
+			delay = s.maxBackoff
+			break
+		}
+		delay *= 2
+	}
+	delay = min(delay, s.maxBackoff)
+	return delay - time.Duration(mathrand.Int64N(int64(delay)/10+1))
+}
+
+// webhookSignature returns the hex-encoded HMAC-SHA256 of the timestamp and body of a delivery
+func webhookSignature(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookOwner returns the user webhooks of the context belong to, nil when authentication is disabled
+func webhookOwner(ctx context.Context) *int64 {
+	if user, ok := UserFromContext(ctx); ok {
+		return &user.ID
+	}
+	return nil
+}
+
+// validate checks a webhook from a request body and that the user can see its list
+func (h *Webhook) validate(ctx context.Context) error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return NewHTTPError("URL must be an absolute http or https URL", http.StatusBadRequest, "Bad Request")
+	}
+	// Receivers can't be used to reach the server itself or services on its network
+	err = webhooks.checkHost(ctx, u.Hostname())
+	if err != nil {
+		return err
+	}
+	for _, event := range h.Events {
+		if !slices.Contains(webhookEvents, event) {
+			return NewHTTPError("Unknown event "+strconv.Quote(event)+", must be one of "+strings.Join(webhookEvents, ", "), http.StatusBadRequest, "Bad Request")
+		}
+	}
+	if h.Events == nil {
+		h.Events = []string{}
+	}
+	return ListAccess(ctx, h.ListID, RoleViewer)
+}
+
+// getWebhook returns a webhook of the user of the context
+func getWebhook(ctx context.Context, id int64) (Webhook, error) {
+	var webhook Webhook
+	var events string
+
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	err := DBFromContext(ctx).QueryRowContext(queryCtx, `SELECT id, url, events, list_id FROM webhook WHERE id = ? AND owner_id IS ?;`,
+		id, webhookOwner(ctx)).Scan(&webhook.ID, &webhook.URL, &events, &webhook.ListID)
+	ObserveQuery("get_webhook", start, err)
+	if errors.Is(err, sql.ErrNoRows) {
+		return webhook, NewHTTPError("No webhook with id "+strconv.FormatInt(id, 10)+" exists", http.StatusNotFound, "Not Found")
+	}
+	webhook.Events = append([]string{}, splitList(events)...)
+	return webhook, err
+}
+
+// HTTP handler for getting the webhooks of the user
+func ReadWebhooks(w http.ResponseWriter, r *http.Request) {
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(r.Context())
+	defer cancel()
+	start := time.Now()
+	rows, err := DBFromContext(r.Context()).QueryContext(queryCtx, `SELECT id, url, events, list_id FROM webhook WHERE owner_id IS ? ORDER BY id;`,
+		webhookOwner(r.Context()))
+	ObserveQuery("list_webhooks", start, err)
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	// Return an empty array instead of null when there are no webhooks
+	hooks := []Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		var events string
+		err = rows.Scan(&webhook.ID, &webhook.URL, &events, &webhook.ListID)
+		if err != nil {
+			break
+		}
+		webhook.Events = append([]string{}, splitList(events)...)
+		hooks = append(hooks, webhook)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return
+	}
+
+	// Tell the client that we are going to return JSON
+	w.Header().Add("Content-Type", "application/json")
+	// Tell the client that the status of the request is 200
+	w.WriteHeader(http.StatusOK)
+	// Return the JSON-encoded webhooks
+	err = json.NewEncoder(w).Encode(hooks)
+	if err != nil {
+		// Log encoding error for debugging
+		slog.ErrorContext(r.Context(), "error encoding webhooks", "error", err)
+	}
+}
+
+// HTTP handler for creating a webhook, the secret is only returned here
+func CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	// Webhook from the request body
+	var webhook Webhook
+
+	// Map webhook from request body to variable
+	err := json.NewDecoder(r.Body).Decode(&webhook)
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteBodyError(w, r, err)
+		return
+	}
+	err = webhook.validate(r.Context())
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return
+	}
+
+	// Generate a random secret unless the client brings its own
+	if webhook.Secret == "" {
+		secret := make([]byte, 32)
+		_, err = rand.Read(secret)
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+	if err == nil {
+		// Stop the query once it takes longer than the query timeout
+		queryCtx, cancel := WithQueryTimeout(r.Context())
+		defer cancel()
+		// Save webhook in database
+		start := time.Now()
+		var res sql.Result
+		res, err = DBFromContext(r.Context()).ExecContext(queryCtx, `INSERT INTO webhook (url, secret, events, list_id, owner_id) VALUES (?, ?, ?, ?, ?);`,
+			webhook.URL,
+			webhook.Secret,
+			strings.Join(webhook.Events, ","),
+			webhook.ListID,
+			webhookOwner(r.Context()),
+		)
+		ObserveQuery("create_webhook", start, err)
+		if err == nil {
+			webhook.ID, err = res.LastInsertId()
+		}
+	}
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return
+	}
+
+	// Tell the client that we are going to return JSON
+	w.Header().Add("Content-Type", "application/json")
+	// Tell the client that the status of the request is 200
+	w.WriteHeader(http.StatusOK)
+	// Return the JSON-encoded new webhook
+	err = json.NewEncoder(w).Encode(webhook)
+	if err != nil {
+		// Log encoding error for debugging
+		slog.ErrorContext(r.Context(), "error encoding webhook", "error", err)
+	}
+}
+
+// HTTP handler for getting a webhook by ID
+func ReadWebhook(w http.ResponseWriter, r *http.Request) {
+	webhookID, ok := parseIDParam(w, r, "webhook_id")
+	if !ok {
+		return
+	}
+
+	webhook, err := getWebhook(r.Context(), webhookID)
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return
+	}
+
+	// Tell the client that we are going to return JSON
+	w.Header().Add("Content-Type", "application/json")
+	// Tell the client that the status of the request is 200
+	w.WriteHeader(http.StatusOK)
+	// Return the JSON-encoded webhook
+	err = json.NewEncoder(w).Encode(webhook)
+	if err != nil {
+		// Log encoding error for debugging
+		slog.ErrorContext(r.Context(), "error encoding webhook", "error", err)
+	}
+}
+
+// HTTP handler for changing a webhook, the secret is only replaced when a new one is given
+func UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	webhookID, ok := parseIDParam(w, r, "webhook_id")
+	if !ok {
+		return
+	}
+
+	// Webhook from the request body
+	var webhook Webhook
+
+	// Map webhook from request body to variable
+	err := json.NewDecoder(r.Body).Decode(&webhook)
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteBodyError(w, r, err)
+		return
+	}
+	// Set its ID equal to the URL path variable
+	webhook.ID = webhookID
+
+	err = webhook.validate(r.Context())
+	if err == nil {
+		// Stop the query once it takes longer than the query timeout
+		queryCtx, cancel := WithQueryTimeout(r.Context())
+		defer cancel()
+		// Update webhook in database, keeping the secret unless there is a new one
+		start := time.Now()
+		var res sql.Result
+		res, err = DBFromContext(r.Context()).ExecContext(queryCtx, `UPDATE webhook SET url = ?, events = ?, list_id = ?,
+			secret = coalesce(nullif(?, ''), secret) WHERE id = ? AND owner_id IS ?;`,
+			webhook.URL,
+			strings.Join(webhook.Events, ","),
+			webhook.ListID,
+			webhook.Secret,
+			webhook.ID,
+			webhookOwner(r.Context()),
+		)
+		ObserveQuery("update_webhook", start, err)
+		var rowsAffected int64
+		if err == nil {
+			rowsAffected, err = res.RowsAffected()
+		}
+		if err == nil && rowsAffected == 0 {
+			err = NewHTTPError("No webhook with id "+strconv.FormatInt(webhookID, 10)+" exists", http.StatusNotFound, "Not Found")
+		}
+	}
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return
+	}
+
+	// Tell the client that we are going to return JSON
+	w.Header().Add("Content-Type", "application/json")
+	// Tell the client that the status of the request is 200
+	w.WriteHeader(http.StatusOK)
+	// Return the JSON-encoded webhook
+	err = json.NewEncoder(w).Encode(webhook)
+	if err != nil {
+		// Log encoding error for debugging
+		slog.ErrorContext(r.Context(), "error encoding webhook", "error", err)
+	}
+}
+
+// HTTP handler for removing a webhook together with its deliveries
+func DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	webhookID, ok := parseIDParam(w, r, "webhook_id")
+	if !ok {
+		return
+	}
+
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(r.Context())
+	defer cancel()
+	err := inTx(queryCtx, func(tx *sql.Tx) error {
+		start := time.Now()
+		res, err := tx.ExecContext(queryCtx, `DELETE FROM webhook WHERE id = ? AND owner_id IS ?;`, webhookID, webhookOwner(r.Context()))
+		ObserveQuery("delete_webhook", start, err)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			return NewHTTPError("No webhook with id "+strconv.FormatInt(webhookID, 10)+" exists", http.StatusNotFound, "Not Found")
+		}
+
+		// Pending deliveries have nowhere to go anymore
+		start = time.Now()
+		_, err = tx.ExecContext(queryCtx, `DELETE FROM webhook_delivery WHERE webhook_id = ?;`, webhookID)
+		ObserveQuery("delete_webhook_deliveries", start, err)
+		return err
+	})
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return
+	}
+
+	// Tell the client that the status of the request is 204
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HTTP handler for the delivery log of a webhook, newest first and optionally only those with a status
+func ReadWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	webhookID, ok := parseIDParam(w, r, "webhook_id")
+	if !ok {
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status != "" && status != DeliveryPending && status != DeliveryDelivered && status != DeliveryDead {
+		// Return the JSON-encoded error message
+		WriteHTTPError(w, r, "Status must be one of pending, delivered or dead", http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	// Make sure the webhook belongs to the user
+	_, err := getWebhook(r.Context(), webhookID)
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return
+	}
+
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(r.Context())
+	defer cancel()
+	start := time.Now()
+	rows, err := DBFromContext(r.Context()).QueryContext(queryCtx, `SELECT id, webhook_id, event, payload, status, attempts,
+		last_status_code, last_error, created_at, next_attempt_at FROM webhook_delivery
+		WHERE webhook_id = ? AND (? = '' OR status = ?) ORDER BY id DESC LIMIT 100;`, webhookID, status, status)
+	ObserveQuery("list_webhook_deliveries", start, err)
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	// Return an empty array instead of null when there are no deliveries
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		var payload string
+		var createdAt, nextAttemptAt int64
+		err = rows.Scan(&d.ID, &d.WebhookID, &d.Event, &payload, &d.Status, &d.Attempts,
+			&d.LastStatusCode, &d.LastError, &createdAt, &nextAttemptAt)
+		if err != nil {
+			break
+		}
+		d.Payload = json.RawMessage(payload)
+		d.CreatedAt = time.UnixMilli(createdAt).UTC()
+		if d.Status == DeliveryPending {
+			next := time.UnixMilli(nextAttemptAt).UTC()
+			d.NextAttemptAt = &next
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return
+	}
+
+	// Tell the client that we are going to return JSON
+	w.Header().Add("Content-Type", "application/json")
+	// Tell the client that the status of the request is 200
+	w.WriteHeader(http.StatusOK)
+	// Return the JSON-encoded deliveries
+	err = json.NewEncoder(w).Encode(deliveries)
+	if err != nil {
+		// Log encoding error for debugging
+		slog.ErrorContext(r.Context(), "error encoding webhook deliveries", "error", err)
+	}
+}
+
+// HTTP handler for sending a dead delivery again, with a fresh set of attempts
+func RetryWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	webhookID, ok := parseIDParam(w, r, "webhook_id")
+	if !ok {
+		return
+	}
+	deliveryID, ok := parseIDParam(w, r, "delivery_id")
+	if !ok {
+		return
+	}
+
+	// Stop the query once it takes longer than the query timeout
+	queryCtx, cancel := WithQueryTimeout(r.Context())
+	defer cancel()
+	start := time.Now()
+	res, err := DBFromContext(r.Context()).ExecContext(queryCtx, `UPDATE webhook_delivery SET status = ?, attempts = 0, next_attempt_at = ?
+		WHERE id = ? AND status = ? AND webhook_id IN (SELECT id FROM webhook WHERE id = ? AND owner_id IS ?);`,
+		DeliveryPending, time.Now().UnixMilli(), deliveryID, DeliveryDead, webhookID, webhookOwner(r.Context()))
+	ObserveQuery("retry_webhook_delivery", start, err)
+	var rowsAffected int64
+	if err == nil {
+		rowsAffected, err = res.RowsAffected()
+	}
+	if err == nil && rowsAffected == 0 {
+		err = NewHTTPError("No dead delivery with id "+strconv.FormatInt(deliveryID, 10)+" exists for webhook "+strconv.FormatInt(webhookID, 10), http.StatusNotFound, "Not Found")
+	}
+	if err != nil {
+		// Return the JSON-encoded error message
+		WriteError(w, r, err)
+		return
+	}
+
+	// Send it right away
+	webhooks.Wake()
+
+	// Tell the client that the status of the request is 204
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	s := &WebhookSender{backoff: 30 * time.Second, maxBackoff: time.Hour}
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{8, time.Hour},
+		// Shifting by this much would overflow
+		{31, time.Hour},
+		{64, time.Hour},
+		{1000, time.Hour},
+	}
+	for _, test := range tests {
+		// Jitter takes off up to a tenth
+		delay := s.retryDelay(test.attempts)
+		if delay > test.want || delay < test.want-test.want/10 {
+			t.Errorf("attempt %d: got delay %v, want about %v", test.attempts, delay, test.want)
+		}
+	}
+}
+
+func TestInternalAddr(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1":            true,
+		"::1":                  true,
+		"10.1.2.3":             true,
+		"172.16.0.1":           true,
+		"192.168.1.1":          true,
+		"169.254.169.254":      true,
+		"fe80::1":              true,
+		"fd00::1":              true,
+		"0.0.0.0":              true,
+		"100.64.0.1":           true,
+		"::ffff:127.0.0.1":     true,
+		"::ffff:10.0.0.1":      true,
+		"93.184.215.14":        false,
+		"2606:4700::6810:1":    false,
+		"::ffff:93.184.215.14": false,
+	}
+	for address, internal := range tests {
+		if got := internalAddr(netip.MustParseAddr(address)); got != internal {
+			t.Errorf("%s: got internal %t, want %t", address, got, internal)
+		}
+	}
+}
+
+func TestWebhookRejectsInternalURLs(t *testing.T) {
+	server, issuer := setupTestServer(t)
+	token := issuer.token(t, issuer.key, "alice", nil)
+
+	tests := map[string]int{
+		"http://127.0.0.1:8080/hook":       http.StatusBadRequest,
+		"http://localhost/hook":            http.StatusBadRequest,
+		"http://[::1]/hook":                http.StatusBadRequest,
+		"http://169.254.169.254/latest":    http.StatusBadRequest,
+		"http://10.0.0.1/hook":             http.StatusBadRequest,
+		"https://93.184.215.14/hook":       http.StatusOK,
+		"https://[2606:4700::6810:1]/hook": http.StatusOK,
+	}
+	for url, status := range tests {
+		res, body := testRequest(t, server, token, http.MethodPost, "/webhooks", map[string]any{"url": url})
+		if res.StatusCode != status {
+			t.Errorf("%s: got status %d, want %d: %s", url, res.StatusCode, status, body)
+		}
+	}
+}
+
+// setupTestWebhooks replaces the webhook sender for the duration of the test
+func setupTestWebhooks(t *testing.T, options WebhookOptions) *WebhookSender {
+	t.Helper()
+	previous := webhooks
+	webhooks = SetupWebhooks(options)
+	t.Cleanup(func() { webhooks = previous })
+	return webhooks
+}
+
+// testWebhookOptions are the default webhook options with short waits, reaching receivers on the loopback address
+func testWebhookOptions() WebhookOptions {
+	options := DefaultConfig().Webhook
+	options.Timeout = 5 * time.Second
+	options.Interval = 10 * time.Millisecond
+	options.AllowPrivate = true
+	return options
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	server, issuer := setupTestServer(t)
+	token := issuer.token(t, issuer.key, "alice", nil)
+	sender := setupTestWebhooks(t, testWebhookOptions())
+
+	type received struct {
+		header  http.Header
+		payload []byte
+	}
+	deliveries := make(chan received, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := io.ReadAll(r.Body)
+		deliveries <- received{header: r.Header, payload: payload}
+	}))
+	t.Cleanup(receiver.Close)
+
+	var webhook Webhook
+	res, body := testRequest(t, server, token, http.MethodPost, "/webhooks", map[string]any{"url": receiver.URL, "events": []string{EventCreated}})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("creating webhook: %d %s", res.StatusCode, body)
+	}
+	decodeTestJSON(t, body, &webhook)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- sender.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	res, body = testRequest(t, server, token, http.MethodPost, "/todo", map[string]any{"description": "call me"})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("creating todo item: %d %s", res.StatusCode, body)
+	}
+
+	var got received
+	select {
+	case got = <-deliveries:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook wasn't delivered")
+	}
+	var payload WebhookPayload
+	decodeTestJSON(t, got.payload, &payload)
+	if payload.Event != EventCreated || payload.Todo.Description != "call me" {
+		t.Errorf("got payload %s", got.payload)
+	}
+	if got.header.Get("X-Webhook-Event") != EventCreated {
+		t.Errorf("got event header %q", got.header.Get("X-Webhook-Event"))
+	}
+	signature := "sha256=" + webhookSignature(webhook.Secret, got.header.Get("X-Webhook-Timestamp"), got.payload)
+	if got.header.Get("X-Webhook-Signature") != signature {
+		t.Errorf("got signature %q, want %q", got.header.Get("X-Webhook-Signature"), signature)
+	}
+
+	// The outcome is recorded in the delivery log
+	path := "/webhooks/" + strconv.FormatInt(webhook.ID, 10) + "/deliveries"
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var log []WebhookDelivery
+		_, body = testRequest(t, server, token, http.MethodGet, path, nil)
+		decodeTestJSON(t, body, &log)
+		if len(log) == 1 && log[0].Status == DeliveryDelivered {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("delivery log is %s", body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookDeliveryConcurrency(t *testing.T) {
+	setupTestDB(t)
+	options := testWebhookOptions()
+	options.Workers = 2
+	sender := setupTestWebhooks(t, options)
+
+	var current, most atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := current.Add(1)
+		defer current.Add(-1)
+		for {
+			m := most.Load()
+			if n <= m || most.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}))
+	t.Cleanup(receiver.Close)
+
+	_, err := db.Exec(`INSERT INTO webhook (url, secret, events) VALUES (?, 'secret', '');`, receiver.URL)
+	if err != nil {
+		t.Fatalf("error creating webhook: %v", err)
+	}
+	for range 6 {
+		_, err = store.Create(context.Background(), TodoItem{Description: "item"})
+		if err != nil {
+			t.Fatalf("error creating todo item: %v", err)
+		}
+	}
+
+	err = sender.deliverDue(context.Background(), "", db)
+	if err != nil {
+		t.Fatalf("error delivering: %v", err)
+	}
+	if most.Load() != 2 {
+		t.Errorf("at most %d deliveries were sent at the same time, want 2", most.Load())
+	}
+	var delivered int
+	err = db.QueryRow(`SELECT count(*) FROM webhook_delivery WHERE status = ?;`, DeliveryDelivered).Scan(&delivered)
+	if err != nil || delivered != 6 {
+		t.Errorf("%d deliveries were delivered, want 6: %v", delivered, err)
+	}
+}
+
+func TestWebhookDeliveryRefusesInternalAddresses(t *testing.T) {
+	setupTestDB(t)
+	options := testWebhookOptions()
+	options.AllowPrivate = false
+	sender := setupTestWebhooks(t, options)
+
+	// A receiver whose host resolved to a public address when it was registered can point elsewhere by now
+	var hits atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	t.Cleanup(receiver.Close)
+	_, err := db.Exec(`INSERT INTO webhook (url, secret, events) VALUES (?, 'secret', '');`, receiver.URL)
+	if err != nil {
+		t.Fatalf("error creating webhook: %v", err)
+	}
+	_, err = store.Create(context.Background(), TodoItem{Description: "item"})
+	if err != nil {
+		t.Fatalf("error creating todo item: %v", err)
+	}
+
+	err = sender.deliverDue(context.Background(), "", db)
+	if err != nil {
+		t.Fatalf("error delivering: %v", err)
+	}
+	if hits.Load() != 0 {
+		t.Fatal("delivery reached a receiver on the loopback address")
+	}
+	var status, lastError string
+	err = db.QueryRow(`SELECT status, last_error FROM webhook_delivery;`).Scan(&status, &lastError)
+	if err != nil || status != DeliveryPending || !strings.Contains(lastError, "internal") {
+		t.Errorf("delivery is %s with error %q: %v", status, lastError, err)
+	}
+}
+
+func TestTodoUpdateConcurrentCompletion(t *testing.T) {
+	setupTestDB(t)
+	_, err := db.Exec(`INSERT INTO webhook (url, secret, events) VALUES ('https://93.184.215.14/hook', 'secret', ?);`, EventCompleted)
+	if err != nil {
+		t.Fatalf("error creating webhook: %v", err)
+	}
+	todo, err := store.Create(context.Background(), TodoItem{Description: "race"})
+	if err != nil {
+		t.Fatalf("error creating todo item: %v", err)
+	}
+
+	// Only the update that actually completes the item sends the completed event, however many try at once
+	const rounds = 10
+	for range rounds {
+		todo.Done = false
+		_, err = store.Update(context.Background(), todo)
+		if err != nil {
+			t.Fatalf("error reopening todo item: %v", err)
+		}
+
+		todo.Done = true
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				_, err := store.Update(context.Background(), todo)
+				if err != nil {
+					t.Errorf("error updating todo item: %v", err)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+	}
+
+	var completed int
+	err = db.QueryRow(`SELECT count(*) FROM webhook_delivery WHERE event = ?;`, EventCompleted).Scan(&completed)
+	if err != nil || completed != rounds {
+		t.Errorf("%d completed deliveries were enqueued, want %d: %v", completed, rounds, err)
+	}
+}